@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/model"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"os"
+	"strings"
+)
+
+const (
+	// AuthorizationKey is the gRPC metadata key carrying
+	// a source token, as "Bearer <token>"
+	AuthorizationKey = "authorization"
+
+	// TokenPrefix starts every source token, so they're easy to spot
+	TokenPrefix = "kyt_"
+)
+
+// TokenStore finds the unexpired, unrevoked source token with a hash
+type TokenStore interface {
+	GetActiveSourceToken(ctx context.Context, tokenHash []byte) (model.SourceToken, error)
+}
+
+// NewToken generates a source token. Only its hash is stored
+func NewToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HashToken returns the hash a source token is stored as
+func HashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// Authenticator checks the credentials of source plugins opening streams,
+// recording the source they authenticated as on the stream's context
+type Authenticator struct {
+	required bool
+	tokens   TokenStore
+	logger   *zap.Logger
+}
+
+// NewAuthenticator checks source tokens against the store, which is nil
+// without a database. Sources without credentials are let through
+// unless authentication is required
+func NewAuthenticator(cfg config.GrpcServer, tokens TokenStore, logger *zap.Logger) (*Authenticator, error) {
+	if cfg.Auth.Required && tokens == nil && cfg.Tls.ClientCaFile == "" {
+		return nil, errors.New("required authentication needs a database for source tokens, or a client CA for certificates")
+	}
+	return &Authenticator{required: cfg.Auth.Required, tokens: tokens, logger: logger}, nil
+}
+
+type authenticatedKey struct{}
+
+// Source returns the name of the source a call or stream authenticated as
+func Source(ctx context.Context) (string, bool) {
+	source, ok := ctx.Value(authenticatedKey{}).(string)
+	return source, ok
+}
+
+// authenticate checks a source token when one is sent, and otherwise
+// a verified client certificate, whose common name names the source
+func (a *Authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	if token, ok := bearerToken(ctx); ok {
+		if a.tokens == nil {
+			return nil, status.Error(codes.Unauthenticated, "source tokens are not enabled")
+		}
+		row, err := a.tokens.GetActiveSourceToken(ctx, HashToken(token))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, status.Error(codes.Unauthenticated, "invalid source token")
+		}
+		if err != nil {
+			a.logger.Error("failed to check source token", zap.Error(err))
+			return nil, status.Error(codes.Unavailable, "failed to check source token")
+		}
+		return context.WithValue(ctx, authenticatedKey{}, row.Source), nil
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			if name := info.State.VerifiedChains[0][0].Subject.CommonName; name != "" {
+				return context.WithValue(ctx, authenticatedKey{}, name), nil
+			}
+		}
+	}
+
+	if a.required {
+		return nil, status.Error(codes.Unauthenticated, "source token or client certificate required")
+	}
+	return ctx, nil
+}
+
+func bearerToken(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	values := md.Get(AuthorizationKey)
+	if len(values) == 0 {
+		return "", false
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	return token, ok && token != ""
+}
+
+// healthService is left open, so orchestrators can check
+// the server's health without credentials
+const healthService = "/grpc.health.v1.Health/"
+
+// UnaryInterceptor authenticates unary calls
+func (a *Authenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if info != nil && strings.HasPrefix(info.FullMethod, healthService) {
+			return handler(ctx, req)
+		}
+		ctx, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor authenticates streams
+func (a *Authenticator) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if info != nil && strings.HasPrefix(info.FullMethod, healthService) {
+			return handler(srv, stream)
+		}
+		ctx, err := a.authenticate(stream.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// authenticatedStream carries the authenticated source on its context
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// ServerCredentials loads the server's TLS certificate, and the client
+// CAs for mutual TLS. It returns nil when TLS isn't configured
+func ServerCredentials(cfg config.ServerTls) (credentials.TransportCredentials, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		if cfg.ClientCaFile != "" {
+			return nil, errors.New("mutual TLS needs a server certificate and key")
+		}
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCaFile != "" {
+		content, err := os.ReadFile(cfg.ClientCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ClientCaFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/jackc/pgx/v5"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/model"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"strings"
+	"testing"
+)
+
+// tokenStore holds a single token for a source
+type tokenStore struct {
+	hash   []byte
+	source string
+}
+
+func (s *tokenStore) GetActiveSourceToken(_ context.Context, tokenHash []byte) (model.SourceToken, error) {
+	if !bytes.Equal(tokenHash, s.hash) {
+		return model.SourceToken{}, pgx.ErrNoRows
+	}
+	return model.SourceToken{Source: s.source, TokenHash: tokenHash}, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	token, err := NewToken()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, TokenPrefix))
+
+	auth, err := NewAuthenticator(config.GrpcServer{Auth: config.GrpcAuth{Required: true}}, &tokenStore{hash: HashToken(token), source: "audit"}, zap.NewNop())
+	assert.NoError(t, err)
+
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(AuthorizationKey, "Bearer "+token))
+	}
+	ctx, err := auth.authenticate(withToken(token))
+	assert.NoError(t, err)
+	source, ok := Source(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "audit", source)
+
+	_, err = auth.authenticate(withToken(TokenPrefix + "guess"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = auth.authenticate(context.Background())
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Verified client certificates name their source
+	ctx = peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "edge-1"}}}},
+	}}})
+	ctx, err = auth.authenticate(ctx)
+	assert.NoError(t, err)
+	source, _ = Source(ctx)
+	assert.Equal(t, "edge-1", source)
+}
+
+func TestAuthenticateOptional(t *testing.T) {
+	_, err := NewAuthenticator(config.GrpcServer{Auth: config.GrpcAuth{Required: true}}, nil, zap.NewNop())
+	assert.Error(t, err)
+
+	auth, err := NewAuthenticator(config.GrpcServer{}, nil, zap.NewNop())
+	assert.NoError(t, err)
+	ctx, err := auth.authenticate(context.Background())
+	assert.NoError(t, err)
+	_, ok := Source(ctx)
+	assert.False(t, ok)
+}
+
+func TestHealthUnauthenticated(t *testing.T) {
+	auth, err := NewAuthenticator(config.GrpcServer{Auth: config.GrpcAuth{Required: true}}, &tokenStore{}, zap.NewNop())
+	assert.NoError(t, err)
+	handler := func(ctx context.Context, req any) (any, error) {
+		return "ok", nil
+	}
+
+	// Orchestrators check health without credentials
+	_, err = auth.UnaryInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}, handler)
+	assert.NoError(t, err)
+	_, err = auth.UnaryInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/plugin.SourcePlugin/StreamLogs"}, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kytheron-org/kytheron/auth"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/model"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var tokensCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "Manage the tokens source plugins authenticate with",
+}
+
+var createTokenCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a token for a source, printing it once",
+	Run: func(cmd *cobra.Command, args []string) {
+		source, _ := cmd.Flags().GetString("source")
+		name, _ := cmd.Flags().GetString("name")
+		expires, _ := cmd.Flags().GetDuration("expires")
+
+		token, err := auth.NewToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		params := model.CreateSourceTokenParams{
+			Source:    source,
+			Name:      name,
+			TokenHash: auth.HashToken(token),
+		}
+		if expires > 0 {
+			params.ExpiresAt = pgtype.Timestamptz{Time: time.Now().Add(expires), Valid: true}
+		}
+
+		pool := connect(cmd)
+		defer pool.Close()
+		created, err := model.New(pool).CreateSourceToken(cmd.Context(), params)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Only the hash is stored, so the token can't be shown again
+		fmt.Fprintf(os.Stderr, "Created token %s for source %s\n", formatUuid(created.ID), created.Source)
+		fmt.Println(token)
+	},
+}
+
+var listTokensCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List source tokens",
+	Run: func(cmd *cobra.Command, args []string) {
+		pool := connect(cmd)
+		defer pool.Close()
+		tokens, err := model.New(pool).ListSourceTokens(cmd.Context())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSOURCE\tNAME\tCREATED\tEXPIRES\tREVOKED")
+		for _, token := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				formatUuid(token.ID),
+				token.Source,
+				token.Name,
+				formatTime(token.CreatedAt),
+				formatTime(token.ExpiresAt),
+				formatTime(token.RevokedAt),
+			)
+		}
+		w.Flush()
+	},
+}
+
+var revokeTokenCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke a source token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var id pgtype.UUID
+		if err := id.Scan(args[0]); err != nil {
+			log.Fatalf("invalid token id %q: %s", args[0], err)
+		}
+
+		pool := connect(cmd)
+		defer pool.Close()
+		revoked, err := model.New(pool).RevokeSourceToken(cmd.Context(), id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if revoked == 0 {
+			log.Fatalf("no active token %s", args[0])
+		}
+		fmt.Println("Revoked token", args[0])
+	},
+}
+
+// connect opens a pool to the configured database
+func connect(cmd *cobra.Command) *pgxpool.Pool {
+	configPath, _ := cmd.Flags().GetString("config")
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Database.Url == "" {
+		log.Fatal("no database configured")
+	}
+
+	pool, err := pgxpool.New(context.Background(), fmt.Sprintf("postgres://%s", cfg.Database.Url))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pool
+}
+
+func formatUuid(id pgtype.UUID) string {
+	value, _ := id.Value()
+	if value == nil {
+		return "-"
+	}
+	return value.(string)
+}
+
+func formatTime(t pgtype.Timestamptz) string {
+	if !t.Valid {
+		return "-"
+	}
+	return t.Time.Format(time.RFC3339)
+}
+
+func init() {
+	tokensCmd.PersistentFlags().StringP("config", "c", ".config.yaml", "path to config file")
+	createTokenCmd.Flags().String("source", "", "source the token authenticates as")
+	createTokenCmd.Flags().String("name", "", "name describing the token")
+	createTokenCmd.Flags().Duration("expires", 0, "how long the token is valid for, forever when unset")
+	createTokenCmd.MarkFlagRequired("source")
+	tokensCmd.AddCommand(createTokenCmd, listTokensCmd, revokeTokenCmd)
+	rootCmd.AddCommand(tokensCmd)
+}
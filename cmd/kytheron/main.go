@@ -11,6 +11,8 @@ import (
 	"go.uber.org/zap/zapcore"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var kytheronCmd = &cobra.Command{
@@ -19,45 +21,12 @@ var kytheronCmd = &cobra.Command{
 		// Load our config
 		configPath, _ := cmd.Flags().GetString("config")
 
-		//policyPath, _ := cmd.Flags().GetString("policy")
-		//
-		//var policies []*policy.Policy
-		//matches, err := filepath.Glob(policyPath)
-		//if err != nil {
-		//	log.Fatalf("Error globbing pattern %s: %v", policyPath, err)
-		//}
-		//for _, match := range matches {
-		//	policyContents, err := ioutil.ReadFile(match)
-		//	if err != nil {
-		//		log.Fatal(err)
-		//	}
-		//	p, err := policy.Decode(match, policyContents)
-		//	if err != nil {
-		//		log.Fatal(err)
-		//	}
-		//	policies = append(policies, p)
-		//}
-
 		cfg, err := config.Load(configPath)
 		if err != nil {
 			log.Fatal(err)
 		}
 		fmt.Println(cfg.LogLevel)
-		atom := zap.NewAtomicLevel()
-		switch cfg.LogLevel {
-		case "debug":
-			atom.SetLevel(zapcore.DebugLevel)
-		default:
-			atom.SetLevel(zapcore.InfoLevel)
-		}
-
-		encoderConfig := zap.NewProductionEncoderConfig()
-		core := zapcore.NewCore(
-			zapcore.NewJSONEncoder(encoderConfig),
-			zapcore.AddSync(os.Stdout),
-			atom, // Use the AtomicLevel here
-		)
-		logger := zap.New(core)
+		logger := newLogger(cfg)
 		defer logger.Sync()
 
 		pluginRegistry := registry.NewPluginRegistry(cfg.Registry.CacheDir)
@@ -67,16 +36,39 @@ var kytheronCmd = &cobra.Command{
 			}
 		}
 
-		k := kytheron.New(cfg, pluginRegistry, logger)
-		if err := k.Run(); err != nil {
+		k, err := kytheron.New(cfg, pluginRegistry, logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Stop on SIGINT/SIGTERM, draining in-flight logs first
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := k.Run(ctx); err != nil {
 			log.Fatal(err)
 		}
 	},
 }
 
+func newLogger(cfg *config.Config) *zap.Logger {
+	atom := zap.NewAtomicLevel()
+	switch cfg.LogLevel {
+	case "debug":
+		atom.SetLevel(zapcore.DebugLevel)
+	default:
+		atom.SetLevel(zapcore.InfoLevel)
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(encoderConfig),
+		zapcore.AddSync(os.Stdout),
+		atom, // Use the AtomicLevel here
+	)
+	return zap.New(core)
+}
+
 func init() {
 	kytheronCmd.Flags().StringP("config", "c", ".config.yaml", "path to config file")
-	kytheronCmd.Flags().StringP("policy", "p", "", "path to policy file")
 }
 
 func main() {
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/kytheron"
+	"github.com/spf13/cobra"
+	"log"
+	"time"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Replay dead-lettered messages onto their topic",
+	Run: func(cmd *cobra.Command, args []string) {
+		configPath, _ := cmd.Flags().GetString("config")
+		stage, _ := cmd.Flags().GetString("stage")
+		idle, _ := cmd.Flags().GetDuration("idle")
+
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger := newLogger(cfg)
+		defer logger.Sync()
+
+		replayed, err := kytheron.Replay(cfg, stage, idle, logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Replayed %d messages\n", replayed)
+	},
+}
+
+func init() {
+	replayCmd.Flags().StringP("config", "c", ".config.yaml", "path to config file")
+	replayCmd.Flags().String("stage", kytheron.StageIngest, "stage of the dead-lettered messages to replay")
+	replayCmd.Flags().Duration("idle", 5*time.Second, "stop once no message arrives for this long")
+	kytheronCmd.AddCommand(replayCmd)
+}
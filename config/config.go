@@ -2,6 +2,7 @@ package config
 
 import (
 	"github.com/spf13/viper"
+	"time"
 )
 
 type Plugin struct {
@@ -11,27 +12,280 @@ type Plugin struct {
 }
 
 type Config struct {
-	Plugins  map[string]Plugin `yaml:"plugins"`
-	Policies Policies          `yaml:"policies"`
-	Server   Server            `yaml:"server"`
-	Registry Registry          `yaml:"registry"`
-	Database Database          `yaml:"database"`
-	Kafka    KafkaMap          `yaml:"kafka"`
-	LogLevel string            `yaml:"logLevel"`
-	Loki     Loki              `yaml:"loki"`
+	Plugins   map[string]Plugin `yaml:"plugins"`
+	Policies  Policies          `yaml:"policies"`
+	Server    Server            `yaml:"server"`
+	Registry  Registry          `yaml:"registry"`
+	Database  Database          `yaml:"database"`
+	Kafka     KafkaMap          `yaml:"kafka"`
+	LogLevel  string            `yaml:"logLevel"`
+	Loki      Loki              `yaml:"loki"`
+	Outputs   Outputs           `yaml:"outputs"`
+	Pipelines []Pipeline        `yaml:"pipelines"`
+	Queue     Queue             `yaml:"queue"`
+	Storage   Storage           `yaml:"storage"`
+	Tracing   Tracing           `yaml:"tracing"`
+}
+
+const (
+	QueueDriverKafka  = "kafka"
+	QueueDriverInline = "inline"
+	QueueDriverFile   = "file"
+)
+
+// Queue selects how messages are passed between the pipeline stages
+type Queue struct {
+	// Driver is kafka, inline to pass messages over bounded
+	// in-process channels without a broker, or file to keep
+	// them in a durable log on the local filesystem
+	Driver string `yaml:"driver"`
+	// Size of each topic's buffer for the inline driver
+	Size int `yaml:"size"`
+	// Dir holds the file driver's topics
+	Dir string `yaml:"dir"`
+	// SegmentBytes is the size of each of the file driver's log segments
+	SegmentBytes int64 `yaml:"segmentBytes"`
+	// Sync flushes each message to disk as it is published
+	Sync bool `yaml:"sync"`
+	// Commit batches the offsets committed for processed messages
+	Commit QueueCommit `yaml:"commit"`
+}
+
+// QueueCommit batches offset commits. A message's offset is only
+// committed once it has been fully processed, and a batch is committed
+// when either limit is reached, so a crash redelivers at most a batch
+type QueueCommit struct {
+	Messages int           `yaml:"messages"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Pipeline routes raw logs from a source to the parsers that handle
+// them. Parsers are tried in order until one parses the log
+type Pipeline struct {
+	Name string `yaml:"name"`
+	// Source is the name of the source plugin sending logs,
+	// or * to match any source without its own pipeline
+	Source string `yaml:"source"`
+	// Topic the source's raw logs are published to, defaulting to the
+	// ingest topic suffixed with the source's name. Pipelines for any
+	// source use the ingest topic
+	Topic   string   `yaml:"topic"`
+	Parsers []string `yaml:"parsers"`
+	// TopicSettings provision the source's topic, defaulting
+	// to those of the ingest topic
+	TopicSettings `mapstructure:",squash"`
+	// Timestamp locates the time of the logged event in parsed logs,
+	// which are stored at the time they're received without it
+	Timestamp Timestamp `yaml:"timestamp"`
+	// Labels and Metadata map names to JSONPaths of parsed logs, whose
+	// values are stored as stream labels or structured metadata
+	Labels   map[string]string `yaml:"labels"`
+	Metadata map[string]string `yaml:"metadata"`
+	// MaxLabelValues limits the values of each label. Values beyond
+	// the limit are stored as structured metadata instead
+	MaxLabelValues int `yaml:"maxLabelValues"`
+}
+
+// Timestamp locates the event time of a parsed log
+type Timestamp struct {
+	// Path is a JSONPath of the parsed log, such as $.eventTime
+	Path string `yaml:"path"`
+	// Format of the timestamp, a Go time layout or unix, unix_ms or
+	// unix_ns for epoch times. Defaults to RFC 3339, or unix for numbers
+	Format string `yaml:"format"`
+}
+
+// Outputs configures delivery of detection hits to output plugins
+type Outputs struct {
+	// Timeout of a single delivery attempt
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries after the first failed attempt
+	Retries int `yaml:"retries"`
+	// Backoff before the first retry, doubling on each retry after
+	Backoff time.Duration `yaml:"backoff"`
 }
 
 type Loki struct {
 	Url string `yaml:"url"`
+	// TenantId is sent as the X-Scope-OrgID header, for multi-tenant Loki
+	TenantId string `yaml:"tenantId"`
+	// Encoding of push requests, protobuf for snappy compressed
+	// protobuf, or json for gzip compressed JSON
+	Encoding string `yaml:"encoding"`
+	// BatchSize is the size in bytes a batch grows to before it is sent
+	BatchSize int `yaml:"batchSize"`
+	// BatchWait is the longest an entry waits for its batch to be sent
+	BatchWait time.Duration `yaml:"batchWait"`
+	// BufferSize is the number of entries waiting to be batched, after
+	// which pushing blocks until a batch has been sent
+	BufferSize int `yaml:"bufferSize"`
+	// Timeout of a single push request
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries of a batch rejected with a 429 or 5xx status, backing off
+	// from MinBackoff and doubling up to MaxBackoff between attempts
+	Retries    int           `yaml:"retries"`
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+const (
+	SinkLoki     = "loki"
+	SinkFile     = "file"
+	SinkPostgres = "postgres"
+	SinkS3       = "s3"
+)
+
+// Storage selects where parsed logs are kept long term
+type Storage struct {
+	// Sinks each parsed log is stored in, any of loki, file, postgres
+	// and s3. A log is only acknowledged once every sink has stored it.
+	// Defaults to loki when its url is set
+	Sinks    []string     `yaml:"sinks"`
+	File     FileSink     `yaml:"file"`
+	Postgres PostgresSink `yaml:"postgres"`
+	S3       S3Sink       `yaml:"s3"`
+}
+
+// SinkBatch batches the logs written to a sink
+type SinkBatch struct {
+	// BatchSize is the number of logs a batch grows to before it is written
+	BatchSize int `yaml:"batchSize"`
+	// BatchWait is the longest a log waits for its batch to be written
+	BatchWait time.Duration `yaml:"batchWait"`
+	// BufferSize is the number of logs waiting to be batched, after
+	// which storing blocks until a batch has been written
+	BufferSize int `yaml:"bufferSize"`
+	// Retries of a failed batch, backing off from MinBackoff
+	// and doubling up to MaxBackoff between attempts
+	Retries    int           `yaml:"retries"`
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// FileSink writes parsed logs as newline delimited JSON to
+// files in a directory, starting a new file once the current
+// one reaches MaxBytes or MaxAge
+type FileSink struct {
+	Dir      string        `yaml:"dir"`
+	MaxBytes int64         `yaml:"maxBytes"`
+	MaxAge   time.Duration `yaml:"maxAge"`
+	// MaxFiles kept, removing the oldest beyond it. Zero keeps every file
+	MaxFiles  int `yaml:"maxFiles"`
+	SinkBatch `mapstructure:",squash"`
+}
+
+// PostgresSink writes parsed logs to the parsed_logs table of
+// the configured database, which is partitioned by day
+type PostgresSink struct {
+	// Retention drops partitions once all of their logs are older.
+	// Zero keeps every partition
+	Retention time.Duration `yaml:"retention"`
+	SinkBatch `mapstructure:",squash"`
+}
+
+// S3Sink writes each batch of parsed logs as a gzipped newline
+// delimited JSON object to an S3 compatible bucket
+type S3Sink struct {
+	// Endpoint of the object store, such as https://s3.us-east-1.amazonaws.com
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// Prefix of the keys objects are written to, followed by the hour of the batch
+	Prefix string `yaml:"prefix"`
+	// PathStyle addresses the bucket in the path rather than the host,
+	// as most S3 compatible stores expect
+	PathStyle       bool          `yaml:"pathStyle"`
+	AccessKeyId     string        `yaml:"accessKeyId"`
+	SecretAccessKey string        `yaml:"secretAccessKey"`
+	SessionToken    string        `yaml:"sessionToken"`
+	Timeout         time.Duration `yaml:"timeout"`
+	SinkBatch       `mapstructure:",squash"`
 }
 
+// Kafka configures the clients of a role, publishing
+// to and consuming from one of the pipeline's topics
 type Kafka struct {
 	Url string `yaml:"url"`
+	// Topic the role's messages are published to
+	Topic string `yaml:"topic"`
+	// GroupId the role's consumers join
+	GroupId       string `yaml:"groupId"`
+	KafkaClient   `mapstructure:",squash"`
+	TopicSettings `mapstructure:",squash"`
+}
+
+// KafkaClient configures the connection of a role's clients
+type KafkaClient struct {
+	Sasl Sasl `yaml:"sasl"`
+	Tls  Tls  `yaml:"tls"`
+	// Producer and Consumer hold librdkafka properties for the role's
+	// producer and consumer. They're applied over the connection settings
+	// above, but not over those Kytheron relies on for its delivery guarantees
+	Producer map[string]string `yaml:"producer"`
+	Consumer map[string]string `yaml:"consumer"`
+}
+
+type Sasl struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512,
+	// leaving SASL disabled when empty
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+type Tls struct {
+	Enabled  bool   `yaml:"enabled"`
+	CaFile   string `yaml:"caFile"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// InsecureSkipVerify disables verification of the broker's certificate
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+// TopicSettings are applied when provisioning a topic. Zero
+// values leave the setting to the broker's defaults
+type TopicSettings struct {
+	Partitions        int           `yaml:"partitions"`
+	ReplicationFactor int           `yaml:"replicationFactor"`
+	Retention         time.Duration `yaml:"retention"`
 }
 
 type KafkaMap struct {
-	Source Kafka `yaml:"source"`
-	Parser Kafka `yaml:"parser"`
+	// Provision creates missing topics on startup,
+	// and warns about existing topics' settings differing
+	Provision  bool       `yaml:"provision"`
+	Source     Kafka      `yaml:"source"`
+	Parser     Kafka      `yaml:"parser"`
+	DeadLetter DeadLetter `yaml:"deadLetter"`
+}
+
+// DeadLetter configures the topic receiving messages
+// that could not be handled by the processor
+type DeadLetter struct {
+	Url   string `yaml:"url"`
+	Topic string `yaml:"topic"`
+	// Attempts at handling a message before it is dead lettered
+	Attempts int `yaml:"attempts"`
+	// Backoff before the second attempt, doubling on each attempt after
+	Backoff       time.Duration `yaml:"backoff"`
+	KafkaClient   `mapstructure:",squash"`
+	TopicSettings `mapstructure:",squash"`
+}
+
+// Tracing exports a trace of each log through the pipeline over OTLP/gRPC.
+// The standard OTEL_EXPORTER_OTLP_* environment variables are honoured
+type Tracing struct {
+	// Endpoint of the OTLP collector, as host:port.
+	// Tracing is disabled when unset
+	Endpoint string `yaml:"endpoint"`
+	// Insecure connects to the collector without TLS
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio of the traces started by the server, from 0 to 1,
+	// sampling every trace when unset. Traces continued from a source
+	// plugin follow the plugin's sampling decision
+	SampleRatio float64 `yaml:"sampleRatio"`
+	// ServiceName the traces are reported under, defaulting to kytheron
+	ServiceName string `yaml:"serviceName"`
 }
 
 type Database struct {
@@ -41,16 +295,60 @@ type Database struct {
 type Server struct {
 	Http HttpServer `yaml:"http"`
 	Grpc GrpcServer `yaml:"grpc"`
+	// ShutdownTimeout bounds the time taken to drain
+	// in-flight work after a shutdown signal
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	Health          Health        `yaml:"health"`
+}
+
+// Health configures the readiness checks, which are run periodically
+// and reported by the gRPC health service and the http /readyz endpoint
+type Health struct {
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds each check
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxConsumerLag is the number of messages a topic's consumers may
+	// be behind before the server isn't ready. Zero disables the check
+	MaxConsumerLag int64 `yaml:"maxConsumerLag"`
 }
 
 type HttpServer struct {
+	// Address the management API listens on, defaulting to localhost
+	Address string `yaml:"address"`
+	// Port serves the management API, which is disabled when unset
 	Port int `yaml:"port"`
 }
 
 type GrpcServer struct {
-	Port               int `yaml:"port"`
-	MaxSendMessageSize int `yaml:"maxSendMessageSize"`
-	MaxRecvMessageSize int `yaml:"maxRecvMessageSize"`
+	// Address the server listens on, defaulting to localhost. Sources on
+	// other hosts need it to listen more widely, which should be paired
+	// with TLS and required authentication
+	Address            string `yaml:"address"`
+	Port               int    `yaml:"port"`
+	MaxSendMessageSize int    `yaml:"maxSendMessageSize"`
+	MaxRecvMessageSize int    `yaml:"maxRecvMessageSize"`
+	// MaxInFlightLogs limits the logs of a source's stream
+	// being published and awaiting acknowledgement at once
+	MaxInFlightLogs int       `yaml:"maxInFlightLogs"`
+	Tls             ServerTls `yaml:"tls"`
+	Auth            GrpcAuth  `yaml:"auth"`
+}
+
+// ServerTls serves over TLS when a certificate and key are set
+type ServerTls struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ClientCaFile enables mutual TLS, requiring clients
+	// to present a certificate signed by one of its CAs
+	ClientCaFile string `yaml:"clientCaFile"`
+}
+
+// GrpcAuth authenticates the source plugins streaming logs
+type GrpcAuth struct {
+	// Required rejects streams without a valid source token, sent as
+	// a bearer token in the authorization metadata, or a verified client
+	// certificate, whose common name is taken as the source's name
+	Required bool `yaml:"required"`
 }
 
 type Registry struct {
@@ -58,16 +356,22 @@ type Registry struct {
 }
 type Policies struct {
 	Url string `yaml:"url"`
+	// AllowInvalid starts the server with the policies that decoded
+	// successfully, rather than refusing to start on any decode error
+	AllowInvalid bool `yaml:"allowInvalid"`
 }
 
 func Load(path string) (*Config, error) {
-	viper.SetConfigFile(path)
+	// Kafka client properties are dotted, so keys
+	// can't be split on dots into nested settings
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	v.SetConfigFile(path)
 
 	// Bind environment variables
-	viper.SetEnvPrefix("kytheron")
+	v.SetEnvPrefix("kytheron")
 
 	// Find and read the config file
-	err := viper.ReadInConfig()
+	err := v.ReadInConfig()
 
 	// Handle errors
 	if err != nil {
@@ -75,7 +379,7 @@ func Load(path string) (*Config, error) {
 	}
 
 	var cfg Config
-	err = viper.Unmarshal(&cfg)
+	err = v.Unmarshal(&cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -18,7 +18,9 @@ func (c *Config) Filesystem(storageUrl string) (afero.Fs, error) {
 
 	switch location.Scheme {
 	case "os":
-		return afero.NewBasePathFs(afero.NewOsFs(), location.Path), nil
+		// Relative paths such as os://samples/policies parse with
+		// their first segment as the host
+		return afero.NewBasePathFs(afero.NewOsFs(), location.Host+location.Path), nil
 	default:
 		return nil, fmt.Errorf("unsupported storage scheme: %s", location.Scheme)
 	}
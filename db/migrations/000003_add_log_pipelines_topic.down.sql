@@ -0,0 +1 @@
+ALTER TABLE "log_pipelines" DROP COLUMN topic;
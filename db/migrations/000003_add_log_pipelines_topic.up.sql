@@ -0,0 +1,3 @@
+-- The ingest topic for logs from the pipeline's source,
+-- derived from the source's name when null
+ALTER TABLE "log_pipelines" ADD COLUMN topic VARCHAR(249) NULL;
@@ -0,0 +1 @@
+DROP TABLE "parsed_logs";
@@ -0,0 +1,20 @@
+CREATE TABLE "parsed_logs" (
+    -- Id of the parsed log
+    id UUID NOT NULL,
+    -- Id of the raw log the log was parsed from
+    source_id UUID NULL,
+    -- The source plugin type and name the raw log came from
+    source_type VARCHAR(255) NOT NULL,
+    source_name VARCHAR(255) NOT NULL,
+    -- Time of the logged event, which the table is partitioned by
+    timestamp TIMESTAMPTZ NOT NULL,
+    -- The parsed log
+    data JSONB NOT NULL,
+    labels JSONB NULL,
+    metadata JSONB NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+) PARTITION BY RANGE (timestamp);
+
+-- Partitions are created for each day as logs arrive
+CREATE INDEX parsed_logs_source_name_timestamp_idx ON "parsed_logs" (source_name, timestamp);
+CREATE INDEX parsed_logs_id_idx ON "parsed_logs" (id);
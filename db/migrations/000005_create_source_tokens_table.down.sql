@@ -0,0 +1 @@
+DROP TABLE "source_tokens";
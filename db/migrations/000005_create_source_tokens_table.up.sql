@@ -0,0 +1,13 @@
+CREATE TABLE "source_tokens" (
+    -- Primary key for the source tokens table
+    id UUID DEFAULT gen_random_uuid() PRIMARY KEY,
+    -- Name of the source plugin the token authenticates
+    source VARCHAR(255) NOT NULL,
+    -- Description of the token's holder
+    name VARCHAR(100) NOT NULL,
+    -- SHA-256 of the token, which is only shown when created
+    token_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NULL,
+    revoked_at TIMESTAMPTZ NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE "policies" DROP COLUMN pinned;
+ALTER TABLE "policies" DROP COLUMN active_version;
+DROP TABLE "policy_versions";
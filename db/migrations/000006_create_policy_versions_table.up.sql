@@ -0,0 +1,22 @@
+CREATE TABLE "policy_versions" (
+    -- Primary key for the policy versions table
+    id UUID DEFAULT gen_random_uuid() PRIMARY KEY,
+    -- Policy the revision belongs to
+    policy_id UUID NOT NULL REFERENCES policies (id),
+    -- Revision number, counting up from 1 for each policy
+    version INTEGER NOT NULL,
+    -- HCL contents of the revision
+    content TEXT NOT NULL,
+    -- Hex encoded SHA-256 of the contents
+    checksum VARCHAR(64) NOT NULL,
+    -- Who saved the revision
+    author VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (policy_id, version)
+);
+
+-- The version of each policy the server loads, loading the policy's file
+-- from policy storage when null. Saving a revision activates it, unless
+-- the active version is pinned
+ALTER TABLE "policies" ADD COLUMN active_version INTEGER NULL;
+ALTER TABLE "policies" ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;
@@ -1,4 +1,26 @@
 
 -- name: ListLogPipelines :many
 SELECT * FROM log_pipelines
-ORDER BY id;
\ No newline at end of file
+ORDER BY id;
+-- name: ListActiveLogPipelines :many
+SELECT * FROM log_pipelines
+WHERE deleted_at IS NULL
+ORDER BY created_at;
+
+-- name: GetLogPipeline :one
+SELECT * FROM log_pipelines
+WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: CreateLogPipeline :one
+INSERT INTO log_pipelines (name, source, parsers, topic)
+VALUES ($1, $2, $3, $4)
+RETURNING *;
+
+-- name: UpdateLogPipeline :one
+UPDATE log_pipelines SET name = $2, source = $3, parsers = $4, topic = $5, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING *;
+
+-- name: DeleteLogPipeline :execrows
+UPDATE log_pipelines SET deleted_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL;
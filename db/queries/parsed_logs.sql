@@ -0,0 +1,6 @@
+-- name: InsertParsedLogs :copyfrom
+INSERT INTO parsed_logs (
+    id, source_id, source_type, source_name, timestamp, data, labels, metadata
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8
+);
@@ -1,4 +1,38 @@
-
 -- name: ListPolicies :many
 SELECT * FROM policies
-ORDER BY id;
\ No newline at end of file
+ORDER BY id;
+
+-- name: ListActivePolicies :many
+SELECT * FROM policies
+WHERE deleted_at IS NULL
+ORDER BY created_at;
+
+-- name: GetPolicy :one
+SELECT * FROM policies
+WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: LockPolicy :one
+-- Locks a policy until the end of the transaction, serializing its new versions
+SELECT * FROM policies
+WHERE id = $1 AND deleted_at IS NULL
+FOR UPDATE;
+
+-- name: CreatePolicy :one
+INSERT INTO policies (name, path)
+VALUES ($1, $2)
+RETURNING *;
+
+-- name: UpdatePolicy :one
+UPDATE policies SET name = $2, path = $3, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING *;
+
+-- name: DeletePolicy :execrows
+UPDATE policies SET deleted_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL;
+
+-- name: ActivatePolicyVersion :one
+UPDATE policies SET active_version = $2, pinned = $3, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+  AND EXISTS (SELECT 1 FROM policy_versions WHERE policy_id = $1 AND version = $2)
+RETURNING *;
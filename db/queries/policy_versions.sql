@@ -0,0 +1,30 @@
+-- name: CreatePolicyVersion :one
+-- Saves the next revision of a policy, activating it unless the active version is pinned.
+-- The policy is locked first, so concurrent saves don't number their versions the same
+WITH created AS (
+    INSERT INTO policy_versions (policy_id, version, content, checksum, author)
+    SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4
+    FROM policy_versions WHERE policy_id = $1
+    RETURNING *
+), activated AS (
+    UPDATE policies SET active_version = (SELECT version FROM created), updated_at = NOW()
+    WHERE id = $1 AND NOT pinned
+)
+SELECT id, policy_id, version, content, checksum, author, created_at FROM created;
+
+-- name: GetPolicyVersion :one
+SELECT * FROM policy_versions
+WHERE policy_id = $1 AND version = $2;
+
+-- name: ListPolicyVersions :many
+SELECT * FROM policy_versions
+WHERE policy_id = $1
+ORDER BY version DESC;
+
+-- name: ListActivePolicyVersions :many
+SELECT policies.path, policy_versions.version, policy_versions.content, policy_versions.checksum
+FROM policies
+JOIN policy_versions ON policy_versions.policy_id = policies.id
+    AND policy_versions.version = policies.active_version
+WHERE policies.deleted_at IS NULL
+ORDER BY policies.created_at;
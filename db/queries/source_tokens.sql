@@ -0,0 +1,18 @@
+-- name: CreateSourceToken :one
+INSERT INTO source_tokens (source, name, token_hash, expires_at)
+VALUES ($1, $2, $3, $4)
+RETURNING *;
+
+-- name: GetActiveSourceToken :one
+SELECT * FROM source_tokens
+WHERE token_hash = $1
+  AND revoked_at IS NULL
+  AND (expires_at IS NULL OR expires_at > NOW());
+
+-- name: ListSourceTokens :many
+SELECT * FROM source_tokens
+ORDER BY created_at;
+
+-- name: RevokeSourceToken :execrows
+UPDATE source_tokens SET revoked_at = NOW()
+WHERE id = $1 AND revoked_at IS NULL;
@@ -0,0 +1,125 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/metrics"
+	"github.com/kytheron-org/kytheron/policy"
+	"github.com/kytheron-org/kytheron/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	defaultOutputTimeout = 10 * time.Second
+	defaultOutputBackoff = time.Second
+)
+
+// OutputClients resolves the plugin client for an output type
+type OutputClients interface {
+	Output(name string) (pb.OutputPluginClient, error)
+}
+
+// Dispatcher delivers hits to the outputs of the matching evaluation
+type Dispatcher struct {
+	clients OutputClients
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	logger  *zap.Logger
+}
+
+func NewDispatcher(clients OutputClients, cfg config.Outputs, logger *zap.Logger) *Dispatcher {
+	d := &Dispatcher{
+		clients: clients,
+		timeout: cfg.Timeout,
+		retries: cfg.Retries,
+		backoff: cfg.Backoff,
+		logger:  logger,
+	}
+	if d.timeout <= 0 {
+		d.timeout = defaultOutputTimeout
+	}
+	if d.backoff <= 0 {
+		d.backoff = defaultOutputBackoff
+	}
+	if d.retries < 0 {
+		d.retries = 0
+	}
+	return d
+}
+
+// Dispatch sends the hit to every output listed on its evaluation.
+// A failing output doesn't prevent delivery to the others, the
+// errors of every failed output are returned together
+func (d *Dispatcher) Dispatch(ctx context.Context, hit Hit) error {
+	var errs []error
+	for _, output := range hit.Evaluation.Outputs {
+		name := fmt.Sprintf("%s.%s", output.Type, output.Name)
+		ctx, span := tracing.Tracer().Start(ctx, "dispatch", trace.WithAttributes(
+			tracing.OutputKey.String(name),
+			tracing.PolicyKey.String(hit.Policy.Name),
+			tracing.EvaluationKey.String(fmt.Sprintf("%s.%s", hit.Evaluation.Type, hit.Evaluation.Name)),
+		))
+		err := d.deliver(ctx, hit, output)
+		tracing.End(span, err)
+		if err != nil {
+			metrics.OutputDispatches.WithLabelValues(name, metrics.ResultFailure).Inc()
+			errs = append(errs, fmt.Errorf("output %s: %w", name, err))
+			continue
+		}
+		metrics.OutputDispatches.WithLabelValues(name, metrics.ResultSuccess).Inc()
+	}
+	return errors.Join(errs...)
+}
+
+// deliver calls the output plugin, retrying with an exponential
+// backoff until it succeeds or the retries are exhausted
+func (d *Dispatcher) deliver(ctx context.Context, hit Hit, output policy.Output) error {
+	// Outputs are served by the plugin named after their type
+	client, err := d.clients.Output(output.Type)
+	if err != nil {
+		return err
+	}
+
+	request := &pb.EvaluationRequest{
+		Logs:       []*pb.ParsedLog{hit.Log},
+		PolicyName: hit.Policy.Name,
+	}
+
+	backoff := d.backoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, d.timeout)
+		_, err = client.Proc(attemptCtx, request)
+		cancel()
+		if err == nil {
+			d.logger.Debug("hit delivered to output",
+				zap.String("output", fmt.Sprintf("%s.%s", output.Type, output.Name)),
+				zap.String("parsed_log_id", hit.Log.Id),
+				zap.Int("attempt", attempt),
+			)
+			return nil
+		}
+
+		d.logger.Warn("failed to deliver hit to output",
+			zap.String("output", fmt.Sprintf("%s.%s", output.Type, output.Name)),
+			zap.String("parsed_log_id", hit.Log.Id),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+		if attempt > d.retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
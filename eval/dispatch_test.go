@@ -0,0 +1,85 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/policy"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"testing"
+	"time"
+)
+
+type fakeOutput struct {
+	failures int
+	calls    int
+	requests []*pb.EvaluationRequest
+}
+
+func (o *fakeOutput) Proc(ctx context.Context, in *pb.EvaluationRequest, opts ...grpc.CallOption) (*pb.EvaluationResponse, error) {
+	o.calls++
+	if o.calls <= o.failures {
+		return nil, errors.New("output unavailable")
+	}
+	o.requests = append(o.requests, in)
+	return &pb.EvaluationResponse{}, nil
+}
+
+type fakeOutputClients map[string]*fakeOutput
+
+func (c fakeOutputClients) Output(name string) (pb.OutputPluginClient, error) {
+	client, ok := c[name]
+	if !ok {
+		return nil, fmt.Errorf("no output plugin client for %s", name)
+	}
+	return client, nil
+}
+
+func testHit(outputs ...policy.Output) Hit {
+	return Hit{
+		Policy:     &policy.Policy{Name: "test_policy.hcl"},
+		Evaluation: &policy.Evaluation{Type: "cloudtrail", Name: "root_action", Outputs: outputs},
+		Log:        &pb.ParsedLog{Id: "parsed-1", Data: `{}`},
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	console := &fakeOutput{failures: 2}
+	dispatcher := NewDispatcher(fakeOutputClients{"console": console}, config.Outputs{
+		Retries: 2,
+		Backoff: time.Millisecond,
+	}, zap.NewNop())
+
+	err := dispatcher.Dispatch(context.Background(), testHit(policy.Output{Type: "console", Name: "log_root_actions"}))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, console.calls)
+	assert.Equal(t, 1, len(console.requests))
+	assert.Equal(t, "test_policy.hcl", console.requests[0].PolicyName)
+	assert.Equal(t, "parsed-1", console.requests[0].Logs[0].Id)
+}
+
+func TestDispatchFailures(t *testing.T) {
+	console := &fakeOutput{failures: 5}
+	slack := &fakeOutput{}
+	dispatcher := NewDispatcher(fakeOutputClients{"console": console, "slack": slack}, config.Outputs{
+		Retries: 1,
+		Backoff: time.Millisecond,
+	}, zap.NewNop())
+
+	err := dispatcher.Dispatch(context.Background(), testHit(
+		policy.Output{Type: "console", Name: "log_root_actions"},
+		policy.Output{Type: "pagerduty", Name: "page_oncall"},
+		policy.Output{Type: "slack", Name: "notify_security"},
+	))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "console.log_root_actions")
+	assert.Contains(t, err.Error(), "pagerduty.page_oncall")
+	assert.Equal(t, 2, console.calls)
+
+	// Failing outputs don't block delivery to the others
+	assert.Equal(t, 1, len(slack.requests))
+}
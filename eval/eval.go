@@ -4,5 +4,153 @@ package eval
 // of policies, and forwarding of detected events
 // to the described outputs
 
-type Context struct {
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/policy"
+	"github.com/theory/jsonpath"
+	"net"
+	"regexp"
+)
+
+// Hit is the record of a single evaluation matching a parsed log
+type Hit struct {
+	Policy     *policy.Policy
+	Evaluation *policy.Evaluation
+	Log        *pb.ParsedLog
+}
+
+// target is an evaluation to run, along with the policy that owns it
+type target struct {
+	policy     *policy.Policy
+	evaluation *policy.Evaluation
+}
+
+// Engine evaluates parsed logs against the loaded policies
+type Engine struct {
+	// Evaluations keyed by the source type and name of their inputs
+	targets  map[string]map[string][]target
+	paths    map[string]*jsonpath.Path
+	patterns map[string]*regexp.Regexp
+	networks map[string]*net.IPNet
+}
+
+// NewEngine indexes the evaluations of each policy by their inputs,
+// and compiles every condition path, pattern and network up front
+func NewEngine(policies []*policy.Policy) (*Engine, error) {
+	e := &Engine{
+		targets:  make(map[string]map[string][]target),
+		paths:    make(map[string]*jsonpath.Path),
+		patterns: make(map[string]*regexp.Regexp),
+		networks: make(map[string]*net.IPNet),
+	}
+
+	for _, p := range policies {
+		for i := range p.Evaluations {
+			evaluation := &p.Evaluations[i]
+			if err := e.compileGroup(evaluation.Conditions, evaluation.Groups); err != nil {
+				return nil, fmt.Errorf("policy %s evaluation %s.%s: %w", p.Name, evaluation.Type, evaluation.Name, err)
+			}
+
+			for _, input := range evaluation.Inputs {
+				if _, ok := e.targets[input.Type]; !ok {
+					e.targets[input.Type] = map[string][]target{}
+				}
+				e.targets[input.Type][input.Name] = append(e.targets[input.Type][input.Name], target{policy: p, evaluation: evaluation})
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// compileGroup compiles conditions throughout the condition tree
+func (e *Engine) compileGroup(conditions []policy.Condition, groups []policy.ConditionGroup) error {
+	for _, condition := range conditions {
+		if err := e.compileCondition(condition); err != nil {
+			return err
+		}
+	}
+	for _, group := range groups {
+		if err := e.compileGroup(group.Conditions, group.Groups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) compile(path string) error {
+	if _, ok := e.paths[path]; ok {
+		return nil
+	}
+	compiled, err := jsonpath.Parse(path)
+	if err != nil {
+		return fmt.Errorf("invalid path %q: %w", path, err)
+	}
+	e.paths[path] = compiled
+	return nil
+}
+
+// Evaluate runs every evaluation with an input matching the log's
+// source, returning a hit for each evaluation whose conditions all match
+func (e *Engine) Evaluate(log *pb.ParsedLog) ([]Hit, error) {
+	targets := e.targets[log.SourceType][log.SourceName]
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	var data any
+	if err := json.Unmarshal([]byte(log.Data), &data); err != nil {
+		return nil, fmt.Errorf("failed to decode log data: %w", err)
+	}
+
+	var hits []Hit
+	for _, t := range targets {
+		if e.matches(t.evaluation, data) {
+			hits = append(hits, Hit{Policy: t.policy, Evaluation: t.evaluation, Log: log})
+		}
+	}
+	return hits, nil
+}
+
+// matches reports whether every condition and group of the evaluation
+// holds. An evaluation without conditions matches every log from its inputs
+func (e *Engine) matches(evaluation *policy.Evaluation, data any) bool {
+	return e.matchAll(evaluation.Conditions, evaluation.Groups, data)
+}
+
+func (e *Engine) matchAll(conditions []policy.Condition, groups []policy.ConditionGroup, data any) bool {
+	for _, condition := range conditions {
+		if !e.matchCondition(condition, data) {
+			return false
+		}
+	}
+	for _, group := range groups {
+		if !e.matchGroup(group, data) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Engine) matchGroup(group policy.ConditionGroup, data any) bool {
+	switch group.Kind {
+	case policy.GroupAny:
+		for _, condition := range group.Conditions {
+			if e.matchCondition(condition, data) {
+				return true
+			}
+		}
+		for _, nested := range group.Groups {
+			if e.matchGroup(nested, data) {
+				return true
+			}
+		}
+		return false
+	case policy.GroupNot:
+		return !e.matchAll(group.Conditions, group.Groups, data)
+	default:
+		return e.matchAll(group.Conditions, group.Groups, data)
+	}
 }
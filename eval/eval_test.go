@@ -0,0 +1,284 @@
+package eval
+
+import (
+	pb "github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/policy"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const testPolicy = `
+source "cloudtrail" "account-x" {}
+
+evaluation "cloudtrail" "root_action" {
+  inputs = [source.cloudtrail.account-x]
+
+  condition {
+    path = "$.userIdentity.type"
+    value = "Root"
+  }
+
+  outputs = [output.console.log_root_actions]
+}
+
+output "console" "log_root_actions" {}
+`
+
+func newTestEngine(t *testing.T) *Engine {
+	p, err := policy.Decode("test_policy.hcl", []byte(testPolicy))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	engine, err := NewEngine([]*policy.Policy{p})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	return engine
+}
+
+func TestEvaluate(t *testing.T) {
+	engine := newTestEngine(t)
+
+	hits, err := engine.Evaluate(&pb.ParsedLog{
+		SourceType: "cloudtrail",
+		SourceName: "account-x",
+		Data:       `{"userIdentity":{"type":"Root"},"eventName":"ListBuckets"}`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(hits))
+	assert.Equal(t, "test_policy.hcl", hits[0].Policy.Name)
+	assert.Equal(t, "root_action", hits[0].Evaluation.Name)
+	assert.Equal(t, "log_root_actions", hits[0].Evaluation.Outputs[0].Name)
+}
+
+func TestEvaluateNoMatch(t *testing.T) {
+	engine := newTestEngine(t)
+
+	hits, err := engine.Evaluate(&pb.ParsedLog{
+		SourceType: "cloudtrail",
+		SourceName: "account-x",
+		Data:       `{"userIdentity":{"type":"IAMUser"}}`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(hits))
+
+	// Logs from sources without evaluations are never decoded
+	hits, err = engine.Evaluate(&pb.ParsedLog{
+		SourceType: "cloudtrail",
+		SourceName: "account-y",
+		Data:       `not json`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(hits))
+}
+
+func TestEvaluateInvalidData(t *testing.T) {
+	engine := newTestEngine(t)
+
+	_, err := engine.Evaluate(&pb.ParsedLog{
+		SourceType: "cloudtrail",
+		SourceName: "account-x",
+		Data:       `not json`,
+	})
+	assert.Error(t, err)
+}
+
+func TestNewEngineInvalidPath(t *testing.T) {
+	_, err := NewEngine([]*policy.Policy{{
+		Name: "invalid.hcl",
+		Evaluations: []policy.Evaluation{{
+			Type:       "cloudtrail",
+			Name:       "broken",
+			Conditions: []policy.Condition{{Path: "userIdentity[", Operator: policy.OperatorEquals, Value: "Root"}},
+		}},
+	}})
+	assert.Error(t, err)
+}
+
+func TestNewEngineInvalidCondition(t *testing.T) {
+	for name, condition := range map[string]policy.Condition{
+		"missing operator": {Path: "$.eventName", Value: "ListBuckets"},
+		"unknown operator": {Path: "$.eventName", Operator: "like", Value: "List%"},
+		"string number":    {Path: "$.count", Operator: policy.OperatorGt, Value: "5"},
+		"number prefix":    {Path: "$.eventName", Operator: policy.OperatorStartsWith, Value: 5.0},
+		"regex list":       {Path: "$.eventName", Operator: policy.OperatorRegex, Value: []any{"^List"}},
+		"cidr number":      {Path: "$.sourceIPAddress", Operator: policy.OperatorCidr, Value: []any{10.0}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewEngine([]*policy.Policy{{
+				Name: "invalid.hcl",
+				Evaluations: []policy.Evaluation{{
+					Type:       "cloudtrail",
+					Name:       "broken",
+					Conditions: []policy.Condition{condition},
+				}},
+			}})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestOperators(t *testing.T) {
+	data := `{
+  "eventName": "ConsoleLogin",
+  "eventSource": "signin.amazonaws.com",
+  "sourceIPAddress": "10.1.2.3",
+  "awsRegion": "us-east-1",
+  "responseElements": {"ConsoleLogin": "Success"},
+  "additionalEventData": {"MFAUsed": "No", "LoginTo": "https://console.aws.amazon.com"},
+  "resources": ["arn:aws:s3:::bucket-a", "arn:aws:s3:::bucket-b"],
+  "readOnly": false,
+  "requestParameters": {"maxItems": 100, "durationSeconds": "3600"}
+}`
+
+	tests := []struct {
+		name      string
+		condition string
+		match     bool
+	}{
+		{"equals", `path = "$.eventName"
+value = "ConsoleLogin"`, true},
+		{"equals typed", `path = "$.readOnly"
+value = false`, true},
+		{"equals number is not string", `path = "$.requestParameters.durationSeconds"
+value = 3600`, false},
+		{"not_equals", `path = "$.awsRegion"
+operator = "not_equals"
+value = "eu-west-1"`, true},
+		{"not_equals missing path", `path = "$.missing"
+operator = "not_equals"
+value = "x"`, true},
+		{"in", `path = "$.awsRegion"
+operator = "in"
+value = ["us-east-1", "us-west-2"]`, true},
+		{"in miss", `path = "$.awsRegion"
+operator = "in"
+value = ["eu-west-1"]`, false},
+		{"contains substring", `path = "$.eventSource"
+operator = "contains"
+value = "signin"`, true},
+		{"contains element", `path = "$.resources"
+operator = "contains"
+value = "arn:aws:s3:::bucket-b"`, true},
+		{"starts_with", `path = "$.additionalEventData.LoginTo"
+operator = "starts_with"
+value = "https://"`, true},
+		{"ends_with", `path = "$.eventSource"
+operator = "ends_with"
+value = ".amazonaws.com"`, true},
+		{"regex", `path = "$.resources[*]"
+operator = "regex"
+value = "bucket-[ab]$"`, true},
+		{"exists", `path = "$.responseElements.ConsoleLogin"
+operator = "exists"`, true},
+		{"not_exists", `path = "$.errorCode"
+operator = "not_exists"`, true},
+		{"gt", `path = "$.requestParameters.maxItems"
+operator = "gt"
+value = 50`, true},
+		{"gte numeric string", `path = "$.requestParameters.durationSeconds"
+operator = "gte"
+value = 3600`, true},
+		{"lt", `path = "$.requestParameters.maxItems"
+operator = "lt"
+value = 100`, false},
+		{"lte", `path = "$.requestParameters.maxItems"
+operator = "lte"
+value = 100`, true},
+		{"cidr", `path = "$.sourceIPAddress"
+operator = "cidr"
+value = ["192.168.0.0/16", "10.0.0.0/8"]`, true},
+		{"cidr single", `path = "$.sourceIPAddress"
+operator = "cidr"
+value = "172.16.0.0/12"`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := policy.Decode("test_policy.hcl", []byte(`
+source "cloudtrail" "account-x" {}
+
+evaluation "cloudtrail" "test" {
+  inputs = [source.cloudtrail.account-x]
+
+  condition {
+`+tt.condition+`
+  }
+}
+`))
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			engine, err := NewEngine([]*policy.Policy{p})
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+
+			hits, err := engine.Evaluate(&pb.ParsedLog{SourceType: "cloudtrail", SourceName: "account-x", Data: data})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.match, len(hits) == 1)
+		})
+	}
+}
+
+func TestConditionGroups(t *testing.T) {
+	p, err := policy.Decode("test_policy.hcl", []byte(`
+source "cloudtrail" "account-x" {}
+
+evaluation "cloudtrail" "root_login" {
+  inputs = [source.cloudtrail.account-x]
+
+  condition {
+    path = "$.userIdentity.type"
+    value = "Root"
+  }
+
+  any {
+    condition {
+      path = "$.additionalEventData.MFAUsed"
+      value = "No"
+    }
+
+    all {
+      condition {
+        path = "$.eventName"
+        value = "ConsoleLogin"
+      }
+
+      not {
+        condition {
+          path = "$.sourceIPAddress"
+          operator = "cidr"
+          value = ["10.0.0.0/8"]
+        }
+      }
+    }
+  }
+}
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	engine, err := NewEngine([]*policy.Policy{p})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	tests := map[string]struct {
+		data  string
+		match bool
+	}{
+		"root without mfa":        {`{"userIdentity":{"type":"Root"},"additionalEventData":{"MFAUsed":"No"},"eventName":"ConsoleLogin","sourceIPAddress":"10.0.0.1"}`, true},
+		"root login from outside": {`{"userIdentity":{"type":"Root"},"additionalEventData":{"MFAUsed":"Yes"},"eventName":"ConsoleLogin","sourceIPAddress":"203.0.113.5"}`, true},
+		"root login from inside":  {`{"userIdentity":{"type":"Root"},"additionalEventData":{"MFAUsed":"Yes"},"eventName":"ConsoleLogin","sourceIPAddress":"10.0.0.1"}`, false},
+		"iam user without mfa":    {`{"userIdentity":{"type":"IAMUser"},"additionalEventData":{"MFAUsed":"No"}}`, false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			hits, err := engine.Evaluate(&pb.ParsedLog{SourceType: "cloudtrail", SourceName: "account-x", Data: tt.data})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.match, len(hits) == 1)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package eval
+
+import (
+	"github.com/kytheron-org/kytheron/policy"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// compileCondition validates a condition, and prepares the path,
+// pattern and networks it needs at evaluation time
+func (e *Engine) compileCondition(condition policy.Condition) error {
+	if err := condition.Validate(); err != nil {
+		return err
+	}
+	if err := e.compile(condition.Path); err != nil {
+		return err
+	}
+
+	switch condition.Operator {
+	case policy.OperatorRegex:
+		pattern, _ := condition.Value.(string)
+		if _, ok := e.patterns[pattern]; ok {
+			return nil
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		e.patterns[pattern] = compiled
+	case policy.OperatorCidr:
+		values, _ := condition.Value.([]any)
+		for _, value := range values {
+			cidr, _ := value.(string)
+			if _, ok := e.networks[cidr]; ok {
+				continue
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return err
+			}
+			e.networks[cidr] = network
+		}
+	}
+	return nil
+}
+
+// matchCondition applies the condition's operator to the nodes
+// selected by its path. Every operator other than not_equals and
+// not_exists holds when at least one selected node satisfies it
+func (e *Engine) matchCondition(condition policy.Condition, data any) bool {
+	nodes := e.paths[condition.Path].Select(data)
+
+	switch condition.Operator {
+	case policy.OperatorExists:
+		return len(nodes) > 0
+	case policy.OperatorNotExists:
+		return len(nodes) == 0
+	case policy.OperatorNotEquals:
+		for _, node := range nodes {
+			if equal(node, condition.Value) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, node := range nodes {
+		if e.matchNode(condition, node) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Engine) matchNode(condition policy.Condition, node any) bool {
+	switch condition.Operator {
+	case policy.OperatorEquals:
+		return equal(node, condition.Value)
+	case policy.OperatorIn:
+		values, _ := condition.Value.([]any)
+		for _, value := range values {
+			if equal(node, value) {
+				return true
+			}
+		}
+		return false
+	case policy.OperatorContains:
+		// Strings contain substrings, arrays contain elements
+		switch n := node.(type) {
+		case string:
+			value, ok := condition.Value.(string)
+			return ok && strings.Contains(n, value)
+		case []any:
+			for _, item := range n {
+				if equal(item, condition.Value) {
+					return true
+				}
+			}
+		}
+		return false
+	case policy.OperatorStartsWith:
+		n, ok := node.(string)
+		prefix, valid := condition.Value.(string)
+		return ok && valid && strings.HasPrefix(n, prefix)
+	case policy.OperatorEndsWith:
+		n, ok := node.(string)
+		suffix, valid := condition.Value.(string)
+		return ok && valid && strings.HasSuffix(n, suffix)
+	case policy.OperatorRegex:
+		n, ok := node.(string)
+		pattern, valid := condition.Value.(string)
+		compiled := e.patterns[pattern]
+		return ok && valid && compiled != nil && compiled.MatchString(n)
+	case policy.OperatorGt, policy.OperatorGte, policy.OperatorLt, policy.OperatorLte:
+		n, ok := number(node)
+		value, valid := condition.Value.(float64)
+		if !ok || !valid {
+			return false
+		}
+		switch condition.Operator {
+		case policy.OperatorGt:
+			return n > value
+		case policy.OperatorGte:
+			return n >= value
+		case policy.OperatorLt:
+			return n < value
+		default:
+			return n <= value
+		}
+	case policy.OperatorCidr:
+		n, ok := node.(string)
+		if !ok {
+			return false
+		}
+		ip := net.ParseIP(n)
+		if ip == nil {
+			return false
+		}
+		values, _ := condition.Value.([]any)
+		for _, value := range values {
+			cidr, _ := value.(string)
+			if network := e.networks[cidr]; network != nil && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// equal compares a JSON node with a condition value. Values are typed,
+// so the string "1" is not equal to the number 1
+func equal(node any, value any) bool {
+	return reflect.DeepEqual(node, value)
+}
+
+// number reads a JSON node as a number. Numeric strings are accepted,
+// as many log formats quote their numbers
+func number(node any) (float64, bool) {
+	switch n := node.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,307 @@
+package batcher
+
+// This package collects items into batches, sending a batch once it's
+// full or has waited long enough, and retrying batches that fail
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchWait  = time.Second
+	defaultBufferSize = 10000
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = time.Minute
+)
+
+// ErrClosed is returned when pushing to a closed batcher
+var ErrClosed = errors.New("batcher is closed")
+
+// Options of a batcher. Unset options take the defaults, except for
+// BatchSize, which depends on what the batch's size is measured in
+type Options struct {
+	// BatchSize is the size a batch grows to before it is sent
+	BatchSize int
+	// BatchWait is the longest an item waits for its batch to be sent
+	BatchWait time.Duration
+	// BufferSize is the number of items waiting to be batched, after
+	// which pushing blocks until a batch has been sent
+	BufferSize int
+	// Retries of a failed batch, backing off from MinBackoff
+	// and doubling up to MaxBackoff between attempts
+	Retries    int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.BatchWait <= 0 {
+		o.BatchWait = defaultBatchWait
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = defaultBufferSize
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = defaultMinBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = defaultMaxBackoff
+	}
+	return o
+}
+
+// Sender sends a batch of items. Failed batches are retried,
+// unless the error is marked as permanent
+type Sender[T any] func(ctx context.Context, items []T) error
+
+// Sizer measures an item's contribution to the size of its batch
+type Sizer[T any] func(item T) int
+
+// permanentError is a failure that won't be fixed by trying again
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks a batch's failure as not worth retrying
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type pending[T any] struct {
+	item T
+	done func(error)
+}
+
+// Batcher collects items into batches for a sender. Batches are sent
+// one at a time, so the results of pushing items are reported in order
+type Batcher[T any] struct {
+	options Options
+	size    Sizer[T]
+	send    Sender[T]
+	logger  *zap.Logger
+
+	items   chan pending[T]
+	flushes chan chan struct{}
+	closing chan struct{}
+	closed  chan struct{}
+	// pushes is held by pushes while they enqueue, and by Close before
+	// sealing the buffer, so no item is enqueued after the final drain
+	pushes    sync.RWMutex
+	sealed    chan struct{}
+	closeOnce sync.Once
+	// abort is called when closing runs out of time,
+	// abandoning retries of the batch being sent
+	ctx   context.Context
+	abort context.CancelFunc
+}
+
+// New starts a batcher. Without a sizer, each item counts as one
+// toward the batch size
+func New[T any](options Options, size Sizer[T], send Sender[T], logger *zap.Logger) *Batcher[T] {
+	if size == nil {
+		size = func(T) int { return 1 }
+	}
+	options = options.withDefaults()
+	b := &Batcher[T]{
+		options: options,
+		size:    size,
+		send:    send,
+		logger:  logger,
+		items:   make(chan pending[T], options.BufferSize),
+		flushes: make(chan chan struct{}),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+		sealed:  make(chan struct{}),
+	}
+	b.ctx, b.abort = context.WithCancel(context.Background())
+	go b.run()
+	return b
+}
+
+// Push adds an item to the next batch, calling done with the result of
+// sending it. Push blocks while the buffer of waiting items is full,
+// holding back the caller until the sender catches up, rather than
+// dropping items
+func (b *Batcher[T]) Push(ctx context.Context, item T, done func(error)) error {
+	b.pushes.RLock()
+	defer b.pushes.RUnlock()
+
+	select {
+	case <-b.closing:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case b.items <- pending[T]{item: item, done: done}:
+		return nil
+	case <-b.closing:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len is the number of items waiting to be batched
+func (b *Batcher[T]) Len() int {
+	return len(b.items)
+}
+
+// Flush sends the items pushed so far, returning once they've been sent
+func (b *Batcher[T]) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case b.flushes <- flushed:
+	case <-b.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends the items pushed so far and stops the batcher. Items
+// still waiting when the context expires are reported as failed
+func (b *Batcher[T]) Close(ctx context.Context) error {
+	b.closeOnce.Do(func() {
+		// Pushes waiting on a full buffer give up once closing, and
+		// pushes after sealing see the batcher is closed
+		close(b.closing)
+		b.pushes.Lock()
+		close(b.sealed)
+		b.pushes.Unlock()
+	})
+
+	select {
+	case <-b.closed:
+		return nil
+	case <-ctx.Done():
+		b.abort()
+		<-b.closed
+		return ctx.Err()
+	}
+}
+
+func (b *Batcher[T]) run() {
+	defer close(b.closed)
+	defer b.abort()
+
+	var batch []pending[T]
+	var size int
+	var created time.Time
+	ticker := time.NewTicker(b.options.BatchWait / 2)
+	defer ticker.Stop()
+
+	send := func() {
+		if len(batch) > 0 {
+			b.deliver(batch)
+			batch = nil
+			size = 0
+		}
+	}
+	add := func(p pending[T]) {
+		if len(batch) == 0 {
+			created = time.Now()
+		}
+		batch = append(batch, p)
+		size += b.size(p.item)
+		if size >= b.options.BatchSize {
+			send()
+		}
+	}
+	// drain batches every item waiting in the buffer
+	drain := func() {
+		for {
+			select {
+			case p := <-b.items:
+				add(p)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case p := <-b.items:
+			add(p)
+		case <-ticker.C:
+			if len(batch) > 0 && time.Since(created) >= b.options.BatchWait {
+				send()
+			}
+		case flushed := <-b.flushes:
+			drain()
+			send()
+			close(flushed)
+		case <-b.closing:
+			// Pushes racing with Close can still enqueue until the
+			// buffer is sealed, so only drain it after that
+			<-b.sealed
+			drain()
+			send()
+			return
+		}
+	}
+}
+
+// deliver sends a batch, then reports the result to each of its items
+func (b *Batcher[T]) deliver(batch []pending[T]) {
+	items := make([]T, len(batch))
+	for i, p := range batch {
+		items[i] = p.item
+	}
+
+	err := b.retry(items)
+	for _, p := range batch {
+		if p.done != nil {
+			p.done(err)
+		}
+	}
+}
+
+// retry sends a batch, backing off between attempts until it's
+// sent, the retries run out or the failure is permanent
+func (b *Batcher[T]) retry(items []T) error {
+	backoff := b.options.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := b.send(b.ctx, items)
+		if err == nil {
+			b.logger.Debug("sent batch", zap.Int("items", len(items)))
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= b.options.Retries {
+			b.logger.Error("failed to send batch", zap.Int("items", len(items)), zap.Int("attempts", attempt+1), zap.Error(err))
+			return err
+		}
+
+		b.logger.Warn("retrying batch", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+			return b.ctx.Err()
+		}
+		backoff *= 2
+		if backoff > b.options.MaxBackoff {
+			backoff = b.options.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	var batches [][]string
+	b := New(Options{BatchSize: 2, BatchWait: time.Minute}, nil, func(ctx context.Context, items []string) error {
+		batches = append(batches, items)
+		return nil
+	}, zap.NewNop())
+
+	results := make(chan error, 3)
+	for _, item := range []string{"one", "two", "three"} {
+		assert.NoError(t, b.Push(context.Background(), item, func(err error) { results <- err }))
+	}
+	assert.NoError(t, b.Close(context.Background()))
+	for range 3 {
+		assert.NoError(t, <-results)
+	}
+	// Full batches are sent straight away, and the rest when closing
+	assert.Equal(t, [][]string{{"one", "two"}, {"three"}}, batches)
+	assert.ErrorIs(t, b.Push(context.Background(), "four", nil), ErrClosed)
+}
+
+func TestBatcherRetries(t *testing.T) {
+	var attempts int
+	unavailable := errors.New("unavailable")
+	b := New(Options{BatchSize: 1, Retries: 5, MinBackoff: time.Millisecond}, nil, func(ctx context.Context, items []string) error {
+		attempts++
+		if attempts < 3 {
+			return unavailable
+		}
+		return nil
+	}, zap.NewNop())
+	defer b.Close(context.Background())
+
+	result := make(chan error, 1)
+	assert.NoError(t, b.Push(context.Background(), "one", func(err error) { result <- err }))
+	assert.NoError(t, <-result)
+	assert.Equal(t, 3, attempts)
+
+	// Permanent failures aren't retried
+	attempts = 0
+	b.send = func(ctx context.Context, items []string) error {
+		attempts++
+		return Permanent(unavailable)
+	}
+	assert.NoError(t, b.Push(context.Background(), "two", func(err error) { result <- err }))
+	assert.ErrorIs(t, <-result, unavailable)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestBatcherPushWhileClosing(t *testing.T) {
+	for range 20 {
+		// Pushers wait on a full buffer while a slow batch is sent
+		b := New(Options{BatchSize: 1, BufferSize: 1, BatchWait: time.Minute}, nil, func(ctx context.Context, items []int) error {
+			time.Sleep(100 * time.Microsecond)
+			return nil
+		}, zap.NewNop())
+
+		var pushed, reported atomic.Int32
+		var wg sync.WaitGroup
+		for i := range 32 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if err := b.Push(context.Background(), i, func(error) { reported.Add(1) }); err != nil {
+						assert.ErrorIs(t, err, ErrClosed)
+						return
+					}
+					pushed.Add(1)
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		assert.NoError(t, b.Close(context.Background()))
+		wg.Wait()
+
+		// Every item accepted before closing is sent, and none after
+		assert.Equal(t, pushed.Load(), reported.Load())
+		assert.ErrorIs(t, b.Push(context.Background(), 0, nil), ErrClosed)
+	}
+}
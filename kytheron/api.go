@@ -0,0 +1,764 @@
+package kytheron
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/metrics"
+	"github.com/kytheron-org/kytheron/model"
+	"github.com/kytheron-org/kytheron/policy"
+	"github.com/kytheron-org/kytheron/registry"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultHttpAddress only serves the management API on the same host
+	defaultHttpAddress = "localhost"
+
+	maxRequestBytes   = 1 << 20
+	readHeaderTimeout = 10 * time.Second
+
+	// uniqueViolation is the Postgres error code of a duplicate key
+	uniqueViolation = "23505"
+)
+
+// ManagementQueries are the queries the management API makes
+type ManagementQueries interface {
+	ListActivePolicies(ctx context.Context) ([]model.Policy, error)
+	GetPolicy(ctx context.Context, id pgtype.UUID) (model.Policy, error)
+	LockPolicy(ctx context.Context, id pgtype.UUID) (model.Policy, error)
+	CreatePolicy(ctx context.Context, arg model.CreatePolicyParams) (model.Policy, error)
+	UpdatePolicy(ctx context.Context, arg model.UpdatePolicyParams) (model.Policy, error)
+	DeletePolicy(ctx context.Context, id pgtype.UUID) (int64, error)
+	ActivatePolicyVersion(ctx context.Context, arg model.ActivatePolicyVersionParams) (model.Policy, error)
+	ListPolicyVersions(ctx context.Context, policyID pgtype.UUID) ([]model.PolicyVersion, error)
+	GetPolicyVersion(ctx context.Context, arg model.GetPolicyVersionParams) (model.PolicyVersion, error)
+	CreatePolicyVersion(ctx context.Context, arg model.CreatePolicyVersionParams) (model.PolicyVersion, error)
+
+	ListActiveLogPipelines(ctx context.Context) ([]model.LogPipeline, error)
+	GetLogPipeline(ctx context.Context, id pgtype.UUID) (model.LogPipeline, error)
+	CreateLogPipeline(ctx context.Context, arg model.CreateLogPipelineParams) (model.LogPipeline, error)
+	UpdateLogPipeline(ctx context.Context, arg model.UpdateLogPipelineParams) (model.LogPipeline, error)
+	DeleteLogPipeline(ctx context.Context, id pgtype.UUID) (int64, error)
+}
+
+// ManagementStore holds the policies and log pipelines managed through the API
+type ManagementStore interface {
+	ManagementQueries
+	// InTx makes fn's queries in one transaction, committed when fn succeeds
+	InTx(ctx context.Context, fn func(ManagementQueries) error) error
+}
+
+// dbManagementStore keeps the managed policies and log pipelines in the database
+type dbManagementStore struct {
+	*model.Queries
+	db *pgxpool.Pool
+}
+
+func newDbManagementStore(db *pgxpool.Pool) *dbManagementStore {
+	return &dbManagementStore{Queries: model.New(db), db: db}
+}
+
+func (s *dbManagementStore) InTx(ctx context.Context, fn func(ManagementQueries) error) error {
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		return fn(model.New(tx))
+	})
+}
+
+// HttpServer serves the management API, a JSON API over the stored
+// policies and log pipelines, the loaded plugins and recent policy hits,
+// along with the server's liveness on /healthz, readiness on /readyz and
+// Prometheus metrics on /metrics.
+// Changes to policies and pipelines take effect once the server restarts
+type HttpServer struct {
+	store    ManagementStore
+	policies afero.Fs
+	registry *registry.PluginRegistry
+	hits     *Hits
+	health   *Health
+	logger   *zap.Logger
+
+	server *http.Server
+}
+
+// NewHttpServer creates the management API. Without a store, which needs
+// a database, policies and pipelines can't be managed. Policy storage is
+// only read, for the content of policies without a stored version.
+// Without health, the health endpoints aren't served
+func NewHttpServer(store ManagementStore, policies afero.Fs, reg *registry.PluginRegistry, hits *Hits, health *Health, logger *zap.Logger) *HttpServer {
+	s := &HttpServer{
+		store:    store,
+		policies: policies,
+		registry: reg,
+		hits:     hits,
+		health:   health,
+		logger:   logger,
+	}
+	s.server = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	return s
+}
+
+// Handler routes the management API
+func (s *HttpServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/policies", s.listPolicies)
+	mux.HandleFunc("POST /api/v1/policies", s.createPolicy)
+	mux.HandleFunc("GET /api/v1/policies/{id}", s.getPolicy)
+	mux.HandleFunc("PUT /api/v1/policies/{id}", s.updatePolicy)
+	mux.HandleFunc("DELETE /api/v1/policies/{id}", s.deletePolicy)
+	mux.HandleFunc("GET /api/v1/policies/{id}/versions", s.listPolicyVersions)
+	mux.HandleFunc("GET /api/v1/policies/{id}/versions/{version}", s.getPolicyVersion)
+	mux.HandleFunc("PUT /api/v1/policies/{id}/active", s.activatePolicyVersion)
+
+	mux.HandleFunc("GET /api/v1/pipelines", s.listPipelines)
+	mux.HandleFunc("POST /api/v1/pipelines", s.createPipeline)
+	mux.HandleFunc("GET /api/v1/pipelines/{id}", s.getPipeline)
+	mux.HandleFunc("PUT /api/v1/pipelines/{id}", s.updatePipeline)
+	mux.HandleFunc("DELETE /api/v1/pipelines/{id}", s.deletePipeline)
+
+	mux.HandleFunc("GET /api/v1/plugins", s.listPlugins)
+	mux.HandleFunc("GET /api/v1/hits", s.listHits)
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	if s.health != nil {
+		mux.HandleFunc("GET /healthz", s.healthz)
+		mux.HandleFunc("GET /readyz", s.readyz)
+	}
+	return mux
+}
+
+// Start listens on the configured address, serving
+// in the background until the server is shut down
+func (s *HttpServer) Start(cfg *config.Config) error {
+	address := cfg.Server.Http.Address
+	if address == "" {
+		address = defaultHttpAddress
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(cfg.Server.Http.Port)))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		s.logger.Info("http server listening", zap.String("address", lis.Addr().String()))
+		if err := s.server.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("http server failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops accepting requests, waiting for those
+// in progress until the context expires
+func (s *HttpServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// defaultPolicyAuthor is recorded for versions saved without an author
+const defaultPolicyAuthor = "anonymous"
+
+type policyResource struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// ActiveVersion is loaded by the server, which loads
+	// the file at the policy's path without one
+	ActiveVersion int32     `json:"active_version,omitempty"`
+	Pinned        bool      `json:"pinned"`
+	Content       string    `json:"content,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// policyRequest creates or updates a policy. When content is given
+// it's validated and saved as the policy's next version
+type policyRequest struct {
+	Name    string  `json:"name"`
+	Path    string  `json:"path"`
+	Content *string `json:"content"`
+	Author  string  `json:"author"`
+}
+
+func newPolicyResource(row model.Policy) policyResource {
+	return policyResource{
+		Id:            uuid.UUID(row.ID.Bytes).String(),
+		Name:          row.Name,
+		Path:          row.Path,
+		ActiveVersion: row.ActiveVersion.Int32,
+		Pinned:        row.Pinned,
+		CreatedAt:     row.CreatedAt.Time,
+		UpdatedAt:     row.UpdatedAt.Time,
+	}
+}
+
+type policyVersionResource struct {
+	Version   int32     `json:"version"`
+	Checksum  string    `json:"checksum"`
+	Author    string    `json:"author"`
+	Content   string    `json:"content,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newPolicyVersionResource(row model.PolicyVersion) policyVersionResource {
+	return policyVersionResource{
+		Version:   row.Version,
+		Checksum:  row.Checksum,
+		Author:    row.Author,
+		CreatedAt: row.CreatedAt.Time,
+	}
+}
+
+// activateRequest selects the version of a policy the server loads.
+// Pinned versions stay active as newer versions are saved
+type activateRequest struct {
+	Version int32 `json:"version"`
+	Pinned  bool  `json:"pinned"`
+}
+
+func (s *HttpServer) listPolicies(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	rows, err := s.store.ListActivePolicies(r.Context())
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	policies := make([]policyResource, 0, len(rows))
+	for _, row := range rows {
+		policies = append(policies, newPolicyResource(row))
+	}
+	writeJson(w, http.StatusOK, policies)
+}
+
+// getPolicy returns a policy with the content of its active version,
+// or of the file at its path when it has none
+func (s *HttpServer) getPolicy(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	row, err := s.store.GetPolicy(r.Context(), id)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	resource := newPolicyResource(row)
+	if row.ActiveVersion.Valid {
+		version, err := s.store.GetPolicyVersion(r.Context(), model.GetPolicyVersionParams{PolicyID: id, Version: row.ActiveVersion.Int32})
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		resource.Content = version.Content
+	} else if s.policies != nil {
+		content, err := afero.ReadFile(s.policies, "/"+row.Path)
+		if err != nil {
+			s.logger.Warn("failed to read policy content", zap.String("path", row.Path), zap.Error(err))
+		} else {
+			resource.Content = string(content)
+		}
+	}
+	writeJson(w, http.StatusOK, resource)
+}
+
+func (s *HttpServer) createPolicy(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	var req policyRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if !validatePolicy(w, &req) {
+		return
+	}
+
+	var row model.Policy
+	var version *model.PolicyVersion
+	err := s.store.InTx(r.Context(), func(q ManagementQueries) error {
+		created, err := q.CreatePolicy(r.Context(), model.CreatePolicyParams{Name: req.Name, Path: req.Path})
+		if err != nil {
+			return err
+		}
+		row, version, err = savePolicyVersion(r.Context(), q, created, &req)
+		return err
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Info("policy created", zap.String("policy", row.Name), zap.String("path", row.Path))
+	s.logPolicyVersion(row, version)
+	writeJson(w, http.StatusCreated, newPolicyResource(row))
+}
+
+func (s *HttpServer) updatePolicy(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	var req policyRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if !validatePolicy(w, &req) {
+		return
+	}
+
+	var row model.Policy
+	var version *model.PolicyVersion
+	err := s.store.InTx(r.Context(), func(q ManagementQueries) error {
+		updated, err := q.UpdatePolicy(r.Context(), model.UpdatePolicyParams{ID: id, Name: req.Name, Path: req.Path})
+		if err != nil {
+			return err
+		}
+		row, version, err = savePolicyVersion(r.Context(), q, updated, &req)
+		return err
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Info("policy updated", zap.String("policy", row.Name), zap.String("path", row.Path))
+	s.logPolicyVersion(row, version)
+	writeJson(w, http.StatusOK, newPolicyResource(row))
+}
+
+// savePolicyVersion saves the request's content as the policy's next
+// version, returning the policy as it is once the version is saved.
+// The policy is locked until the transaction ends, so concurrent
+// saves are numbered one after the other
+func savePolicyVersion(ctx context.Context, q ManagementQueries, row model.Policy, req *policyRequest) (model.Policy, *model.PolicyVersion, error) {
+	if req.Content == nil {
+		return row, nil, nil
+	}
+	if _, err := q.LockPolicy(ctx, row.ID); err != nil {
+		return row, nil, err
+	}
+
+	checksum := sha256.Sum256([]byte(*req.Content))
+	version, err := q.CreatePolicyVersion(ctx, model.CreatePolicyVersionParams{
+		PolicyID: row.ID,
+		Content:  *req.Content,
+		Checksum: hex.EncodeToString(checksum[:]),
+		Author:   req.Author,
+	})
+	if err != nil {
+		return row, nil, fmt.Errorf("failed to save policy version: %w", err)
+	}
+
+	row, err = q.GetPolicy(ctx, row.ID)
+	if err != nil {
+		return row, nil, err
+	}
+	return row, &version, nil
+}
+
+// logPolicyVersion logs a version saved along with a policy, once it's committed
+func (s *HttpServer) logPolicyVersion(row model.Policy, version *model.PolicyVersion) {
+	if version != nil {
+		s.logger.Info("policy version saved", zap.String("policy", row.Name), zap.Int32("version", version.Version), zap.String("author", version.Author))
+	}
+}
+
+// deletePolicy soft deletes a policy, which is no longer loaded.
+// Its versions are kept, as is any file at its path
+func (s *HttpServer) deletePolicy(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := s.store.DeletePolicy(r.Context(), id)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if deleted == 0 {
+		s.writeError(w, pgx.ErrNoRows)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listPolicyVersions returns a policy's versions, newest first, without their content
+func (s *HttpServer) listPolicyVersions(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.store.GetPolicy(r.Context(), id); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	rows, err := s.store.ListPolicyVersions(r.Context(), id)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	versions := make([]policyVersionResource, 0, len(rows))
+	for _, row := range rows {
+		versions = append(versions, newPolicyVersionResource(row))
+	}
+	writeJson(w, http.StatusOK, versions)
+}
+
+func (s *HttpServer) getPolicyVersion(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.ParseInt(r.PathValue("version"), 10, 32)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid version %q", r.PathValue("version")))
+		return
+	}
+	row, err := s.store.GetPolicyVersion(r.Context(), model.GetPolicyVersionParams{PolicyID: id, Version: int32(version)})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	resource := newPolicyVersionResource(row)
+	resource.Content = row.Content
+	writeJson(w, http.StatusOK, resource)
+}
+
+// activatePolicyVersion rolls a policy back or forward to one of its
+// versions, optionally pinning it so newer versions aren't activated
+func (s *HttpServer) activatePolicyVersion(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	var req activateRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Version < 1 {
+		writeMessage(w, http.StatusBadRequest, "version is required")
+		return
+	}
+
+	row, err := s.store.ActivatePolicyVersion(r.Context(), model.ActivatePolicyVersionParams{
+		ID:            id,
+		ActiveVersion: pgtype.Int4{Int32: req.Version, Valid: true},
+		Pinned:        req.Pinned,
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Info("policy version activated", zap.String("policy", row.Name), zap.Int32("version", req.Version), zap.Bool("pinned", req.Pinned))
+	writeJson(w, http.StatusOK, newPolicyResource(row))
+}
+
+// validatePolicy checks a policy request, decoding its content when given
+func validatePolicy(w http.ResponseWriter, req *policyRequest) bool {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeMessage(w, http.StatusBadRequest, "name is required")
+		return false
+	}
+	// Policies are named by their path relative to the storage root
+	req.Path = strings.TrimPrefix(path.Clean("/"+req.Path), "/")
+	if filepath.Ext(req.Path) != policy.PolicyExtension {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("path must be a %s file", policy.PolicyExtension))
+		return false
+	}
+	req.Author = strings.TrimSpace(req.Author)
+	if req.Author == "" {
+		req.Author = defaultPolicyAuthor
+	}
+	if req.Content == nil {
+		return true
+	}
+
+	if _, err := policy.Decode(req.Path, []byte(*req.Content)); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid policy: %s", err))
+		return false
+	}
+	return true
+}
+
+type pipelineResource struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	Parsers   []string  `json:"parsers"`
+	Topic     string    `json:"topic,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type pipelineRequest struct {
+	Name    string   `json:"name"`
+	Source  string   `json:"source"`
+	Parsers []string `json:"parsers"`
+	Topic   string   `json:"topic"`
+}
+
+func newPipelineResource(row model.LogPipeline) pipelineResource {
+	resource := pipelineResource{
+		Id:        uuid.UUID(row.ID.Bytes).String(),
+		Name:      row.Name,
+		Source:    row.Source,
+		Parsers:   []string{},
+		Topic:     row.Topic.String,
+		CreatedAt: row.CreatedAt.Time,
+		UpdatedAt: row.UpdatedAt.Time,
+	}
+	if len(row.Parsers) > 0 {
+		// Rows that don't hold a list are shown without parsers,
+		// as they are when loaded
+		json.Unmarshal(row.Parsers, &resource.Parsers)
+	}
+	return resource
+}
+
+func (s *HttpServer) listPipelines(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	rows, err := s.store.ListActiveLogPipelines(r.Context())
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	pipelines := make([]pipelineResource, 0, len(rows))
+	for _, row := range rows {
+		pipelines = append(pipelines, newPipelineResource(row))
+	}
+	writeJson(w, http.StatusOK, pipelines)
+}
+
+func (s *HttpServer) getPipeline(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	row, err := s.store.GetLogPipeline(r.Context(), id)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	writeJson(w, http.StatusOK, newPipelineResource(row))
+}
+
+func (s *HttpServer) createPipeline(w http.ResponseWriter, r *http.Request) {
+	if !s.requireStore(w) {
+		return
+	}
+	var req pipelineRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	parsers, ok := validatePipeline(w, &req)
+	if !ok {
+		return
+	}
+
+	row, err := s.store.CreateLogPipeline(r.Context(), model.CreateLogPipelineParams{
+		Name:    req.Name,
+		Source:  req.Source,
+		Parsers: parsers,
+		Topic:   pgtype.Text{String: req.Topic, Valid: req.Topic != ""},
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Info("log pipeline created", zap.String("pipeline", row.Name), zap.String("source", row.Source))
+	writeJson(w, http.StatusCreated, newPipelineResource(row))
+}
+
+func (s *HttpServer) updatePipeline(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	var req pipelineRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	parsers, ok := validatePipeline(w, &req)
+	if !ok {
+		return
+	}
+
+	row, err := s.store.UpdateLogPipeline(r.Context(), model.UpdateLogPipelineParams{
+		ID:      id,
+		Name:    req.Name,
+		Source:  req.Source,
+		Parsers: parsers,
+		Topic:   pgtype.Text{String: req.Topic, Valid: req.Topic != ""},
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.logger.Info("log pipeline updated", zap.String("pipeline", row.Name), zap.String("source", row.Source))
+	writeJson(w, http.StatusOK, newPipelineResource(row))
+}
+
+func (s *HttpServer) deletePipeline(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.pathId(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := s.store.DeleteLogPipeline(r.Context(), id)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if deleted == 0 {
+		s.writeError(w, pgx.ErrNoRows)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validatePipeline checks a pipeline request, returning
+// its parsers as the JSON array they're stored as
+func validatePipeline(w http.ResponseWriter, req *pipelineRequest) ([]byte, bool) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || req.Source == "" {
+		writeMessage(w, http.StatusBadRequest, "name and source are required")
+		return nil, false
+	}
+	if len(req.Parsers) == 0 {
+		writeMessage(w, http.StatusBadRequest, "at least one parser is required")
+		return nil, false
+	}
+	if req.Topic != "" && topicSafe.MatchString(req.Topic) {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid topic %q", req.Topic))
+		return nil, false
+	}
+	parsers, err := json.Marshal(req.Parsers)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return parsers, true
+}
+
+func (s *HttpServer) listPlugins(w http.ResponseWriter, r *http.Request) {
+	plugins := []registry.PluginStatus{}
+	if s.registry != nil {
+		plugins = s.registry.Plugins()
+	}
+	writeJson(w, http.StatusOK, plugins)
+}
+
+// listHits returns the most recent policy hits, newest first,
+// up to the limit query parameter
+func (s *HttpServer) listHits(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeMessage(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = parsed
+	}
+	hits := []RecentHit{}
+	if s.hits != nil {
+		hits = s.hits.Recent(limit)
+	}
+	writeJson(w, http.StatusOK, hits)
+}
+
+func (s *HttpServer) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.health.Live(r.Context()))
+}
+
+func (s *HttpServer) readyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, s.health.Ready())
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if !report.Ok() {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, report)
+}
+
+// requireStore fails requests needing the database when there isn't one
+func (s *HttpServer) requireStore(w http.ResponseWriter) bool {
+	if s.store == nil {
+		writeMessage(w, http.StatusServiceUnavailable, "no database configured")
+		return false
+	}
+	return true
+}
+
+// pathId reads the id of the resource a request is for
+func (s *HttpServer) pathId(w http.ResponseWriter, r *http.Request) (pgtype.UUID, bool) {
+	if !s.requireStore(w) {
+		return pgtype.UUID{}, false
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid id %q", r.PathValue("id")))
+		return pgtype.UUID{}, false
+	}
+	return pgtype.UUID{Bytes: id, Valid: true}, true
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %s", err))
+		return false
+	}
+	return true
+}
+
+// writeError responds with not found for missing rows, and
+// otherwise logs the error without exposing it
+func (s *HttpServer) writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeMessage(w, http.StatusNotFound, "not found")
+		return
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		writeMessage(w, http.StatusConflict, "conflict")
+		return
+	}
+	s.logger.Error("management request failed", zap.Error(err))
+	writeMessage(w, http.StatusInternalServerError, "internal error")
+}
+
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
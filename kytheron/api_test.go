@@ -0,0 +1,377 @@
+package kytheron
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/eval"
+	"github.com/kytheron-org/kytheron/model"
+	"github.com/kytheron-org/kytheron/policy"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// managementStore keeps policies, their versions and pipelines in memory
+type managementStore struct {
+	policies  []model.Policy
+	versions  []model.PolicyVersion
+	pipelines []model.LogPipeline
+	// conflict fails saving versions as a duplicate would
+	conflict bool
+}
+
+// InTx restores the store's rows when fn fails, as a rolled back transaction would
+func (m *managementStore) InTx(_ context.Context, fn func(ManagementQueries) error) error {
+	policies := append([]model.Policy(nil), m.policies...)
+	versions := append([]model.PolicyVersion(nil), m.versions...)
+	pipelines := append([]model.LogPipeline(nil), m.pipelines...)
+	if err := fn(m); err != nil {
+		m.policies, m.versions, m.pipelines = policies, versions, pipelines
+		return err
+	}
+	return nil
+}
+
+func newId() pgtype.UUID {
+	return pgtype.UUID{Bytes: uuid.New(), Valid: true}
+}
+
+func now() pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: time.Now(), Valid: true}
+}
+
+func (m *managementStore) ListActivePolicies(context.Context) ([]model.Policy, error) {
+	var rows []model.Policy
+	for _, row := range m.policies {
+		if !row.DeletedAt.Valid {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func (m *managementStore) findPolicy(id pgtype.UUID) *model.Policy {
+	for i := range m.policies {
+		if m.policies[i].ID == id && !m.policies[i].DeletedAt.Valid {
+			return &m.policies[i]
+		}
+	}
+	return nil
+}
+
+func (m *managementStore) GetPolicy(_ context.Context, id pgtype.UUID) (model.Policy, error) {
+	if row := m.findPolicy(id); row != nil {
+		return *row, nil
+	}
+	return model.Policy{}, pgx.ErrNoRows
+}
+
+func (m *managementStore) LockPolicy(ctx context.Context, id pgtype.UUID) (model.Policy, error) {
+	return m.GetPolicy(ctx, id)
+}
+
+func (m *managementStore) CreatePolicy(_ context.Context, arg model.CreatePolicyParams) (model.Policy, error) {
+	row := model.Policy{ID: newId(), Name: arg.Name, Path: arg.Path, CreatedAt: now(), UpdatedAt: now()}
+	m.policies = append(m.policies, row)
+	return row, nil
+}
+
+func (m *managementStore) UpdatePolicy(_ context.Context, arg model.UpdatePolicyParams) (model.Policy, error) {
+	row := m.findPolicy(arg.ID)
+	if row == nil {
+		return model.Policy{}, pgx.ErrNoRows
+	}
+	row.Name, row.Path, row.UpdatedAt = arg.Name, arg.Path, now()
+	return *row, nil
+}
+
+func (m *managementStore) DeletePolicy(_ context.Context, id pgtype.UUID) (int64, error) {
+	row := m.findPolicy(id)
+	if row == nil {
+		return 0, nil
+	}
+	row.DeletedAt = now()
+	return 1, nil
+}
+
+func (m *managementStore) ActivatePolicyVersion(ctx context.Context, arg model.ActivatePolicyVersionParams) (model.Policy, error) {
+	row := m.findPolicy(arg.ID)
+	if row == nil {
+		return model.Policy{}, pgx.ErrNoRows
+	}
+	if _, err := m.GetPolicyVersion(ctx, model.GetPolicyVersionParams{PolicyID: arg.ID, Version: arg.ActiveVersion.Int32}); err != nil {
+		return model.Policy{}, err
+	}
+	row.ActiveVersion, row.Pinned, row.UpdatedAt = arg.ActiveVersion, arg.Pinned, now()
+	return *row, nil
+}
+
+func (m *managementStore) ListPolicyVersions(_ context.Context, policyID pgtype.UUID) ([]model.PolicyVersion, error) {
+	var rows []model.PolicyVersion
+	for i := len(m.versions) - 1; i >= 0; i-- {
+		if m.versions[i].PolicyID == policyID {
+			rows = append(rows, m.versions[i])
+		}
+	}
+	return rows, nil
+}
+
+func (m *managementStore) GetPolicyVersion(_ context.Context, arg model.GetPolicyVersionParams) (model.PolicyVersion, error) {
+	for _, row := range m.versions {
+		if row.PolicyID == arg.PolicyID && row.Version == arg.Version {
+			return row, nil
+		}
+	}
+	return model.PolicyVersion{}, pgx.ErrNoRows
+}
+
+func (m *managementStore) CreatePolicyVersion(ctx context.Context, arg model.CreatePolicyVersionParams) (model.PolicyVersion, error) {
+	if m.conflict {
+		return model.PolicyVersion{}, &pgconn.PgError{Code: uniqueViolation}
+	}
+	latest, _ := m.ListPolicyVersions(ctx, arg.PolicyID)
+	row := model.PolicyVersion{ID: newId(), PolicyID: arg.PolicyID, Version: 1, Content: arg.Content, Checksum: arg.Checksum, Author: arg.Author, CreatedAt: now()}
+	if len(latest) > 0 {
+		row.Version = latest[0].Version + 1
+	}
+	m.versions = append(m.versions, row)
+	if policy := m.findPolicy(arg.PolicyID); policy != nil && !policy.Pinned {
+		policy.ActiveVersion = pgtype.Int4{Int32: row.Version, Valid: true}
+	}
+	return row, nil
+}
+
+func (m *managementStore) ListActiveLogPipelines(context.Context) ([]model.LogPipeline, error) {
+	var rows []model.LogPipeline
+	for _, row := range m.pipelines {
+		if !row.DeletedAt.Valid {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+func (m *managementStore) findPipeline(id pgtype.UUID) *model.LogPipeline {
+	for i := range m.pipelines {
+		if m.pipelines[i].ID == id && !m.pipelines[i].DeletedAt.Valid {
+			return &m.pipelines[i]
+		}
+	}
+	return nil
+}
+
+func (m *managementStore) GetLogPipeline(_ context.Context, id pgtype.UUID) (model.LogPipeline, error) {
+	if row := m.findPipeline(id); row != nil {
+		return *row, nil
+	}
+	return model.LogPipeline{}, pgx.ErrNoRows
+}
+
+func (m *managementStore) CreateLogPipeline(_ context.Context, arg model.CreateLogPipelineParams) (model.LogPipeline, error) {
+	row := model.LogPipeline{ID: newId(), Name: arg.Name, Source: arg.Source, Parsers: arg.Parsers, Topic: arg.Topic, CreatedAt: now(), UpdatedAt: now()}
+	m.pipelines = append(m.pipelines, row)
+	return row, nil
+}
+
+func (m *managementStore) UpdateLogPipeline(_ context.Context, arg model.UpdateLogPipelineParams) (model.LogPipeline, error) {
+	row := m.findPipeline(arg.ID)
+	if row == nil {
+		return model.LogPipeline{}, pgx.ErrNoRows
+	}
+	row.Name, row.Source, row.Parsers, row.Topic, row.UpdatedAt = arg.Name, arg.Source, arg.Parsers, arg.Topic, now()
+	return *row, nil
+}
+
+func (m *managementStore) DeleteLogPipeline(_ context.Context, id pgtype.UUID) (int64, error) {
+	row := m.findPipeline(id)
+	if row == nil {
+		return 0, nil
+	}
+	row.DeletedAt = now()
+	return 1, nil
+}
+
+func request(t *testing.T, handler http.Handler, method, target, body string, v any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if v != nil {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), v), rec.Body.String())
+	}
+	return rec.Code
+}
+
+func TestApiPolicies(t *testing.T) {
+	content, err := os.ReadFile("../samples/policies/aws_iam_root_user_access.hcl")
+	assert.NoError(t, err)
+	store := &managementStore{}
+	storage := afero.NewMemMapFs()
+	handler := NewHttpServer(store, storage, nil, nil, nil, zap.NewNop()).Handler()
+
+	body, _ := json.Marshal(map[string]string{"name": "root access", "path": "aws/root.hcl", "content": string(content), "author": "alice"})
+	var created policyResource
+	assert.Equal(t, http.StatusCreated, request(t, handler, http.MethodPost, "/api/v1/policies", string(body), &created))
+	assert.Equal(t, "aws/root.hcl", created.Path)
+	assert.Equal(t, int32(1), created.ActiveVersion)
+
+	// The content was saved as the policy's first version
+	assert.Len(t, store.versions, 1)
+	assert.Equal(t, "alice", store.versions[0].Author)
+
+	var fetched policyResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/api/v1/policies/"+created.Id, "", &fetched))
+	assert.Equal(t, string(content), fetched.Content)
+
+	var updated policyResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodPut, "/api/v1/policies/"+created.Id, `{"name": "root", "path": "aws/root.hcl"}`, &updated))
+	assert.Equal(t, "root", updated.Name)
+
+	assert.Equal(t, http.StatusNoContent, request(t, handler, http.MethodDelete, "/api/v1/policies/"+created.Id, "", nil))
+	assert.Equal(t, http.StatusNotFound, request(t, handler, http.MethodDelete, "/api/v1/policies/"+created.Id, "", nil))
+	var listed []policyResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/api/v1/policies", "", &listed))
+	assert.Empty(t, listed)
+
+	// Invalid policies are rejected before anything is stored
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodPost, "/api/v1/policies", `{"name": "bad", "path": "bad.hcl", "content": "policy {"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodPost, "/api/v1/policies", `{"name": "bad", "path": "bad.txt"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodGet, "/api/v1/policies/nope", "", nil))
+	assert.Len(t, store.versions, 1)
+
+	// Policies without a version are read from policy storage
+	assert.NoError(t, afero.WriteFile(storage, "/aws/legacy.hcl", content, 0644))
+	var unversioned policyResource
+	assert.Equal(t, http.StatusCreated, request(t, handler, http.MethodPost, "/api/v1/policies", `{"name": "legacy", "path": "aws/legacy.hcl"}`, &unversioned))
+	assert.Zero(t, unversioned.ActiveVersion)
+	var legacy policyResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/api/v1/policies/"+unversioned.Id, "", &legacy))
+	assert.Equal(t, string(content), legacy.Content)
+}
+
+func TestApiPolicyVersions(t *testing.T) {
+	content, err := os.ReadFile("../samples/policies/aws_iam_root_user_access.hcl")
+	assert.NoError(t, err)
+	revised := strings.Replace(string(content), "root", "root user", 1)
+	store := &managementStore{}
+	handler := NewHttpServer(store, nil, nil, nil, nil, zap.NewNop()).Handler()
+
+	body, _ := json.Marshal(map[string]string{"name": "root", "path": "root.hcl", "content": string(content)})
+	var created policyResource
+	assert.Equal(t, http.StatusCreated, request(t, handler, http.MethodPost, "/api/v1/policies", string(body), &created))
+	policyPath := "/api/v1/policies/" + created.Id
+
+	// Saving content activates the new version
+	body, _ = json.Marshal(map[string]string{"name": "root", "path": "root.hcl", "content": revised, "author": "bob"})
+	var updated policyResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodPut, policyPath, string(body), &updated))
+	assert.Equal(t, int32(2), updated.ActiveVersion)
+
+	var versions []policyVersionResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, policyPath+"/versions", "", &versions))
+	assert.Len(t, versions, 2)
+	assert.Equal(t, int32(2), versions[0].Version)
+	assert.Equal(t, "bob", versions[0].Author)
+	assert.Equal(t, defaultPolicyAuthor, versions[1].Author)
+	assert.Len(t, versions[1].Checksum, 64)
+	assert.Empty(t, versions[0].Content)
+
+	var version policyVersionResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, policyPath+"/versions/1", "", &version))
+	assert.Equal(t, string(content), version.Content)
+
+	// Rolling back and pinning keeps the version active as others are saved
+	var activated policyResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodPut, policyPath+"/active", `{"version": 1, "pinned": true}`, &activated))
+	assert.Equal(t, int32(1), activated.ActiveVersion)
+	assert.True(t, activated.Pinned)
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodPut, policyPath, string(body), &updated))
+	assert.Equal(t, int32(1), updated.ActiveVersion)
+
+	var fetched policyResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, policyPath, "", &fetched))
+	assert.Equal(t, string(content), fetched.Content)
+
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodPut, policyPath+"/active", `{"version": 3}`, &activated))
+	assert.Equal(t, int32(3), activated.ActiveVersion)
+	assert.False(t, activated.Pinned)
+
+	assert.Equal(t, http.StatusNotFound, request(t, handler, http.MethodPut, policyPath+"/active", `{"version": 4}`, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodPut, policyPath+"/active", `{}`, nil))
+	assert.Equal(t, http.StatusNotFound, request(t, handler, http.MethodGet, policyPath+"/versions/4", "", nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodGet, policyPath+"/versions/latest", "", nil))
+
+	// A version that can't be saved leaves the policy as it was
+	store.conflict = true
+	body, _ = json.Marshal(map[string]string{"name": "renamed", "path": "root.hcl", "content": revised})
+	assert.Equal(t, http.StatusConflict, request(t, handler, http.MethodPut, policyPath, string(body), nil))
+	assert.Equal(t, http.StatusConflict, request(t, handler, http.MethodPost, "/api/v1/policies", string(body), nil))
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, policyPath, "", &fetched))
+	assert.Equal(t, "root", fetched.Name)
+	assert.Len(t, store.policies, 1)
+}
+
+func TestApiPipelines(t *testing.T) {
+	handler := NewHttpServer(&managementStore{}, nil, nil, nil, nil, zap.NewNop()).Handler()
+
+	var created pipelineResource
+	assert.Equal(t, http.StatusCreated, request(t, handler, http.MethodPost, "/api/v1/pipelines", `{"name": "edge", "source": "edge-1", "parsers": ["json"]}`, &created))
+	assert.Equal(t, []string{"json"}, created.Parsers)
+
+	var updated pipelineResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodPut, "/api/v1/pipelines/"+created.Id, `{"name": "edge", "source": "edge-1", "parsers": ["json", "logfmt"], "topic": "edge-logs"}`, &updated))
+	assert.Equal(t, []string{"json", "logfmt"}, updated.Parsers)
+	assert.Equal(t, "edge-logs", updated.Topic)
+
+	var listed []pipelineResource
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/api/v1/pipelines", "", &listed))
+	assert.Len(t, listed, 1)
+
+	assert.Equal(t, http.StatusNoContent, request(t, handler, http.MethodDelete, "/api/v1/pipelines/"+created.Id, "", nil))
+	assert.Equal(t, http.StatusNotFound, request(t, handler, http.MethodGet, "/api/v1/pipelines/"+created.Id, "", nil))
+
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodPost, "/api/v1/pipelines", `{"name": "edge", "source": "edge-1"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodPost, "/api/v1/pipelines", `{"name": "edge", "source": "edge-1", "parsers": ["json"], "topic": "edge logs"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodPost, "/api/v1/pipelines", `{"name": "edge", "sources": "edge-1"}`, nil))
+}
+
+func TestApiWithoutDatabase(t *testing.T) {
+	handler := NewHttpServer(nil, nil, nil, nil, nil, zap.NewNop()).Handler()
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, handler, http.MethodGet, "/api/v1/policies", "", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, handler, http.MethodDelete, "/api/v1/pipelines/"+uuid.NewString(), "", nil))
+
+	var plugins []any
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/api/v1/plugins", "", &plugins))
+	assert.Empty(t, plugins)
+}
+
+func TestApiHits(t *testing.T) {
+	hits := NewHits(2)
+	p := &policy.Policy{Name: "root.hcl"}
+	for _, id := range []string{"one", "two", "three"} {
+		hits.Record(eval.Hit{Policy: p, Evaluation: &policy.Evaluation{Type: "detection", Name: "root"}, Log: &plugin.ParsedLog{Id: id}}, time.Now())
+	}
+	handler := NewHttpServer(nil, nil, nil, hits, nil, zap.NewNop()).Handler()
+
+	var recent []RecentHit
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/api/v1/hits", "", &recent))
+	assert.Len(t, recent, 2)
+	assert.Equal(t, "three", recent[0].ParsedLogId)
+	assert.Equal(t, "two", recent[1].ParsedLogId)
+	assert.Equal(t, "detection.root", recent[0].Evaluation)
+
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/api/v1/hits?limit=1", "", &recent))
+	assert.Len(t, recent, 1)
+	assert.Equal(t, http.StatusBadRequest, request(t, handler, http.MethodGet, "/api/v1/hits?limit=x", "", nil))
+}
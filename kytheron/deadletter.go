@@ -0,0 +1,294 @@
+package kytheron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/queue"
+	"github.com/kytheron-org/kytheron/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StageIngest = "ingest"
+	StageParsed = "parsed"
+
+	// AttemptsHeader carries the attempts made at handling a
+	// message, so replayed messages keep counting from where they left off
+	AttemptsHeader = "kytheron-attempts"
+
+	defaultAttemptBackoff = time.Second
+)
+
+// DeadLetter is the record placed on the dead-letter topic
+// for a message that could not be handled
+type DeadLetter struct {
+	Stage     string    `json:"stage"`
+	Error     string    `json:"error"`
+	Plugin    string    `json:"plugin,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+	// Message is the original message value
+	Message []byte `json:"message"`
+	// Headers are the original message headers, such as its
+	// source and trace, which are restored when it's replayed
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// PluginError is a failure returned by a plugin while handling a message
+type PluginError struct {
+	Plugin string
+	Err    error
+}
+
+func (e *PluginError) Error() string {
+	return fmt.Sprintf("plugin %s: %s", e.Plugin, e.Err)
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// pluginNames collects the names of every plugin that failed within err
+func pluginNames(err error) []string {
+	names := map[string]struct{}{}
+	var walk func(err error)
+	walk = func(err error) {
+		if err == nil {
+			return
+		}
+		if pluginErr, ok := err.(*PluginError); ok {
+			names[pluginErr.Plugin] = struct{}{}
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner)
+			}
+		}
+	}
+	walk(err)
+
+	var result []string
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// messageAttempts reads the attempts already made at handling a message
+func messageAttempts(msg *queue.Message) int {
+	attempts, err := strconv.Atoi(msg.Headers[AttemptsHeader])
+	if err != nil {
+		return 0
+	}
+	return attempts
+}
+
+// handle runs the handler for a message, retrying up to the configured
+// attempts with an exponential backoff. Messages that still fail are
+// sent to the dead-letter topic, and an error is only returned if that
+// fails too, or the context ends while backing off. The message is
+// handled within the trace carried by its headers
+func (p *Processor) handle(ctx context.Context, stage string, msg *queue.Message, handler queue.Handler) error {
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, msg.Headers), "process "+stage,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(tracing.MessageAttributes(msg)...),
+	)
+	defer span.End()
+
+	attempts := p.config.Kafka.DeadLetter.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := p.config.Kafka.DeadLetter.Backoff
+	if backoff <= 0 {
+		backoff = defaultAttemptBackoff
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = p.call(ctx, stage, msg, handler); err == nil {
+			return nil
+		}
+		span.RecordError(err, trace.WithAttributes(attribute.Int("attempt", attempt)))
+		p.logger.Warn("failed to handle message",
+			zap.String("stage", stage),
+			zap.String("partition", msg.String()),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+		if attempt >= attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			// The message is nacked, to be handled again once the server restarts
+			span.SetStatus(codes.Error, ctx.Err().Error())
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	span.SetStatus(codes.Error, err.Error())
+	return p.deadLetter(ctx, stage, msg, messageAttempts(msg)+attempts, err)
+}
+
+// call runs a handler, turning a panic into an error so the message
+// is retried and dead lettered rather than taking the server down
+func (p *Processor) call(ctx context.Context, stage string, msg *queue.Message, handler queue.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logger.Error("handler panicked",
+				zap.String("stage", stage),
+				zap.String("partition", msg.String()),
+				zap.Any("panic", r),
+				zap.Stack("stack"),
+			)
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return handler(ctx, msg)
+}
+
+// deadLetter places a message that could not be processed at the given
+// stage on the dead-letter topic, alongside the reason it failed. Without
+// a dead-letter topic the message is logged and dropped, as handling it
+// again would fail the same way, holding back the messages behind it
+func (p *Processor) deadLetter(ctx context.Context, stage string, msg *queue.Message, attempts int, err error) error {
+	logger := p.logger.With(
+		zap.String("stage", stage),
+		zap.String("partition", msg.String()),
+		zap.Int("attempts", attempts),
+		zap.NamedError("cause", err),
+	)
+
+	if p.queues.DeadLetter == nil {
+		logger.Error("message dropped, no dead-letter topic configured", zap.ByteString("message", msg.Value))
+		return nil
+	}
+
+	record := DeadLetter{
+		Stage:     stage,
+		Error:     err.Error(),
+		Plugin:    strings.Join(pluginNames(err), ","),
+		Attempts:  attempts,
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: time.Now().UTC(),
+		Message:   msg.Value,
+		Headers:   msg.Headers,
+	}
+	content, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+
+	deadLetterTopic := p.queues.Topics.DeadLetter
+	if err := p.queues.DeadLetter.Publish(ctx, &queue.Message{
+		Topic:   deadLetterTopic,
+		Value:   content,
+		Headers: map[string]string{"stage": stage},
+	}); err != nil {
+		return fmt.Errorf("failed to produce dead letter: %w", err)
+	}
+	trace.SpanFromContext(ctx).AddEvent("message dead lettered", trace.WithAttributes(attribute.String("topic", deadLetterTopic)))
+	logger.Warn("message dead lettered", zap.String("topic", deadLetterTopic))
+	return nil
+}
+
+// replayHeaders restores a dead letter's original headers, with
+// the attempts made so far in place of those it was delivered with
+func replayHeaders(record DeadLetter) map[string]string {
+	headers := make(map[string]string, len(record.Headers)+1)
+	for key, value := range record.Headers {
+		headers[key] = value
+	}
+	headers[AttemptsHeader] = strconv.Itoa(record.Attempts)
+	return headers
+}
+
+// Replay moves dead-lettered messages of a stage back onto the stage's
+// topic, so they're handled again. It reads the dead-letter topic until
+// no message arrives within the idle timeout, returning the count replayed
+func Replay(cfg *config.Config, stage string, idle time.Duration, logger *zap.Logger) (int, error) {
+	if stage != StageIngest && stage != StageParsed {
+		return 0, fmt.Errorf("unsupported stage %q", stage)
+	}
+	if cfg.Kafka.DeadLetter.Topic == "" {
+		return 0, fmt.Errorf("no dead-letter topic configured")
+	}
+
+	queues, err := NewQueues(cfg, fmt.Sprintf("kytheron-replay-%s", stage), logger)
+	if err != nil {
+		return 0, err
+	}
+	defer queues.Close()
+	if queues.DeadLetter == nil {
+		return 0, fmt.Errorf("queue driver %s does not keep dead letters", cfg.Queue.Driver)
+	}
+	target, targetQueue := queues.Topics.Ingest, queues.Ingest
+	if stage == StageParsed {
+		target, targetQueue = queues.Topics.Parsed, queues.Parsed
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Stop once the topic has been idle for the timeout
+	timer := time.AfterFunc(idle, cancel)
+	defer timer.Stop()
+
+	replayed := 0
+	err = queues.DeadLetter.Subscribe(ctx, []string{queues.Topics.DeadLetter}, func(ctx context.Context, msg *queue.Message) error {
+		timer.Stop()
+		defer timer.Reset(idle)
+
+		var record DeadLetter
+		if err := json.Unmarshal(msg.Value, &record); err != nil {
+			logger.Warn("skipping invalid dead letter", zap.String("partition", msg.String()), zap.Error(err))
+			return queues.DeadLetter.Ack(msg)
+		}
+		if record.Stage != stage {
+			return queues.DeadLetter.Ack(msg)
+		}
+
+		// Raw logs go back to the source topic they came from
+		topic := target
+		if stage == StageIngest && record.Topic != "" {
+			topic = record.Topic
+		}
+		if err := targetQueue.Publish(ctx, &queue.Message{
+			Topic:   topic,
+			Value:   record.Message,
+			Headers: replayHeaders(record),
+		}); err != nil {
+			return err
+		}
+		// Only acknowledge once the message is back on its topic
+		if err := queues.DeadLetter.Ack(msg); err != nil {
+			return err
+		}
+
+		replayed++
+		logger.Debug("replayed dead letter", zap.String("stage", record.Stage), zap.String("topic", topic))
+		return nil
+	})
+	return replayed, err
+}
@@ -0,0 +1,109 @@
+package kytheron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/queue"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPluginNames(t *testing.T) {
+	err := fmt.Errorf("%w: %w", ErrParseFailed, errors.Join(
+		&PluginError{Plugin: "json", Err: errors.New("invalid character")},
+		&PluginError{Plugin: "cloudtrail", Err: errors.New("missing Records")},
+	))
+
+	assert.Equal(t, []string{"cloudtrail", "json"}, pluginNames(err))
+	assert.Empty(t, pluginNames(ErrNoParser))
+}
+
+func TestMessageAttempts(t *testing.T) {
+	assert.Equal(t, 0, messageAttempts(&queue.Message{}))
+	assert.Equal(t, 3, messageAttempts(&queue.Message{
+		Headers: map[string]string{AttemptsHeader: "3"},
+	}))
+}
+
+func TestHandleBackoff(t *testing.T) {
+	cfg := &config.Config{Kafka: config.KafkaMap{DeadLetter: config.DeadLetter{Attempts: 3, Backoff: 10 * time.Millisecond}}}
+	p := &Processor{config: cfg, queues: &Queues{}, logger: zap.NewNop()}
+
+	// Attempts back off from the configured backoff, doubling each time
+	var attempts []time.Time
+	err := p.handle(context.Background(), StageIngest, &queue.Message{}, func(ctx context.Context, msg *queue.Message) error {
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, attempts, 3)
+	assert.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), 10*time.Millisecond)
+	assert.GreaterOrEqual(t, attempts[2].Sub(attempts[1]), 20*time.Millisecond)
+
+	// Messages still backing off when the context ends aren't dead lettered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = p.handle(ctx, StageIngest, &queue.Message{}, func(ctx context.Context, msg *queue.Message) error {
+		return errors.New("unavailable")
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReplayHeaders(t *testing.T) {
+	headers := replayHeaders(DeadLetter{
+		Attempts: 4,
+		Headers: map[string]string{
+			SourceHeader:   "edge-1",
+			"traceparent":  "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			AttemptsHeader: "1",
+		},
+	})
+	assert.Equal(t, map[string]string{
+		SourceHeader:   "edge-1",
+		"traceparent":  "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		AttemptsHeader: "4",
+	}, headers)
+}
+
+// settleCounter counts the messages acknowledged and nacked on a queue
+type settleCounter struct {
+	queue.Queue
+	acks  atomic.Int32
+	nacks atomic.Int32
+}
+
+func (s *settleCounter) Ack(*queue.Message) error {
+	s.acks.Add(1)
+	return nil
+}
+
+func (s *settleCounter) Nack(*queue.Message) error {
+	s.nacks.Add(1)
+	return nil
+}
+
+func TestConsumeWithoutDeadLetterTopic(t *testing.T) {
+	cfg := &config.Config{Kafka: config.KafkaMap{DeadLetter: config.DeadLetter{Attempts: 2, Backoff: time.Millisecond}}}
+	p := &Processor{config: cfg, queues: &Queues{}, logger: zap.NewNop(), work: context.Background()}
+	q := &settleCounter{Queue: queue.NewChannel(1)}
+
+	// Messages that always fail are dropped once their attempts run out,
+	// rather than coming back forever
+	var attempts int
+	handler := p.consume(q, StageIngest, func(ctx context.Context, msg *queue.Message) error {
+		attempts++
+		return ErrNoParser
+	})
+	assert.NoError(t, handler(context.Background(), &queue.Message{Topic: "ingest"}))
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, int32(1), q.acks.Load())
+	assert.Zero(t, q.nacks.Load())
+}
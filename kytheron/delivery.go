@@ -0,0 +1,110 @@
+package kytheron
+
+import (
+	"context"
+	"fmt"
+	"github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultMaxInFlightLogs = 1000
+
+	// maxFailureDetails bounds the failures returned to a source,
+	// keeping the status within gRPC's trailer size limits
+	maxFailureDetails = 100
+
+	// ReasonLogNotPersisted is the ErrorInfo reason for a
+	// streamed log that wasn't acknowledged by the queue
+	ReasonLogNotPersisted = "LOG_NOT_PERSISTED"
+	ErrorDomain           = "kytheron.io"
+)
+
+// deliveryFailure is a streamed log that couldn't be published
+type deliveryFailure struct {
+	index int
+	id    string
+	err   error
+}
+
+// streamDeliveries tracks the logs of a stream being
+// published, until each is acknowledged or has failed
+type streamDeliveries struct {
+	wg       sync.WaitGroup
+	inFlight chan struct{}
+	count    int
+
+	mu       sync.Mutex
+	failures []deliveryFailure
+}
+
+func newStreamDeliveries(maxInFlight int) *streamDeliveries {
+	return &streamDeliveries{inFlight: make(chan struct{}, maxInFlight)}
+}
+
+// add publishes a log in the background, blocking
+// while the maximum number of logs are in flight
+func (d *streamDeliveries) add(ctx context.Context, rawLog *plugin.RawLog, publish LogReceiveHandler) {
+	index := d.count
+	d.count++
+
+	d.inFlight <- struct{}{}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer func() { <-d.inFlight }()
+		if err := publish(ctx, rawLog); err != nil {
+			d.mu.Lock()
+			d.failures = append(d.failures, deliveryFailure{index: index, id: rawLog.Id, err: err})
+			d.mu.Unlock()
+		}
+	}()
+}
+
+// wait returns once every log has been acknowledged or has failed,
+// with a status describing the failures if there were any
+func (d *streamDeliveries) wait(logger *zap.Logger) error {
+	d.wg.Wait()
+	if len(d.failures) == 0 {
+		return nil
+	}
+
+	sort.Slice(d.failures, func(i, j int) bool { return d.failures[i].index < d.failures[j].index })
+	st := status.New(codes.Unavailable, fmt.Sprintf("%d of %d logs were not persisted", len(d.failures), d.count))
+
+	var details []*errdetails.ErrorInfo
+	for _, failure := range d.failures {
+		logger.Warn("failed to publish streamed log",
+			zap.Int("index", failure.index),
+			zap.String("log_id", failure.id),
+			zap.Error(failure.err),
+		)
+		if len(details) < maxFailureDetails {
+			details = append(details, &errdetails.ErrorInfo{
+				Reason: ReasonLogNotPersisted,
+				Domain: ErrorDomain,
+				Metadata: map[string]string{
+					"index":  strconv.Itoa(failure.index),
+					"log_id": failure.id,
+					"error":  failure.err.Error(),
+				},
+			})
+		}
+	}
+
+	for _, detail := range details {
+		withDetail, err := st.WithDetails(detail)
+		if err != nil {
+			logger.Error("failed to attach failure details", zap.Error(err))
+			break
+		}
+		st = withDetail
+	}
+	return st.Err()
+}
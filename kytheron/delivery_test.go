@@ -0,0 +1,46 @@
+package kytheron
+
+import (
+	"context"
+	"errors"
+	"github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestStreamDeliveries(t *testing.T) {
+	publish := func(ctx context.Context, rawLog *plugin.RawLog) error {
+		if rawLog.Data == "bad" {
+			return errors.New("broker unavailable")
+		}
+		return nil
+	}
+
+	deliveries := newStreamDeliveries(2)
+	for _, data := range []string{"good", "bad", "good"} {
+		deliveries.add(context.Background(), &plugin.RawLog{Id: data + "-log", Data: data}, publish)
+	}
+	err := deliveries.wait(zap.NewNop())
+
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	assert.Equal(t, "1 of 3 logs were not persisted", st.Message())
+	assert.Equal(t, 1, len(st.Details()))
+
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	assert.Equal(t, ReasonLogNotPersisted, info.Reason)
+	assert.Equal(t, map[string]string{"index": "1", "log_id": "bad-log", "error": "broker unavailable"}, info.Metadata)
+}
+
+func TestStreamDeliveriesSucceeded(t *testing.T) {
+	deliveries := newStreamDeliveries(1)
+	deliveries.add(context.Background(), &plugin.RawLog{}, func(ctx context.Context, rawLog *plugin.RawLog) error {
+		return nil
+	})
+	assert.NoError(t, deliveries.wait(zap.NewNop()))
+}
@@ -0,0 +1,233 @@
+package kytheron
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/theory/jsonpath"
+	"go.uber.org/zap"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxLabelValues = 100
+
+	TimestampUnix      = "unix"
+	TimestampUnixMilli = "unix_ms"
+	TimestampUnixNano  = "unix_ns"
+)
+
+// labelName matches the label names Loki accepts
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Fields extracts the event timestamp, labels and structured
+// metadata configured for a source from its parsed logs
+type Fields struct {
+	timestamp *jsonpath.Path
+	format    string
+	labels    map[string]*jsonpath.Path
+	metadata  map[string]*jsonpath.Path
+
+	// values holds the values seen for each label, up to maxValues
+	mu        sync.Mutex
+	maxValues int
+	values    map[string]map[string]struct{}
+}
+
+// Extracted is what was found in a parsed log
+type Extracted struct {
+	Timestamp time.Time
+	// Stamped is false when the log's timestamp couldn't be
+	// found, and Timestamp is the time it was received
+	Stamped  bool
+	Labels   map[string]string
+	Metadata map[string]string
+}
+
+func newFields(pipeline config.Pipeline) (*Fields, error) {
+	f := &Fields{
+		format:    pipeline.Timestamp.Format,
+		labels:    make(map[string]*jsonpath.Path),
+		metadata:  make(map[string]*jsonpath.Path),
+		maxValues: pipeline.MaxLabelValues,
+		values:    make(map[string]map[string]struct{}),
+	}
+	if f.maxValues <= 0 {
+		f.maxValues = defaultMaxLabelValues
+	}
+
+	var err error
+	if pipeline.Timestamp.Path != "" {
+		if f.timestamp, err = jsonpath.Parse(pipeline.Timestamp.Path); err != nil {
+			return nil, fmt.Errorf("invalid timestamp path %q: %w", pipeline.Timestamp.Path, err)
+		}
+	}
+	for name, path := range pipeline.Labels {
+		if !labelName.MatchString(name) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if f.labels[name], err = jsonpath.Parse(path); err != nil {
+			return nil, fmt.Errorf("invalid path %q for label %s: %w", path, name, err)
+		}
+	}
+	for name, path := range pipeline.Metadata {
+		if f.metadata[name], err = jsonpath.Parse(path); err != nil {
+			return nil, fmt.Errorf("invalid path %q for metadata %s: %w", path, name, err)
+		}
+	}
+	return f, nil
+}
+
+// Extract finds the configured fields in a parsed log's data. Logs without
+// a timestamp, or whose timestamp can't be read, are given the received time
+func (f *Fields) Extract(data string, received time.Time, logger *zap.Logger) Extracted {
+	extracted := Extracted{Timestamp: received}
+	if f == nil || (f.timestamp == nil && len(f.labels) == 0 && len(f.metadata) == 0) {
+		return extracted
+	}
+
+	// Numbers are kept as written, so nanosecond timestamps
+	// aren't rounded by decoding them as floats
+	var decoded any
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return extracted
+	}
+
+	if f.timestamp != nil {
+		if value, ok := first(f.timestamp, decoded); ok {
+			timestamp, err := parseTimestamp(value, f.format)
+			if err != nil {
+				logger.Debug("using received time for log", zap.Error(err))
+			} else {
+				extracted.Timestamp, extracted.Stamped = timestamp, true
+			}
+		}
+	}
+
+	for name, path := range f.metadata {
+		if value, ok := first(path, decoded); ok {
+			if extracted.Metadata == nil {
+				extracted.Metadata = make(map[string]string)
+			}
+			extracted.Metadata[name] = stringify(value)
+		}
+	}
+	for name, path := range f.labels {
+		value, ok := first(path, decoded)
+		if !ok {
+			continue
+		}
+		s := stringify(value)
+		if !f.allow(name, s, logger) {
+			// Keep the value, without adding another stream
+			if extracted.Metadata == nil {
+				extracted.Metadata = make(map[string]string)
+			}
+			extracted.Metadata[name] = s
+			continue
+		}
+		if extracted.Labels == nil {
+			extracted.Labels = make(map[string]string)
+		}
+		extracted.Labels[name] = s
+	}
+	return extracted
+}
+
+// allow reports whether a value may be used for a label, which is
+// the case for values already seen, or while the label has room for more
+func (f *Fields) allow(name, value string, logger *zap.Logger) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	values, ok := f.values[name]
+	if !ok {
+		values = make(map[string]struct{})
+		f.values[name] = values
+	}
+	if _, ok := values[value]; ok {
+		return true
+	}
+	if len(values) >= f.maxValues {
+		return false
+	}
+	values[value] = struct{}{}
+	if len(values) == f.maxValues {
+		logger.Warn("label reached its value limit, further values are stored as metadata",
+			zap.String("label", name),
+			zap.Int("limit", f.maxValues),
+		)
+	}
+	return true
+}
+
+// first returns the first node the path selects
+func first(path *jsonpath.Path, data any) (any, bool) {
+	nodes := path.Select(data)
+	if len(nodes) == 0 || nodes[0] == nil {
+		return nil, false
+	}
+	return nodes[0], true
+}
+
+// stringify renders a node as a label or metadata value
+func stringify(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		content, _ := json.Marshal(v)
+		return string(content)
+	}
+}
+
+// parseTimestamp reads a timestamp in the given format, defaulting
+// to RFC 3339 for strings and unix seconds for numbers
+func parseTimestamp(value any, format string) (time.Time, error) {
+	var epoch string
+	switch v := value.(type) {
+	case json.Number:
+		epoch = v.String()
+	case string:
+		switch format {
+		case TimestampUnix, TimestampUnixMilli, TimestampUnixNano:
+			epoch = v
+		case "":
+			return time.Parse(time.RFC3339Nano, v)
+		default:
+			return time.Parse(format, v)
+		}
+	default:
+		return time.Time{}, fmt.Errorf("unsupported timestamp %v", value)
+	}
+
+	switch format {
+	case TimestampUnixNano:
+		// Nanoseconds since the epoch need every digit of an int64
+		nanos, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch timestamp %q: %w", epoch, err)
+		}
+		return time.Unix(0, nanos), nil
+	case TimestampUnixMilli, TimestampUnix, "":
+		parsed, err := strconv.ParseFloat(epoch, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch timestamp %q: %w", epoch, err)
+		}
+		if format == TimestampUnixMilli {
+			return time.UnixMilli(int64(parsed)), nil
+		}
+		seconds := int64(parsed)
+		return time.Unix(seconds, int64((parsed-float64(seconds))*float64(time.Second))), nil
+	default:
+		return time.Time{}, fmt.Errorf("numeric timestamp %v doesn't match format %q", value, format)
+	}
+}
@@ -0,0 +1,75 @@
+package kytheron
+
+import (
+	"encoding/json"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestFields(t *testing.T) {
+	fields, err := newFields(config.Pipeline{
+		Timestamp:      config.Timestamp{Path: "$.eventTime"},
+		Labels:         map[string]string{"event_source": "$.eventSource", "region": "$.awsRegion"},
+		Metadata:       map[string]string{"event_name": "$.eventName"},
+		MaxLabelValues: 1,
+	})
+	assert.NoError(t, err)
+
+	received := time.Now()
+	extracted := fields.Extract(`{"eventTime":"2017-02-12T19:57:06Z","eventSource":"s3.amazonaws.com","awsRegion":"us-east-1","eventName":"ListBuckets"}`, received, zap.NewNop())
+	assert.True(t, extracted.Stamped)
+	assert.Equal(t, time.Date(2017, 2, 12, 19, 57, 6, 0, time.UTC), extracted.Timestamp.UTC())
+	assert.Equal(t, map[string]string{"event_source": "s3.amazonaws.com", "region": "us-east-1"}, extracted.Labels)
+	assert.Equal(t, map[string]string{"event_name": "ListBuckets"}, extracted.Metadata)
+
+	// Values beyond a label's limit are kept as metadata, and
+	// logs without a readable timestamp keep the received time
+	extracted = fields.Extract(`{"eventTime":"yesterday","eventSource":"s3.amazonaws.com","awsRegion":"eu-west-1"}`, received, zap.NewNop())
+	assert.False(t, extracted.Stamped)
+	assert.Equal(t, received, extracted.Timestamp)
+	assert.Equal(t, map[string]string{"event_source": "s3.amazonaws.com"}, extracted.Labels)
+	assert.Equal(t, map[string]string{"region": "eu-west-1"}, extracted.Metadata)
+
+	_, err = newFields(config.Pipeline{Labels: map[string]string{"event-source": "$.eventSource"}})
+	assert.ErrorContains(t, err, "invalid label name")
+}
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2017, 2, 12, 19, 57, 6, 0, time.UTC)
+	for _, test := range []struct {
+		value  any
+		format string
+	}{
+		{"2017-02-12T19:57:06Z", ""},
+		{json.Number("1486929426"), ""},
+		{json.Number("1486929426000"), TimestampUnixMilli},
+		{"1486929426", TimestampUnix},
+		{"12/Feb/2017:19:57:06 +0000", "02/Jan/2006:15:04:05 -0700"},
+	} {
+		timestamp, err := parseTimestamp(test.value, test.format)
+		assert.NoError(t, err)
+		assert.True(t, expected.Equal(timestamp), "%v: %s", test.value, timestamp)
+	}
+
+	_, err := parseTimestamp(true, "")
+	assert.Error(t, err)
+}
+
+func TestParseTimestampNanos(t *testing.T) {
+	// Nanosecond timestamps keep every digit, which a float64 can't hold
+	expected := time.Unix(1486929426, 123456789)
+	for _, value := range []any{json.Number("1486929426123456789"), "1486929426123456789"} {
+		timestamp, err := parseTimestamp(value, TimestampUnixNano)
+		assert.NoError(t, err)
+		assert.True(t, expected.Equal(timestamp), "%v: %s", value, timestamp)
+	}
+
+	fields, err := newFields(config.Pipeline{Timestamp: config.Timestamp{Path: "$.ts", Format: TimestampUnixNano}})
+	assert.NoError(t, err)
+	extracted := fields.Extract(`{"ts":1486929426123456789}`, time.Now(), zap.NewNop())
+	assert.True(t, extracted.Stamped)
+	assert.True(t, expected.Equal(extracted.Timestamp), extracted.Timestamp)
+}
@@ -0,0 +1,216 @@
+package kytheron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/config"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+
+	HealthOk      = "ok"
+	HealthFailing = "failing"
+)
+
+// errNotChecked is reported until the readiness checks first run
+var errNotChecked = errors.New("not checked yet")
+
+// Check returns an error when something the server relies on isn't working
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// HealthReport is the result of running a set of checks
+type HealthReport struct {
+	Status string `json:"status"`
+	// Checks holds ok, or the error, for each check
+	Checks    map[string]string `json:"checks"`
+	CheckedAt time.Time         `json:"checked_at"`
+}
+
+func (r HealthReport) Ok() bool {
+	return r.Status == HealthOk
+}
+
+// Health runs the server's checks. Liveness checks find failures only
+// a restart recovers from, and run when asked. Readiness checks cover
+// the services the server relies on as well, and run periodically, with
+// their result reported by the gRPC health service
+type Health struct {
+	cfg       config.Health
+	liveness  []namedCheck
+	readiness []namedCheck
+	grpc      *health.Server
+	logger    *zap.Logger
+
+	mu       sync.RWMutex
+	ready    HealthReport
+	stopping bool
+}
+
+func NewHealth(cfg config.Health, logger *zap.Logger) *Health {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultHealthInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultHealthTimeout
+	}
+	h := &Health{
+		cfg:    cfg,
+		grpc:   health.NewServer(),
+		logger: logger,
+		ready:  failingReport("startup", errNotChecked),
+	}
+	h.setServing(false)
+	return h
+}
+
+// AddLiveness adds a check of the server itself, which is part
+// of readiness too. Checks must be added before Run is called
+func (h *Health) AddLiveness(name string, check Check) {
+	h.liveness = append(h.liveness, namedCheck{name: name, check: check})
+}
+
+// AddReadiness adds a check of a service the server relies on
+func (h *Health) AddReadiness(name string, check Check) {
+	h.readiness = append(h.readiness, namedCheck{name: name, check: check})
+}
+
+// GrpcServer is the gRPC health service, serving while the server is ready
+func (h *Health) GrpcServer() *health.Server {
+	return h.grpc
+}
+
+// Live runs the liveness checks
+func (h *Health) Live(ctx context.Context) HealthReport {
+	return h.run(ctx, h.liveness)
+}
+
+// Ready returns the result of the latest readiness checks
+func (h *Health) Ready() HealthReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ready
+}
+
+// Run checks readiness at the configured interval until the context is cancelled
+func (h *Health) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		h.checkReady(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Shutdown reports the server as no longer ready, so it's sent no
+// more work while it drains. It stays that way until it exits
+func (h *Health) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopping = true
+	h.ready = failingReport("shutdown", errors.New("shutting down"))
+	h.grpc.Shutdown()
+}
+
+func (h *Health) checkReady(ctx context.Context) {
+	report := h.run(ctx, append(h.liveness, h.readiness...))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopping {
+		return
+	}
+	if report.Ok() != h.ready.Ok() {
+		if report.Ok() {
+			h.logger.Info("server is ready")
+		} else {
+			h.logger.Warn("server is not ready", zap.Any("checks", report.Checks))
+		}
+	}
+	h.ready = report
+	h.setServing(report.Ok())
+}
+
+// run runs the checks at once, each within the configured timeout
+func (h *Health) run(ctx context.Context, checks []namedCheck) HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.check(ctx)
+		}()
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: HealthOk, Checks: make(map[string]string, len(checks)), CheckedAt: time.Now().UTC()}
+	for i, c := range checks {
+		if results[i] != nil {
+			report.Status = HealthFailing
+			report.Checks[c.name] = results[i].Error()
+		} else {
+			report.Checks[c.name] = HealthOk
+		}
+	}
+	return report
+}
+
+func (h *Health) setServing(serving bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	h.grpc.SetServingStatus("", status)
+	h.grpc.SetServingStatus(plugin.SourcePlugin_ServiceDesc.ServiceName, status)
+}
+
+func failingReport(name string, err error) HealthReport {
+	return HealthReport{Status: HealthFailing, Checks: map[string]string{name: err.Error()}, CheckedAt: time.Now().UTC()}
+}
+
+// consumerLagCheck fails while any topic's consumers are more than max messages behind
+func consumerLagCheck(queues *Queues, max int64) Check {
+	return func(ctx context.Context) error {
+		partitions, err := queues.Lag(ctx)
+		if err != nil {
+			return err
+		}
+		lag := make(map[string]int64)
+		for _, partition := range partitions {
+			lag[partition.Topic] += partition.Lag
+		}
+		var behind []string
+		for topic, messages := range lag {
+			if messages > max {
+				behind = append(behind, fmt.Sprintf("%s is %d messages behind", topic, messages))
+			}
+		}
+		if len(behind) > 0 {
+			sort.Strings(behind)
+			return fmt.Errorf("consumer lag over %d: %v", max, behind)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+package kytheron
+
+import (
+	"context"
+	"errors"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/queue"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func servingStatus(t *testing.T, h *Health) healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := h.GrpcServer().Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	return resp.Status
+}
+
+func TestHealth(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	h := NewHealth(config.Health{}, zap.NewNop())
+	h.AddLiveness("processor", func(ctx context.Context) error { return nil })
+	h.AddReadiness("database", func(ctx context.Context) error {
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	// Nothing is ready until it's been checked
+	assert.False(t, h.Ready().Ok())
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, servingStatus(t, h))
+
+	h.checkReady(context.Background())
+	report := h.Ready()
+	assert.False(t, report.Ok())
+	assert.Equal(t, map[string]string{"processor": HealthOk, "database": "connection refused"}, report.Checks)
+	assert.True(t, h.Live(context.Background()).Ok())
+
+	down.Store(false)
+	h.checkReady(context.Background())
+	assert.True(t, h.Ready().Ok())
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, servingStatus(t, h))
+
+	// Once shutting down, later checks don't make it ready again
+	h.Shutdown()
+	h.checkReady(context.Background())
+	assert.False(t, h.Ready().Ok())
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, servingStatus(t, h))
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	h := NewHealth(config.Health{}, zap.NewNop())
+	h.AddLiveness("processor", func(ctx context.Context) error { return nil })
+	handler := NewHttpServer(nil, nil, nil, nil, h, zap.NewNop()).Handler()
+
+	var report HealthReport
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/healthz", "", &report))
+	assert.Equal(t, HealthOk, report.Status)
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, handler, http.MethodGet, "/readyz", "", &report))
+
+	h.checkReady(context.Background())
+	assert.Equal(t, http.StatusOK, request(t, handler, http.MethodGet, "/readyz", "", &report))
+}
+
+// laggingQueue reports a fixed lag
+type laggingQueue struct {
+	queue.Queue
+	lag []queue.PartitionLag
+}
+
+func (q *laggingQueue) Lag(ctx context.Context) ([]queue.PartitionLag, error) {
+	return q.lag, nil
+}
+
+func TestConsumerLagCheck(t *testing.T) {
+	ingest := &laggingQueue{lag: []queue.PartitionLag{{Topic: "ingest", Partition: 0, Lag: 50}}}
+	parsed := &laggingQueue{lag: []queue.PartitionLag{{Topic: "parsed", Partition: 0, Lag: 300}, {Topic: "parsed", Partition: 1, Lag: 200}}}
+	check := consumerLagCheck(&Queues{Ingest: ingest, Parsed: parsed}, 100)
+
+	// Lag is summed across a topic's partitions
+	err := check(context.Background())
+	assert.ErrorContains(t, err, "parsed is 500 messages behind")
+	assert.NotContains(t, err.Error(), "ingest")
+
+	parsed.lag = parsed.lag[:0]
+	assert.NoError(t, check(context.Background()))
+}
+
+func TestProcessorCheck(t *testing.T) {
+	cfg := &config.Config{}
+	processor := NewProcessor(cfg, nil, nil, nil, &Queues{Topics: NewTopics(cfg)}, nil, zap.NewNop())
+	assert.NoError(t, processor.Check(context.Background()))
+
+	// Handlers that panic fail the message, rather than the consumer
+	err := processor.call(context.Background(), StageIngest, &queue.Message{}, func(ctx context.Context, msg *queue.Message) error {
+		panic("nil map")
+	})
+	assert.ErrorContains(t, err, "handler panicked: nil map")
+	assert.NoError(t, processor.Check(context.Background()))
+
+	processor.stopped("source consumer", errors.New("broker gone"))
+	assert.ErrorContains(t, processor.Check(context.Background()), "source consumer: broker gone")
+
+	// Consumers stopping on shutdown are expected to
+	processor.stop()
+	processor.stopped("parser consumer", nil)
+	assert.NotContains(t, processor.Check(context.Background()).Error(), "parser consumer")
+}
@@ -0,0 +1,79 @@
+package kytheron
+
+import (
+	"fmt"
+	"github.com/kytheron-org/kytheron/eval"
+	"sync"
+	"time"
+)
+
+const defaultRecentHits = 1000
+
+// RecentHit is a policy hit, as listed by the management API
+type RecentHit struct {
+	Time        time.Time `json:"time"`
+	Policy      string    `json:"policy"`
+	Evaluation  string    `json:"evaluation"`
+	ParsedLogId string    `json:"parsed_log_id"`
+	SourceId    string    `json:"source_id"`
+	SourceType  string    `json:"source_type"`
+	SourceName  string    `json:"source_name"`
+}
+
+// Hits keeps the most recent policy hits in memory,
+// dropping the oldest once it holds its capacity
+type Hits struct {
+	mu   sync.Mutex
+	hits []RecentHit
+	next int
+	full bool
+}
+
+func NewHits(capacity int) *Hits {
+	if capacity <= 0 {
+		capacity = defaultRecentHits
+	}
+	return &Hits{hits: make([]RecentHit, capacity)}
+}
+
+// Record adds a hit, at the time it was found
+func (h *Hits) Record(hit eval.Hit, at time.Time) {
+	recent := RecentHit{
+		Time:       at,
+		Policy:     hit.Policy.Name,
+		Evaluation: fmt.Sprintf("%s.%s", hit.Evaluation.Type, hit.Evaluation.Name),
+	}
+	if hit.Log != nil {
+		recent.ParsedLogId = hit.Log.Id
+		recent.SourceId = hit.Log.SourceId
+		recent.SourceType = hit.Log.SourceType
+		recent.SourceName = hit.Log.SourceName
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hits[h.next] = recent
+	h.next = (h.next + 1) % len(h.hits)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Recent returns up to limit hits, newest first
+func (h *Hits) Recent(limit int) []RecentHit {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.hits)
+	}
+	if limit <= 0 || limit > count {
+		limit = count
+	}
+	recent := make([]RecentHit, 0, limit)
+	for i := 1; i <= limit; i++ {
+		recent = append(recent, h.hits[(h.next-i+len(h.hits))%len(h.hits)])
+	}
+	return recent
+}
@@ -0,0 +1,75 @@
+package kytheron
+
+import (
+	"context"
+	"fmt"
+	"github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// Source plugins identify themselves with these gRPC metadata
+	// keys when opening a log stream
+	SourceNameKey = "kytheron-source-name"
+	SourceTypeKey = "kytheron-source-type"
+
+	// MetadataSourceType is the raw log metadata key
+	// holding the type of the source that sent it
+	MetadataSourceType = "source_type"
+
+	// maxSourceNameLength matches the source columns of the database
+	maxSourceNameLength = 255
+)
+
+// SourceIdentity names the source plugin sending a log stream
+type SourceIdentity struct {
+	Name string
+	// Type is the kind of source plugin, such as file
+	Type string
+}
+
+// streamIdentity reads the identity sent in the stream's gRPC metadata
+func streamIdentity(ctx context.Context) (SourceIdentity, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return SourceIdentity{}, false
+	}
+	identity := SourceIdentity{Name: firstValue(md.Get(SourceNameKey)), Type: firstValue(md.Get(SourceTypeKey))}
+	return identity, identity.Name != ""
+}
+
+// logIdentity reads the identity from the metadata of a stream's first
+// log, for source plugins that don't send it in the stream's metadata
+func logIdentity(rawLog *plugin.RawLog) (SourceIdentity, bool) {
+	identity := SourceIdentity{Name: rawLog.Metadata[MetadataSourceName], Type: rawLog.Metadata[MetadataSourceType]}
+	return identity, identity.Name != ""
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (i SourceIdentity) validate() error {
+	if len(i.Name) > maxSourceNameLength {
+		return fmt.Errorf("source name is longer than %d characters", maxSourceNameLength)
+	}
+	if i.Name == AnySource {
+		return fmt.Errorf("source name %q is reserved", AnySource)
+	}
+	return nil
+}
+
+// stamp records the identity on a raw log, replacing any the log
+// carried itself, so a stream's logs are all attributed to its source
+func (i SourceIdentity) stamp(rawLog *plugin.RawLog) {
+	if rawLog.Metadata == nil {
+		rawLog.Metadata = make(map[string]string)
+	}
+	rawLog.Metadata[MetadataSourceName] = i.Name
+	if i.Type != "" {
+		rawLog.Metadata[MetadataSourceType] = i.Type
+	}
+}
@@ -1,86 +1,365 @@
 package kytheron
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kytheron-org/kytheron/auth"
 	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/eval"
+	"github.com/kytheron-org/kytheron/metrics"
+	"github.com/kytheron-org/kytheron/model"
 	"github.com/kytheron-org/kytheron/policy"
 	"github.com/kytheron-org/kytheron/registry"
+	"github.com/kytheron-org/kytheron/sink"
+	"github.com/kytheron-org/kytheron/tracing"
+	"github.com/spf13/afero"
 	"go.uber.org/zap"
 	"log"
+	"time"
 )
 
 // What does our class do
 // It has to maintain a buffer of recent logs
 // For now, let's just give it a list of policies
 // We'll store a map of sources, and the policies that need to be evaluated
-
-// TODO: We'll want instrumentation as well
-// - how many log lines its processed
-// - the lag between current message, and tail of the stream
+//
+// The pipeline is instrumented with the Prometheus metrics of the
+// metrics package, served on the http server's /metrics
 type Kytheron struct {
 	Policies       map[string]*policy.Policy
-	mappedPolicies map[string]map[string][]string
+	engine         *eval.Engine
+	pipelines      *Pipelines
+	policyStorage  afero.Fs
+	db             *pgxpool.Pool
 	config         *config.Config
 	pluginRegistry *registry.PluginRegistry
 	logger         *zap.Logger
 }
 
-func New(cfg *config.Config, pluginRegistry *registry.PluginRegistry, logger *zap.Logger) *Kytheron {
+func New(cfg *config.Config, pluginRegistry *registry.PluginRegistry, logger *zap.Logger) (*Kytheron, error) {
 	k := &Kytheron{
 		Policies:       make(map[string]*policy.Policy),
-		mappedPolicies: make(map[string]map[string][]string),
 		pluginRegistry: pluginRegistry,
 		config:         cfg,
 		logger:         logger,
 	}
-	//for _, policy := range policies {
-	//	k.Policies[policy.Name] = policy
-	//}
-	k.Init()
-	return k
+	if err := k.connectDatabase(); err != nil {
+		return nil, err
+	}
+	if err := k.loadPolicies(); err != nil {
+		return nil, err
+	}
+	if err := k.loadPipelines(); err != nil {
+		return nil, err
+	}
+	if err := k.Init(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// connectDatabase opens the connection pool when a database is configured
+func (k *Kytheron) connectDatabase() error {
+	if k.config.Database.Url == "" {
+		return nil
+	}
+
+	pool, err := pgxpool.New(context.TODO(), fmt.Sprintf("postgres://%s", k.config.Database.Url))
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	k.db = pool
+	return nil
+}
+
+// loadPipelines combines the configured pipelines with
+// the active pipelines stored in the database
+func (k *Kytheron) loadPipelines() error {
+	pipelines, err := NewPipelines(k.config.Pipelines)
+	if err != nil {
+		return err
+	}
+	k.pipelines = pipelines
+	if k.db == nil {
+		return nil
+	}
+
+	rows, err := model.New(k.db).ListActiveLogPipelines(context.TODO())
+	if err != nil {
+		return fmt.Errorf("failed to list log pipelines: %w", err)
+	}
+	if err := k.pipelines.AddModels(rows); err != nil {
+		return err
+	}
+	k.logger.Info("log pipelines loaded", zap.Int("configured", len(k.config.Pipelines)), zap.Int("stored", len(rows)))
+	return nil
+}
+
+// loadPolicies decodes every policy in the configured policy storage, and
+// the active version of each policy stored in the database, which takes
+// the place of any file at the same path
+func (k *Kytheron) loadPolicies() error {
+	var policies []*policy.Policy
+	var invalid []error
+	if k.config.Policies.Url == "" {
+		k.logger.Warn("no policy storage configured")
+	} else {
+		storage, err := k.config.PolicyStorage()
+		if err != nil {
+			return err
+		}
+		k.policyStorage = storage
+
+		loaded, err := policy.Load(storage)
+		if err != nil {
+			invalid = append(invalid, err)
+		}
+		policies = loaded
+	}
+
+	deleted, err := k.deletedPolicies()
+	if err != nil {
+		return err
+	}
+	for _, p := range policies {
+		if deleted[p.Name] {
+			k.logger.Debug("skipping deleted policy", zap.String("policy", p.Name))
+			continue
+		}
+		k.Policies[p.Name] = p
+	}
+
+	var versions []*policy.Policy
+	if k.db != nil {
+		rows, err := model.New(k.db).ListActivePolicyVersions(context.TODO())
+		if err != nil {
+			return fmt.Errorf("failed to list policy versions: %w", err)
+		}
+		versions, err = decodePolicyVersions(rows)
+		if err != nil {
+			invalid = append(invalid, err)
+		}
+	}
+	for _, p := range versions {
+		k.Policies[p.Name] = p
+	}
+
+	if err := errors.Join(invalid...); err != nil {
+		if !k.config.Policies.AllowInvalid {
+			return fmt.Errorf("failed to load policies: %w", err)
+		}
+		k.logger.Error("starting with invalid policies skipped", zap.Error(err))
+	}
+	k.logger.Info("policies loaded", zap.Int("count", len(k.Policies)), zap.Int("versioned", len(versions)))
+	return nil
 }
 
-func (k *Kytheron) Init() {
-	for _, policy := range k.Policies {
-		for _, input := range policy.Sources {
-			if _, ok := k.mappedPolicies[input.Type]; !ok {
-				k.mappedPolicies[input.Type] = map[string][]string{}
-			}
-			if _, ok := k.mappedPolicies[input.Type][input.Name]; !ok {
-				k.mappedPolicies[input.Type][input.Name] = []string{}
-			}
-			k.mappedPolicies[input.Type][input.Name] = append(k.mappedPolicies[input.Type][input.Name], policy.Name)
+// decodePolicyVersions decodes the active versions of the policies stored in
+// the database. Like policy.Load, decode errors are returned together
+// alongside every version that decoded successfully
+func decodePolicyVersions(rows []model.ListActivePolicyVersionsRow) ([]*policy.Policy, error) {
+	var policies []*policy.Policy
+	var errs []error
+	for _, row := range rows {
+		p, err := policy.Decode(row.Path, []byte(row.Content))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s version %d: %w", row.Path, row.Version, err))
+			continue
 		}
+		policies = append(policies, p)
+	}
+	return policies, errors.Join(errs...)
+}
 
-		for _, output := range policy.Outputs {
-			if output.Version != "" {
+// deletedPolicies returns the paths of policies deleted through the
+// management API, which stay in storage but aren't loaded
+func (k *Kytheron) deletedPolicies() (map[string]bool, error) {
+	deleted := make(map[string]bool)
+	if k.db == nil {
+		return deleted, nil
+	}
 
-			}
+	rows, err := model.New(k.db).ListPolicies(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+	for _, row := range rows {
+		if row.DeletedAt.Valid {
+			deleted[row.Path] = true
 		}
 	}
+	// A path deleted once may have been added again
+	for _, row := range rows {
+		if !row.DeletedAt.Valid {
+			delete(deleted, row.Path)
+		}
+	}
+	return deleted, nil
 }
 
-//func (k *Kytheron) Handle(log *log.Log) error {
-//	inputName := log.Source.Name
-//	inputType := log.Source.Type
-//	for _, policyName := range k.mappedPolicies[inputType][inputName] {
-//		//fmt.Printf("Executing policy %s\n", policyName)
-//		policy := k.Policies[policyName]
-//		if err := policy.Process(log); err != nil {
-//			fmt.Println(err)
-//			return err
-//		}
-//	}
-//	return nil
-//}
-
-func (k *Kytheron) Run() error {
-	srv := &GrpcServer{logger: k.logger}
+// Init builds the evaluation engine from the loaded policies
+func (k *Kytheron) Init() error {
+	policies := make([]*policy.Policy, 0, len(k.Policies))
+	for _, p := range k.Policies {
+		policies = append(policies, p)
+	}
+
+	engine, err := eval.NewEngine(policies)
+	if err != nil {
+		return err
+	}
+	k.engine = engine
+	return nil
+}
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	provisionTimeout       = 30 * time.Second
+	// traceFlushTimeout bounds exporting the last spans once shut down
+	traceFlushTimeout = 5 * time.Second
+)
+
+// Run serves sources and processes their logs until the context is
+// cancelled, then shuts down within the configured shutdown timeout
+func (k *Kytheron) Run(ctx context.Context) error {
+	stopTracing, err := tracing.Setup(ctx, k.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+		defer cancel()
+		if err := stopTracing(ctx); err != nil {
+			k.logger.Warn("failed to export traces", zap.Error(err))
+		}
+	}()
+
+	// Source tokens are stored in the database, when there is one
+	var tokens auth.TokenStore
+	if k.db != nil {
+		tokens = model.New(k.db)
+	}
+	authenticator, err := auth.NewAuthenticator(k.config.Server.Grpc, tokens, k.logger)
+	if err != nil {
+		return err
+	}
+
+	queues, err := NewQueues(k.config, "", k.logger)
+	if err != nil {
+		return err
+	}
+	defer queues.Close()
+	queues.Topics.AddSources(k.pipelines)
+
+	// Topics must exist before the consumers subscribe to them
+	provisionCtx, cancel := context.WithTimeout(ctx, provisionTimeout)
+	err = queues.Provision(provisionCtx, k.config, k.pipelines)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	// The processor closes the sinks once it has stored every parsed log
+	store, err := sink.New(k.config, k.db, k.logger)
+	if err != nil {
+		return err
+	}
+
+	processor := NewProcessor(k.config, k.pluginRegistry, k.engine, k.pipelines, queues, store, k.logger)
+	lag := &lagCollector{queues: queues, logger: k.logger}
+	if err := metrics.Registry.Register(lag); err != nil {
+		return fmt.Errorf("failed to register consumer lag metrics: %w", err)
+	}
+	defer metrics.Registry.Unregister(lag)
+	health := k.health(processor, queues, store)
+	srv := NewGrpcServer(queues, authenticator, health, k.logger)
+
+	var api *HttpServer
+	if k.config.Server.Http.Port > 0 {
+		var managed ManagementStore
+		if k.db != nil {
+			managed = newDbManagementStore(k.db)
+		}
+		api = NewHttpServer(managed, k.policyStorage, k.pluginRegistry, processor.Hits(), health, k.logger)
+		if err := api.Start(k.config); err != nil {
+			return fmt.Errorf("failed to start http server: %w", err)
+		}
+	}
 
 	go func() {
-		if err := NewProcessor(k.config, k.pluginRegistry, k.logger).Run(); err != nil {
+		if err := processor.Run(); err != nil {
 			log.Fatal(err)
 		}
 	}()
+	go health.Run(ctx)
+
+	serveErr := srv.Start(ctx, k.config)
+	return errors.Join(serveErr, k.shutdown(health, api, srv, processor, queues))
+}
+
+// health checks the processor is still consuming, and
+// that the services the server relies on are reachable
+func (k *Kytheron) health(processor *Processor, queues *Queues, store sink.Sink) *Health {
+	health := NewHealth(k.config.Server.Health, k.logger)
+	health.AddLiveness("processor", processor.Check)
+	health.AddReadiness("queues", queues.Ping)
+	if lag := k.config.Server.Health.MaxConsumerLag; lag > 0 {
+		health.AddReadiness("consumer_lag", consumerLagCheck(queues, lag))
+	}
+	if k.db != nil {
+		health.AddReadiness("database", k.db.Ping)
+	}
+	if store != nil {
+		health.AddReadiness("storage", func(ctx context.Context) error {
+			return sink.Ping(ctx, store)
+		})
+	}
+	if k.pluginRegistry != nil {
+		health.AddReadiness("plugins", k.pluginRegistry.Check)
+	}
+	return health
+}
+
+// shutdown drains the pipeline in order, so nothing accepted is lost:
+// the server reports it isn't ready, the management API stops,
+// sources stop streaming, in-flight messages finish and have their
+// offsets stored, parsed logs reach the sink and published messages
+// are flushed, before the plugins are stopped
+func (k *Kytheron) shutdown(health *Health, api *HttpServer, srv *GrpcServer, processor *Processor, queues *Queues) error {
+	timeout := k.config.Server.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	k.logger.Info("shutting down", zap.Duration("timeout", timeout))
+
+	var errs []error
+	health.Shutdown()
+	if api != nil {
+		if err := api.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("http server did not stop: %w", err))
+		}
+	}
+	srv.Shutdown(ctx)
+	if err := processor.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("processor did not finish: %w", err))
+	}
+	if err := queues.Flush(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush queues: %w", err))
+	}
+	k.pluginRegistry.Shutdown()
+	if k.db != nil {
+		k.db.Close()
+	}
 
-	return srv.Start(k.config)
+	err := errors.Join(errs...)
+	if err != nil {
+		k.logger.Error("shutdown incomplete", zap.Error(err))
+	} else {
+		k.logger.Info("shutdown complete")
+	}
+	return err
 }
@@ -0,0 +1,22 @@
+package kytheron
+
+import (
+	"github.com/kytheron-org/kytheron/model"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDecodePolicyVersions(t *testing.T) {
+	content, err := os.ReadFile("../samples/policies/aws_iam_root_user_access.hcl")
+	assert.NoError(t, err)
+
+	// Invalid versions are reported without holding back the others
+	policies, err := decodePolicyVersions([]model.ListActivePolicyVersionsRow{
+		{Path: "aws/root.hcl", Version: 3, Content: string(content)},
+		{Path: "broken.hcl", Version: 2, Content: "policy {"},
+	})
+	assert.ErrorContains(t, err, "broken.hcl version 2")
+	assert.Len(t, policies, 1)
+	assert.Equal(t, "aws/root.hcl", policies[0].Name)
+}
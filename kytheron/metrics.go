@@ -0,0 +1,39 @@
+package kytheron
+
+import (
+	"context"
+	"github.com/kytheron-org/kytheron/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+// lagCollectTimeout bounds reading the consumer lag during a scrape
+const lagCollectTimeout = 5 * time.Second
+
+// lagCollector reports the consumer lag of each partition when scraped
+type lagCollector struct {
+	queues *Queues
+	logger *zap.Logger
+}
+
+var _ prometheus.Collector = &lagCollector{}
+
+func (c *lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.ConsumerLag
+}
+
+func (c *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), lagCollectTimeout)
+	defer cancel()
+	partitions, err := c.queues.Lag(ctx)
+	if err != nil {
+		c.logger.Warn("failed to read consumer lag", zap.Error(err))
+		return
+	}
+	for _, partition := range partitions {
+		ch <- prometheus.MustNewConstMetric(metrics.ConsumerLag, prometheus.GaugeValue, float64(partition.Lag),
+			partition.Topic, strconv.Itoa(int(partition.Partition)))
+	}
+}
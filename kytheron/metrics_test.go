@@ -0,0 +1,26 @@
+package kytheron
+
+import (
+	"github.com/kytheron-org/kytheron/metrics"
+	"github.com/kytheron-org/kytheron/queue"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	parsed := &laggingQueue{lag: []queue.PartitionLag{{Topic: "parsed", Partition: 0, Lag: 300}, {Topic: "parsed", Partition: 1, Lag: 200}}}
+	lag := &lagCollector{queues: &Queues{Parsed: parsed}, logger: zap.NewNop()}
+	assert.NoError(t, metrics.Registry.Register(lag))
+	defer metrics.Registry.Unregister(lag)
+	metrics.RawLogsReceived.WithLabelValues("edge-1").Inc()
+
+	handler := NewHttpServer(nil, nil, nil, nil, nil, zap.NewNop()).Handler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `kytheron_consumer_lag{partition="1",topic="parsed"} 200`)
+	assert.Contains(t, rec.Body.String(), `kytheron_raw_logs_received_total{source="edge-1"}`)
+}
@@ -0,0 +1,121 @@
+package kytheron
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/model"
+	"regexp"
+)
+
+const (
+	// MetadataSourceName is the raw log metadata key
+	// holding the name of the source that sent it
+	MetadataSourceName = "source_name"
+
+	// AnySource matches logs from sources without their own pipeline
+	AnySource = "*"
+
+	// Parsed messages are tagged with the source and
+	// ingest topic of the raw log they were parsed from
+	SourceHeader      = "kytheron-source"
+	IngestTopicHeader = "kytheron-ingest-topic"
+)
+
+// topicSafe matches the characters not allowed in topic names
+var topicSafe = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// Pipelines maps each source to the parsers its logs are sent to,
+// and the topic its logs are published to in between
+type Pipelines struct {
+	sources  map[string][]string
+	topics   map[string]string
+	settings map[string]config.TopicSettings
+	fields   map[string]*Fields
+}
+
+func NewPipelines(pipelines []config.Pipeline) (*Pipelines, error) {
+	p := &Pipelines{
+		sources:  make(map[string][]string),
+		topics:   make(map[string]string),
+		settings: make(map[string]config.TopicSettings),
+		fields:   make(map[string]*Fields),
+	}
+	for _, pipeline := range pipelines {
+		fields, err := newFields(pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pipeline %s: %w", pipeline.Name, err)
+		}
+		p.fields[pipeline.Source] = fields
+		p.Add(pipeline.Source, pipeline.Parsers...)
+		if pipeline.Topic != "" {
+			p.topics[pipeline.Source] = pipeline.Topic
+		}
+		if pipeline.TopicSettings != (config.TopicSettings{}) {
+			p.settings[pipeline.Source] = pipeline.TopicSettings
+		}
+	}
+	return p, nil
+}
+
+// Add appends parsers to the source's pipeline
+func (p *Pipelines) Add(source string, parsers ...string) {
+	p.sources[source] = append(p.sources[source], parsers...)
+}
+
+// Topics maps each source with its own pipeline to its ingest topic,
+// which is the base topic suffixed with the source's name unless set
+func (p *Pipelines) Topics(base string) map[string]string {
+	topics := make(map[string]string)
+	for source := range p.sources {
+		if source == AnySource {
+			continue
+		}
+		if topic, ok := p.topics[source]; ok {
+			topics[source] = topic
+			continue
+		}
+		topics[source] = fmt.Sprintf("%s.%s", base, topicSafe.ReplaceAllString(source, "_"))
+	}
+	return topics
+}
+
+// TopicSettings returns the settings configured for the source's topic
+func (p *Pipelines) TopicSettings(source string) (config.TopicSettings, bool) {
+	settings, ok := p.settings[source]
+	return settings, ok
+}
+
+// AddModels adds the pipelines stored in the log_pipelines table,
+// whose parsers column holds a JSON array of parser names
+func (p *Pipelines) AddModels(rows []model.LogPipeline) error {
+	for _, row := range rows {
+		var parsers []string
+		if len(row.Parsers) > 0 {
+			if err := json.Unmarshal(row.Parsers, &parsers); err != nil {
+				return fmt.Errorf("invalid parsers for log pipeline %s: %w", row.Name, err)
+			}
+		}
+		p.Add(row.Source, parsers...)
+		if row.Topic.Valid && row.Topic.String != "" {
+			p.topics[row.Source] = row.Topic.String
+		}
+	}
+	return nil
+}
+
+// Fields returns the fields to extract from the source's parsed logs
+func (p *Pipelines) Fields(source string) *Fields {
+	if fields, ok := p.fields[source]; ok {
+		return fields
+	}
+	return p.fields[AnySource]
+}
+
+// Parsers returns the parsers to try, in order, for logs from the source
+func (p *Pipelines) Parsers(source string) []string {
+	if parsers, ok := p.sources[source]; ok {
+		return parsers
+	}
+	return p.sources[AnySource]
+}
@@ -0,0 +1,53 @@
+package kytheron
+
+import (
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/model"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPipelines(t *testing.T) {
+	pipelines, err := NewPipelines([]config.Pipeline{
+		{Name: "default", Source: AnySource, Parsers: []string{"cloudtrail"}},
+		{Name: "syslog", Source: "edge-1", Parsers: []string{"syslog"}},
+	})
+	assert.NoError(t, err)
+	err = pipelines.AddModels([]model.LogPipeline{
+		{Name: "edge", Source: "edge-1", Parsers: []byte(`["json", "logfmt"]`)},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"syslog", "json", "logfmt"}, pipelines.Parsers("edge-1"))
+	assert.Equal(t, []string{"cloudtrail"}, pipelines.Parsers("account-x"))
+	assert.Equal(t, []string{"cloudtrail"}, pipelines.Parsers(""))
+
+	err = pipelines.AddModels([]model.LogPipeline{{Name: "broken", Source: "edge-2", Parsers: []byte(`"json"`)}})
+	assert.Error(t, err)
+}
+
+func TestPipelineTopics(t *testing.T) {
+	pipelines, err := NewPipelines([]config.Pipeline{
+		{Name: "default", Source: AnySource, Parsers: []string{"cloudtrail"}},
+		{Name: "syslog", Source: "edge/1", Parsers: []string{"syslog"}},
+		{Name: "audit", Source: "audit", Topic: "audit-logs", Parsers: []string{"json"}, TopicSettings: config.TopicSettings{Partitions: 12}},
+	})
+	assert.NoError(t, err)
+	err = pipelines.AddModels([]model.LogPipeline{
+		{Name: "edge", Source: "edge-2", Parsers: []byte(`["json"]`), Topic: pgtype.Text{String: "edge-logs", Valid: true}},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		"edge/1": "ingest.edge_1",
+		"audit":  "audit-logs",
+		"edge-2": "edge-logs",
+	}, pipelines.Topics("ingest"))
+
+	settings, ok := pipelines.TopicSettings("audit")
+	assert.True(t, ok)
+	assert.Equal(t, 12, settings.Partitions)
+	_, ok = pipelines.TopicSettings("edge/1")
+	assert.False(t, ok)
+}
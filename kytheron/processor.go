@@ -1,76 +1,217 @@
 package kytheron
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/google/uuid"
 	pb "github.com/kytheron-org/kytheron-plugin-go/plugin"
 	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/eval"
+	"github.com/kytheron-org/kytheron/metrics"
+	"github.com/kytheron-org/kytheron/queue"
 	"github.com/kytheron-org/kytheron/registry"
+	"github.com/kytheron-org/kytheron/sink"
+	"github.com/kytheron-org/kytheron/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"io"
-	"net/http"
-	"strconv"
+	"sync"
 	"time"
 )
 
 var (
-	ParsedTopic = "parsed"
-	IngestTopic = "ingest"
+	// ErrNoParser is returned for raw logs from a source without a pipeline
+	ErrNoParser = errors.New("no parser configured for source")
+	// ErrParseFailed is returned when every parser of a pipeline fails
+	ErrParseFailed = errors.New("no parser could parse log")
 )
 
 // Processor is going to handle a few things in one place, for now
 // - listen to ingest, pass messages to parser
 // - take parser response and emit to parsed topic
 // - take message from parsed topic
-//   - emit to loki for long term storage
+//   - store in the configured sinks for long term storage
 //   - run policy evaluation on the log message
 
 type Processor struct {
-	config         *config.Config
-	registry       *registry.PluginRegistry
-	logger         *zap.Logger
-	parsedProducer *kafka.Producer
-
-	taskChan chan *pb.ParsedLog
+	config     *config.Config
+	registry   *registry.PluginRegistry
+	engine     *eval.Engine
+	pipelines  *Pipelines
+	dispatcher *eval.Dispatcher
+	queues     *Queues
+	hits       *Hits
+	logger     *zap.Logger
+
+	// sink stores parsed logs, reporting the result to the evaluator
+	// through stored. evaluations counts the logs yet to be evaluated
+	sink        sink.Sink
+	stored      chan storedLog
+	evaluations sync.WaitGroup
+
+	// Consumers stop reading new messages once stopping is cancelled,
+	// while messages being handled run with the work context, which is
+	// only cancelled when shutdown runs out of time
+	stopping context.Context
+	stop     context.CancelFunc
+	work     context.Context
+	abort    context.CancelFunc
+	done     chan struct{}
+
+	// failures records the consumers that stopped before shutdown
+	mu       sync.Mutex
+	failures []error
 }
 
-func NewProcessor(cfg *config.Config, reg *registry.PluginRegistry, logger *zap.Logger) *Processor {
-	return &Processor{
-		logger:   logger,
-		config:   cfg,
-		registry: reg,
-		taskChan: make(chan *pb.ParsedLog),
+// NewProcessor creates a processor storing parsed logs in the given
+// sink, which may be nil to only evaluate them
+func NewProcessor(cfg *config.Config, reg *registry.PluginRegistry, engine *eval.Engine, pipelines *Pipelines, queues *Queues, store sink.Sink, logger *zap.Logger) *Processor {
+	p := &Processor{
+		logger:     logger,
+		config:     cfg,
+		registry:   reg,
+		engine:     engine,
+		pipelines:  pipelines,
+		queues:     queues,
+		dispatcher: eval.NewDispatcher(reg, cfg.Outputs, logger),
+		hits:       NewHits(defaultRecentHits),
+		sink:       store,
+		stored:     make(chan storedLog),
+		done:       make(chan struct{}),
 	}
+	p.stopping, p.stop = context.WithCancel(context.Background())
+	p.work, p.abort = context.WithCancel(context.Background())
+	return p
 }
 
-func (p *Processor) handleParsedMessage(msg *kafka.Message) error {
+// handleParsedMessage stores a parsed log, handing it to the evaluator once
+// stored. Storing is asynchronous, so the consumer is only held back once the
+// log store's buffer is full. Logs are stored before being evaluated, so a
+// log is only acknowledged once stored, and a failed store doesn't dispatch hits twice
+func (p *Processor) handleParsedMessage(ctx context.Context, msg *queue.Message) {
+	// Messages read while stopping are left unacknowledged, to be
+	// read again, while those already stored finish evaluating
+	if p.stopping.Err() != nil {
+		<-ctx.Done()
+		return
+	}
+
 	var parsedLog pb.ParsedLog
 	if err := json.Unmarshal(msg.Value, &parsedLog); err != nil {
-		return err
+		p.evaluations.Add(1)
+		p.stored <- storedLog{msg: msg, err: err}
+		return
 	}
 
 	p.logger.Debug(string(parsedLog.Data), zap.String("type", "parsed_queue"))
-
 	p.logger.Debug("parsed message decoded", zap.String("log_id", parsedLog.SourceId), zap.String("parsed_log_id", parsedLog.Id))
-	// Put the log on the task channel, so that the log sink can handle it
-	p.taskChan <- &parsedLog
 
-	p.logger.Debug("submitting for evaluation", zap.String("log_id", parsedLog.SourceId), zap.String("parsed_log_id", parsedLog.Id))
+	p.evaluations.Add(1)
+	if p.sink == nil {
+		p.stored <- storedLog{msg: msg, log: &parsedLog}
+		return
+	}
 
-	return nil
+	_, span := tracing.Tracer().Start(tracing.Extract(ctx, msg.Headers), "store",
+		trace.WithAttributes(tracing.ParsedLogIdKey.String(parsedLog.Id)),
+	)
+
+	// Logs are stored at the time of the event they record where it's known
+	fields := p.pipelines.Fields(parsedLog.SourceName).Extract(parsedLog.Data, time.Now().UTC(), p.logger)
+	entry := sink.Entry{
+		Id:         parsedLog.Id,
+		SourceId:   parsedLog.SourceId,
+		SourceType: parsedLog.SourceType,
+		SourceName: parsedLog.SourceName,
+		Timestamp:  fields.Timestamp,
+		Data:       parsedLog.Data,
+		Labels:     fields.Labels,
+		Metadata:   fields.Metadata,
+	}
+	err := p.sink.Push(p.work, entry, func(err error) {
+		if err != nil {
+			err = fmt.Errorf("failed to store parsed log: %w", err)
+		}
+		tracing.End(span, err)
+		p.stored <- storedLog{msg: msg, log: &parsedLog, err: err}
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to store parsed log: %w", err)
+		tracing.End(span, err)
+		p.stored <- storedLog{msg: msg, err: err}
+	}
 }
 
-func (p *Processor) handleIngestMessage(msg *kafka.Message) error {
-	p.logger.Info("message on ingest", zap.String("partition", msg.TopicPartition.String()))
-	client, err := p.registry.Parser("cloudtrail")
+// storedLog is the result of storing a parsed log
+type storedLog struct {
+	msg *queue.Message
+	log *pb.ParsedLog
+	err error
+}
+
+// evaluator evaluates parsed logs as they're stored, in the order they
+// were read, until the stored channel is closed. Logs that couldn't be
+// stored are dead lettered, and nacked if that fails too
+func (p *Processor) evaluator(messages chan<- string) {
+	for stored := range p.stored {
+		var err error
+		if stored.err != nil {
+			p.logger.Warn("failed to store message", zap.String("partition", stored.msg.String()), zap.Error(stored.err))
+			err = p.deadLetter(p.work, StageParsed, stored.msg, messageAttempts(stored.msg)+1, stored.err)
+		} else {
+			err = p.handle(p.work, StageParsed, stored.msg, func(ctx context.Context, msg *queue.Message) error {
+				return p.evaluate(ctx, stored.log)
+			})
+		}
+		p.settle(p.queues.Parsed, stored.msg, err)
+		p.evaluations.Done()
+	}
+	messages <- fmt.Sprintf("evaluator stopped")
+}
+
+// evaluate runs policy evaluation on a parsed log, dispatching its hits
+func (p *Processor) evaluate(ctx context.Context, parsedLog *pb.ParsedLog) (err error) {
+	p.logger.Debug("submitting for evaluation", zap.String("log_id", parsedLog.SourceId), zap.String("parsed_log_id", parsedLog.Id))
+	ctx, span := tracing.Tracer().Start(ctx, "evaluate",
+		trace.WithAttributes(tracing.LogIdKey.String(parsedLog.SourceId), tracing.ParsedLogIdKey.String(parsedLog.Id)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	metrics.Evaluations.Inc()
+	hits, err := p.engine.Evaluate(parsedLog)
 	if err != nil {
+		metrics.EvaluationFailures.Inc()
 		return err
 	}
-	// Parse the log
+	span.SetAttributes(tracing.HitsKey.Int(len(hits)))
+
+	for _, hit := range hits {
+		evaluation := fmt.Sprintf("%s.%s", hit.Evaluation.Type, hit.Evaluation.Name)
+		metrics.Hits.WithLabelValues(hit.Policy.Name, evaluation).Inc()
+		p.hits.Record(hit, time.Now().UTC())
+		p.logger.Info("policy hit",
+			zap.String("policy", hit.Policy.Name),
+			zap.String("evaluation", evaluation),
+			zap.String("parsed_log_id", parsedLog.Id),
+		)
+
+		if err := p.dispatcher.Dispatch(ctx, hit); err != nil {
+			p.logger.Error("failed to dispatch policy hit", zap.String("policy", hit.Policy.Name), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// Hits returns the most recent policy hits
+func (p *Processor) Hits() *Hits {
+	return p.hits
+}
+
+func (p *Processor) handleIngestMessage(ctx context.Context, msg *queue.Message) error {
+	p.logger.Info("message on ingest", zap.String("partition", msg.String()))
 	var log pb.RawLog
 	if err := json.Unmarshal(msg.Value, &log); err != nil {
 		return err
@@ -80,198 +221,244 @@ func (p *Processor) handleIngestMessage(msg *kafka.Message) error {
 
 	p.logger.Debug("ingest message decoded", zap.String("log_id", log.Id))
 
-	stream, err := client.ParseLog(context.TODO(), &log)
-	if err != nil {
-		return err
+	// Try each parser of the source's pipeline, in order
+	source := log.Metadata[MetadataSourceName]
+	trace.SpanFromContext(ctx).SetAttributes(tracing.LogIdKey.String(log.Id), tracing.SourceKey.String(source))
+	parsers := p.pipelines.Parsers(source)
+	if len(parsers) == 0 {
+		return fmt.Errorf("%w: %q", ErrNoParser, source)
 	}
 
-	for {
-		parsedLog, err := stream.Recv()
-		if err == io.EOF {
-			stream.CloseSend()
-			break
-		}
-		parsedLog.SourceId = log.Id
-		parsedLog.Id = uuid.Must(uuid.NewUUID()).String()
-
-		p.logger.Debug("parsed log received", zap.String("parsed_log_id", parsedLog.Id), zap.String("log_id", parsedLog.SourceId))
-
+	var parsedLogs []*pb.ParsedLog
+	var errs []error
+	for _, name := range parsers {
+		parsed, err := p.parse(ctx, name, &log)
 		if err != nil {
-			return err
+			p.logger.Debug("parser failed", zap.String("parser", name), zap.String("log_id", log.Id), zap.Error(err))
+			errs = append(errs, &PluginError{Plugin: name, Err: err})
+			continue
 		}
+		parsedLogs = parsed
+		errs = nil
+		break
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrParseFailed, errors.Join(errs...))
+	}
 
+	messages := make([]*queue.Message, 0, len(parsedLogs))
+	for _, parsedLog := range parsedLogs {
+		// Parsers don't know which source sent the log,
+		// so it's taken from the identity of the stream
+		parsedLog.SourceName = source
 		content, err := json.Marshal(parsedLog)
 		if err != nil {
 			return err
 		}
 
-		p.logger.Debug("producing message to parsed topic", zap.String("parsed_log_id", parsedLog.Id))
-		if err := p.parsedProducer.Produce(&kafka.Message{
-			TopicPartition: kafka.TopicPartition{Topic: &ParsedTopic, Partition: kafka.PartitionAny},
-			Value:          content,
-		}, nil); err != nil {
-			return err
+		headers := map[string]string{
+			SourceHeader:      source,
+			IngestTopicHeader: msg.Topic,
 		}
-		p.logger.Debug("produced message to parsed topic", zap.String("parsed_log_id", parsedLog.Id))
+		tracing.Inject(ctx, headers)
+		messages = append(messages, &queue.Message{
+			Topic:   p.queues.Topics.Parsed,
+			Value:   content,
+			Headers: headers,
+		})
 	}
-	return nil
-}
-
-func (p *Processor) logSink(messages chan<- string) {
-
-	for {
-		select {
-		case task := <-p.taskChan:
-			// TODO: Support batching these logs to Loki
-			p.logger.Debug(string(task.Data), zap.String("type", "task_channel"))
-
-			timeInNano := time.Now().UTC().UnixNano()
-			payload := map[string]interface{}{
-				"streams": []map[string]interface{}{
-					{
-						"stream": map[string]interface{}{
-							"source_type": task.SourceType,
-							"source_name": task.SourceName,
-						},
-						"values": [][]interface{}{
-							{strconv.FormatInt(timeInNano, 10), task.Data, map[string]interface{}{
-								"log_id": task.SourceId,
-							}},
-						},
-					},
-				},
-			}
-
-			payloadJson, err := json.Marshal(payload)
-			if err != nil {
-				p.logger.Error("failed to marshal payload", zap.Error(err))
-				continue
-			}
-
-			p.logger.Debug(string(payloadJson))
-
-			resp, err := http.Post(fmt.Sprintf("%s/api/v1/push", p.config.Loki.Url), "application/json", bytes.NewReader(payloadJson))
-			if err != nil {
-				p.logger.Error("failed to send payload", zap.Error(err))
-				continue
-			}
 
-			p.logger.Debug("successfully sent payload to Loki", zap.String("response", resp.Status))
-		}
+	// The log's records are delivered together, rather than one round trip at a time
+	p.logger.Debug("producing messages to parsed topic", zap.String("log_id", log.Id), zap.Int("count", len(messages)))
+	if err := queue.PublishAll(ctx, p.queues.Parsed, messages); err != nil {
+		return err
 	}
-	messages <- fmt.Sprintf("log sink closed")
+	p.logger.Debug("produced messages to parsed topic", zap.String("log_id", log.Id), zap.Int("count", len(messages)))
+	return nil
 }
 
-func (p *Processor) runSourceConsumer(messages chan<- string) {
-	p.logger.Info("starting source consumer")
-	c, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":  p.config.Kafka.Source.Url,
-		"group.id":           "kytheron",
-		"auto.offset.reset":  "earliest",
-		"enable.auto.commit": "true",
-	})
+// parse sends the raw log to the named parser plugin, collecting every
+// parsed record. Records are only returned once the stream completes, so
+// a parser failing part way through doesn't emit partial results
+func (p *Processor) parse(ctx context.Context, name string, log *pb.RawLog) (parsedLogs []*pb.ParsedLog, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "parse", trace.WithAttributes(tracing.ParserKey.String(name)))
+	start := time.Now()
+	defer func() {
+		metrics.ParseDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.ParseFailures.WithLabelValues(name).Inc()
+		} else {
+			metrics.ParsedLogs.WithLabelValues(name).Add(float64(len(parsedLogs)))
+		}
+		tracing.End(span, err)
+	}()
 
+	client, err := p.registry.Parser(name)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	err = c.SubscribeTopics([]string{"ingest"}, nil)
-
+	stream, err := client.ParseLog(ctx, log)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	produce, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": p.config.Kafka.Parser.Url})
-	if err != nil {
-		panic(err)
-	}
-	defer produce.Close()
-	p.parsedProducer = produce
-
-	run := true
-
-	for run {
-		msg, err := c.ReadMessage(time.Second)
-		if err != nil && !err.(kafka.Error).IsTimeout() {
-			// The client will automatically try to recover from all errors.
-			// Timeout is not considered an error because it is raised by
-			// ReadMessage in absence of messages.
-			p.logger.Warn("failed to read message", zap.Error(err), zap.String("topic", msg.TopicPartition.String()))
-			continue
+	for {
+		parsedLog, err := stream.Recv()
+		if err == io.EOF {
+			stream.CloseSend()
+			break
 		}
-
-		if msg == nil {
-			continue
+		if err != nil {
+			return nil, err
 		}
-
-		if err := p.handleIngestMessage(msg); err != nil {
-			p.logger.Warn("failed to handle ingest message", zap.Error(err))
+		if parsedLog.Error != "" {
+			return nil, errors.New(parsedLog.Error)
 		}
 
-	}
+		parsedLog.SourceId = log.Id
+		parsedLog.Id = uuid.Must(uuid.NewUUID()).String()
 
-	c.Close()
-	messages <- fmt.Sprintf("sourceConsumer stopped")
+		p.logger.Debug("parsed log received", zap.String("parsed_log_id", parsedLog.Id), zap.String("log_id", parsedLog.SourceId), zap.String("parser", name))
+		parsedLogs = append(parsedLogs, parsedLog)
+	}
+	return parsedLogs, nil
 }
 
-func (p *Processor) runParserConsumer(messages chan<- string) {
-	p.logger.Info("starting parser consumer")
-	c, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": p.config.Kafka.Parser.Url,
-		"group.id":          "kytheron",
-		"auto.offset.reset": "latest",
-	})
+// consume wraps a stage's handler, acknowledging messages once they're
+// handled or dead lettered. Messages that could be neither are nacked,
+// so they're delivered again rather than lost. Handlers run with the
+// work context, so a message being handled is finished on shutdown
+func (p *Processor) consume(q queue.Queue, stage string, handler queue.Handler) queue.Handler {
+	return func(_ context.Context, msg *queue.Message) error {
+		p.settle(q, msg, p.handle(p.work, stage, msg, handler))
+		return nil
+	}
+}
 
+// settle acknowledges a handled message, or nacks it if
+// it could neither be handled nor dead lettered
+func (p *Processor) settle(q queue.Queue, msg *queue.Message, err error) {
 	if err != nil {
-		panic(err)
+		if err := q.Nack(msg); err != nil {
+			p.logger.Error("failed to nack message", zap.String("partition", msg.String()), zap.Error(err))
+		}
+		return
+	}
+	if err := q.Ack(msg); err != nil {
+		p.logger.Error("failed to ack message", zap.String("partition", msg.String()), zap.Error(err))
 	}
+}
 
-	err = c.SubscribeTopics([]string{"parsed"}, nil)
+func (p *Processor) runSourceConsumer(ctx context.Context, messages chan<- string) {
+	p.logger.Info("starting source consumer")
 
+	err := p.queues.Ingest.Subscribe(ctx, p.queues.Topics.IngestTopics(), p.consume(p.queues.Ingest, StageIngest, p.handleIngestMessage))
 	if err != nil {
-		panic(err)
+		p.logger.Error("source consumer failed", zap.Error(err))
 	}
+	p.stopped("source consumer", err)
 
-	run := true
+	messages <- fmt.Sprintf("sourceConsumer stopped")
+}
 
-	for run {
-		msg, err := c.ReadMessage(time.Second)
-		if err != nil && !err.(kafka.Error).IsTimeout() {
-			p.logger.Warn("failed to read message", zap.Error(err), zap.String("topic", msg.TopicPartition.String()))
-		}
+// runParserConsumer reads parsed logs until the processor is stopping.
+// The subscription is kept open until the logs already read have been
+// stored and evaluated, so they can still be acknowledged
+func (p *Processor) runParserConsumer(messages chan<- string) {
+	p.logger.Info("starting parser consumer")
 
-		if msg == nil {
-			continue
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-p.stopping.Done()
+		if p.sink != nil {
+			if err := p.sink.Flush(p.work); err != nil {
+				p.logger.Error("failed to flush parsed logs", zap.Error(err))
+			}
 		}
-
-		if err := p.handleParsedMessage(msg); err != nil {
-			p.logger.Warn("failed to handle ingest message", zap.Error(err))
+		evaluated := make(chan struct{})
+		go func() {
+			p.evaluations.Wait()
+			close(evaluated)
+		}()
+		select {
+		case <-evaluated:
+		case <-p.work.Done():
 		}
-		//if err == nil {
-		//	p.logger.Debug("message received", zap.String("topic", msg.TopicPartition.String()))
-		//} else if !err.(kafka.Error).IsTimeout() {
-		//	// The client will automatically try to recover from all errors.
-		//	// Timeout is not considered an error because it is raised by
-		//	// ReadMessage in absence of messages.
-		//	p.logger.Warn("parseConsumerError", zap.Error(err))
-		//}
+		cancel()
+	}()
+
+	err := p.queues.Parsed.Subscribe(ctx, []string{p.queues.Topics.Parsed}, func(ctx context.Context, msg *queue.Message) error {
+		p.handleParsedMessage(ctx, msg)
+		return nil
+	})
+	if err != nil {
+		p.logger.Error("parser consumer failed", zap.Error(err))
 	}
+	p.stopped("parser consumer", err)
 
-	c.Close()
 	messages <- fmt.Sprintf("parserConsumer stopped")
 }
 
+// stopped records a consumer that stopped before the processor was
+// shut down, which leaves its stage without anything consuming it
+func (p *Processor) stopped(consumer string, err error) {
+	if p.stopping.Err() != nil {
+		return
+	}
+	if err == nil {
+		err = errors.New("stopped unexpectedly")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures = append(p.failures, fmt.Errorf("%s: %w", consumer, err))
+}
+
+// Check fails once a consumer has stopped, which only a restart recovers from
+func (p *Processor) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return errors.Join(p.failures...)
+}
+
+// Run consumes the pipeline's topics until Shutdown is called
 func (p *Processor) Run() error {
-	processors := make(chan string, 3)
+	defer close(p.done)
+	consumers := make(chan string, 2)
+	evaluator := make(chan string, 1)
 
-	go p.runSourceConsumer(processors)
-	go p.runParserConsumer(processors)
-	go p.logSink(processors)
+	go p.runSourceConsumer(p.stopping, consumers)
+	go p.runParserConsumer(consumers)
+	go p.evaluator(evaluator)
 
-	for i := 1; i <= 3; i++ {
-		msg := <-processors
+	for i := 1; i <= 2; i++ {
+		msg := <-consumers
 		p.logger.Info("processor finished", zap.String("topic", msg))
 	}
 
+	// Nothing is left to store once the consumers have stopped, so
+	// send what the sink holds and let the evaluator drain the results
+	if p.sink != nil {
+		if err := p.sink.Close(p.work); err != nil {
+			p.logger.Error("failed to close log sink", zap.Error(err))
+		}
+	}
+	close(p.stored)
+	p.logger.Info("processor finished", zap.String("topic", <-evaluator))
 	return nil
 }
+
+// Shutdown stops the consumers, and waits for the messages they're handling
+// to finish and the log sink to drain. If the context expires first,
+// in-flight work is cancelled and the context's error is returned
+func (p *Processor) Shutdown(ctx context.Context) error {
+	p.stop()
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		p.abort()
+		<-p.done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,179 @@
+package kytheron
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	pb "github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/eval"
+	"github.com/kytheron-org/kytheron/loki"
+	"github.com/kytheron-org/kytheron/queue"
+	"github.com/kytheron-org/kytheron/sink"
+	"github.com/kytheron-org/kytheron/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lokiEntries counts the entries of gzipped JSON pushes
+func lokiEntries(t *testing.T, entries *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		var push struct {
+			Streams []struct {
+				Values [][]any `json:"values"`
+			} `json:"streams"`
+		}
+		assert.NoError(t, json.NewDecoder(body).Decode(&push))
+		for _, stream := range push.Streams {
+			entries.Add(int32(len(stream.Values)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestProcessorShutdown(t *testing.T) {
+	var pushed atomic.Int32
+	server := httptest.NewServer(lokiEntries(t, &pushed))
+	defer server.Close()
+
+	engine, err := eval.NewEngine(nil)
+	assert.NoError(t, err)
+	pipelines, err := NewPipelines(nil)
+	assert.NoError(t, err)
+	inline := queue.NewChannel(8)
+	// Logs are held for longer than the test, so they're only sent by shutdown
+	cfg := &config.Config{}
+	store := sink.NewLoki(config.Loki{Url: server.URL, Encoding: loki.EncodingJson, BatchWait: time.Minute}, zap.NewNop())
+	processor := NewProcessor(cfg, nil, engine, pipelines, &Queues{Topics: NewTopics(cfg), Ingest: inline, Parsed: inline}, store, zap.NewNop())
+
+	content, err := json.Marshal(&pb.ParsedLog{Id: "parsed-1", Data: `{}`})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, inline.Publish(context.Background(), &queue.Message{Topic: DefaultParsedTopic, Value: content}))
+	}
+
+	finished := make(chan error, 1)
+	go func() { finished <- processor.Run() }()
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, pushed.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, processor.Shutdown(ctx))
+	assert.NoError(t, <-finished)
+	assert.Equal(t, int32(3), pushed.Load())
+}
+
+func TestProcessorStoreFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	engine, err := eval.NewEngine(nil)
+	assert.NoError(t, err)
+	pipelines, err := NewPipelines(nil)
+	assert.NoError(t, err)
+	inline := queue.NewChannel(8)
+	deadLetters := queue.NewChannel(8)
+	cfg := &config.Config{Kafka: config.KafkaMap{DeadLetter: config.DeadLetter{Topic: "dead-letter"}}}
+	store := sink.NewLoki(config.Loki{Url: server.URL, BatchWait: time.Millisecond, MinBackoff: time.Millisecond}, zap.NewNop())
+	processor := NewProcessor(cfg, nil, engine, pipelines, &Queues{Topics: NewTopics(cfg), Ingest: inline, Parsed: inline, DeadLetter: deadLetters}, store, zap.NewNop())
+
+	content, err := json.Marshal(&pb.ParsedLog{Id: "parsed-1", Data: `{}`})
+	assert.NoError(t, err)
+	assert.NoError(t, inline.Publish(context.Background(), &queue.Message{Topic: DefaultParsedTopic, Value: content}))
+
+	finished := make(chan error, 1)
+	go func() { finished <- processor.Run() }()
+
+	// Logs that couldn't be stored are dead lettered rather than evaluated
+	records := make(chan DeadLetter, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go deadLetters.Subscribe(ctx, []string{"dead-letter"}, func(ctx context.Context, msg *queue.Message) error {
+		var record DeadLetter
+		assert.NoError(t, json.Unmarshal(msg.Value, &record))
+		records <- record
+		return nil
+	})
+
+	select {
+	case record := <-records:
+		assert.Equal(t, StageParsed, record.Stage)
+		assert.Contains(t, record.Error, "503")
+	case <-ctx.Done():
+		t.Fatal("log was not dead lettered")
+	}
+
+	assert.NoError(t, processor.Shutdown(ctx))
+	assert.NoError(t, <-finished)
+}
+
+// recordSpans exports the spans started during a test to memory
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return exporter
+}
+
+// spanNamed finds an ended span by name
+func spanNamed(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func TestProcessorTraced(t *testing.T) {
+	spans := recordSpans(t)
+	engine, err := eval.NewEngine(nil)
+	assert.NoError(t, err)
+	pipelines, err := NewPipelines(nil)
+	assert.NoError(t, err)
+	inline := queue.NewChannel(8)
+	cfg := &config.Config{}
+	processor := NewProcessor(cfg, nil, engine, pipelines, &Queues{Topics: NewTopics(cfg), Ingest: inline, Parsed: inline}, nil, zap.NewNop())
+
+	// The parsed log continues the trace of the raw log it was parsed from
+	ctx, parent := tracing.Tracer().Start(context.Background(), "process ingest")
+	headers := map[string]string{}
+	tracing.Inject(ctx, headers)
+	parent.End()
+	content, err := json.Marshal(&pb.ParsedLog{Id: "parsed-1", SourceId: "raw-1", Data: `{}`})
+	assert.NoError(t, err)
+	assert.NoError(t, inline.Publish(context.Background(), &queue.Message{Topic: DefaultParsedTopic, Value: content, Headers: headers}))
+
+	finished := make(chan error, 1)
+	go func() { finished <- processor.Run() }()
+	assert.Eventually(t, func() bool {
+		return spanNamed(spans.GetSpans(), "evaluate") != nil
+	}, time.Second, 10*time.Millisecond)
+
+	ended := spans.GetSpans()
+	handled, evaluated := spanNamed(ended, "process parsed"), spanNamed(ended, "evaluate")
+	assert.NotNil(t, handled)
+	assert.Equal(t, parent.SpanContext().TraceID(), handled.SpanContext.TraceID())
+	assert.Equal(t, parent.SpanContext().SpanID(), handled.Parent.SpanID())
+	assert.Equal(t, handled.SpanContext.SpanID(), evaluated.Parent.SpanID())
+	assert.Contains(t, evaluated.Attributes, tracing.ParsedLogIdKey.String("parsed-1"))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, processor.Shutdown(shutdownCtx))
+	assert.NoError(t, <-finished)
+}
@@ -0,0 +1,310 @@
+package kytheron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/queue"
+	"go.uber.org/zap"
+	"sort"
+)
+
+const (
+	defaultInlineQueueSize = 1024
+
+	DefaultIngestTopic   = "ingest"
+	DefaultParsedTopic   = "parsed"
+	DefaultConsumerGroup = "kytheron"
+)
+
+// Topics names the topics carrying messages between the stages
+type Topics struct {
+	// Ingest receives raw logs from sources without their own topic
+	Ingest string
+	// Sources maps sources with their own pipeline to their ingest topic
+	Sources map[string]string
+	Parsed  string
+	// DeadLetter is empty when no dead-letter topic is configured
+	DeadLetter string
+}
+
+// AddSources gives each source with its own pipeline its own ingest topic
+func (t *Topics) AddSources(pipelines *Pipelines) {
+	t.Sources = pipelines.Topics(t.Ingest)
+}
+
+// Source returns the ingest topic for raw logs from a source
+func (t Topics) Source(name string) string {
+	if topic, ok := t.Sources[name]; ok {
+		return topic
+	}
+	return t.Ingest
+}
+
+// IngestTopics returns every topic raw logs are published to
+func (t Topics) IngestTopics() []string {
+	topics := []string{t.Ingest}
+	seen := map[string]bool{t.Ingest: true}
+	for _, topic := range t.Sources {
+		if !seen[topic] {
+			topics = append(topics, topic)
+			seen[topic] = true
+		}
+	}
+	sort.Strings(topics[1:])
+	return topics
+}
+
+// NewTopics names the topics, defaulting those not configured
+func NewTopics(cfg *config.Config) Topics {
+	return Topics{
+		Ingest:     orDefault(cfg.Kafka.Source.Topic, DefaultIngestTopic),
+		Parsed:     orDefault(cfg.Kafka.Parser.Topic, DefaultParsedTopic),
+		DeadLetter: cfg.Kafka.DeadLetter.Topic,
+	}
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Queues carry messages between the stages of the pipeline
+type Queues struct {
+	Topics Topics
+	Ingest queue.Queue
+	Parsed queue.Queue
+	// DeadLetter is nil when no dead-letter topic is configured
+	DeadLetter queue.Queue
+}
+
+// NewQueues creates the queues for the configured driver. Consumers join
+// the given group, or the groups configured for their role when it's empty
+func NewQueues(cfg *config.Config, group string, logger *zap.Logger) (*Queues, error) {
+	commit := queue.CommitOptions{
+		Messages: cfg.Queue.Commit.Messages,
+		Interval: cfg.Queue.Commit.Interval,
+	}
+	topics := NewTopics(cfg)
+
+	switch cfg.Queue.Driver {
+	case config.QueueDriverInline:
+		size := cfg.Queue.Size
+		if size <= 0 {
+			size = defaultInlineQueueSize
+		}
+		// Stages share one set of channels. There's nothing to replay dead
+		// letters from, so messages that can't be handled are logged and dropped
+		inline := queue.NewChannel(size)
+		topics.DeadLetter = ""
+		return &Queues{Topics: topics, Ingest: inline, Parsed: inline}, nil
+	case config.QueueDriverFile:
+		file, err := queue.NewFile(queue.FileOptions{
+			Dir:          cfg.Queue.Dir,
+			GroupId:      orDefault(group, DefaultConsumerGroup),
+			SegmentBytes: cfg.Queue.SegmentBytes,
+			Sync:         cfg.Queue.Sync,
+			Commit:       commit,
+		}, logger)
+		if err != nil {
+			return nil, err
+		}
+		q := &Queues{Topics: topics, Ingest: file, Parsed: file}
+		if topics.DeadLetter != "" {
+			q.DeadLetter = file
+		}
+		return q, nil
+	case config.QueueDriverKafka, "":
+		q := &Queues{Topics: topics}
+		ingest, err := queue.NewKafka(queue.KafkaOptions{
+			Url:         cfg.Kafka.Source.Url,
+			GroupId:     orDefault(group, orDefault(cfg.Kafka.Source.GroupId, DefaultConsumerGroup)),
+			OffsetReset: "earliest",
+			Commit:      commit,
+			Producer:    kafkaProperties(cfg.Kafka.Source.KafkaClient, cfg.Kafka.Source.Producer),
+			Consumer:    kafkaProperties(cfg.Kafka.Source.KafkaClient, cfg.Kafka.Source.Consumer),
+		}, logger)
+		if err != nil {
+			return nil, err
+		}
+		q.Ingest = ingest
+
+		// New consumer groups start from the earliest parsed log, so logs
+		// parsed before the group was first assigned are still stored
+		parsed, err := queue.NewKafka(queue.KafkaOptions{
+			Url:         cfg.Kafka.Parser.Url,
+			GroupId:     orDefault(group, orDefault(cfg.Kafka.Parser.GroupId, DefaultConsumerGroup)),
+			OffsetReset: "earliest",
+			Commit:      commit,
+			Producer:    kafkaProperties(cfg.Kafka.Parser.KafkaClient, cfg.Kafka.Parser.Producer),
+			Consumer:    kafkaProperties(cfg.Kafka.Parser.KafkaClient, cfg.Kafka.Parser.Consumer),
+		}, logger)
+		if err != nil {
+			q.Close()
+			return nil, err
+		}
+		q.Parsed = parsed
+
+		if topics.DeadLetter != "" {
+			deadLetter, err := queue.NewKafka(queue.KafkaOptions{
+				Url:         cfg.Kafka.DeadLetter.Url,
+				GroupId:     orDefault(group, DefaultConsumerGroup),
+				OffsetReset: "earliest",
+				Commit:      commit,
+				Producer:    kafkaProperties(cfg.Kafka.DeadLetter.KafkaClient, cfg.Kafka.DeadLetter.Producer),
+				Consumer:    kafkaProperties(cfg.Kafka.DeadLetter.KafkaClient, cfg.Kafka.DeadLetter.Consumer),
+			}, logger)
+			if err != nil {
+				q.Close()
+				return nil, err
+			}
+			q.DeadLetter = deadLetter
+		}
+		return q, nil
+	default:
+		return nil, fmt.Errorf("unsupported queue driver: %s", cfg.Queue.Driver)
+	}
+}
+
+// kafkaProperties translates a role's connection settings to librdkafka
+// properties, with the properties configured for the client applied over them
+func kafkaProperties(client config.KafkaClient, properties map[string]string) map[string]string {
+	result := map[string]string{}
+
+	switch {
+	case client.Sasl.Mechanism != "" && client.Tls.Enabled:
+		result["security.protocol"] = "sasl_ssl"
+	case client.Sasl.Mechanism != "":
+		result["security.protocol"] = "sasl_plaintext"
+	case client.Tls.Enabled:
+		result["security.protocol"] = "ssl"
+	}
+
+	if client.Sasl.Mechanism != "" {
+		result["sasl.mechanisms"] = client.Sasl.Mechanism
+		result["sasl.username"] = client.Sasl.Username
+		result["sasl.password"] = client.Sasl.Password
+	}
+
+	if client.Tls.Enabled {
+		if client.Tls.CaFile != "" {
+			result["ssl.ca.location"] = client.Tls.CaFile
+		}
+		if client.Tls.CertFile != "" {
+			result["ssl.certificate.location"] = client.Tls.CertFile
+		}
+		if client.Tls.KeyFile != "" {
+			result["ssl.key.location"] = client.Tls.KeyFile
+		}
+		if client.Tls.InsecureSkipVerify {
+			result["enable.ssl.certificate.verification"] = "false"
+		}
+	}
+
+	for key, value := range properties {
+		result[key] = value
+	}
+	return result
+}
+
+// Provision creates the stages' topics on queues that need them
+// created up front, when provisioning is enabled. Source topics
+// use their pipeline's settings, or those of the ingest topic
+func (q *Queues) Provision(ctx context.Context, cfg *config.Config, pipelines *Pipelines) error {
+	if !cfg.Kafka.Provision {
+		return nil
+	}
+
+	type stage struct {
+		queue    queue.Queue
+		topic    string
+		settings config.TopicSettings
+	}
+	stages := []stage{
+		{q.Ingest, q.Topics.Ingest, cfg.Kafka.Source.TopicSettings},
+		{q.Parsed, q.Topics.Parsed, cfg.Kafka.Parser.TopicSettings},
+		{q.DeadLetter, q.Topics.DeadLetter, cfg.Kafka.DeadLetter.TopicSettings},
+	}
+	for source, topic := range q.Topics.Sources {
+		settings, ok := pipelines.TopicSettings(source)
+		if !ok {
+			settings = cfg.Kafka.Source.TopicSettings
+		}
+		stages = append(stages, stage{q.Ingest, topic, settings})
+	}
+	for _, stage := range stages {
+		provisioner, ok := stage.queue.(queue.Provisioner)
+		if !ok {
+			continue
+		}
+		if err := provisioner.Provision(ctx, []queue.TopicSpec{{
+			Name:              stage.topic,
+			Partitions:        stage.settings.Partitions,
+			ReplicationFactor: stage.settings.ReplicationFactor,
+			Retention:         stage.settings.Retention,
+		}}); err != nil {
+			return fmt.Errorf("failed to provision topic %s: %w", stage.topic, err)
+		}
+	}
+	return nil
+}
+
+// distinct returns each queue once, as inline and file stages share a queue
+func (q *Queues) distinct() []queue.Queue {
+	seen := map[queue.Queue]bool{}
+	var queues []queue.Queue
+	for _, qu := range []queue.Queue{q.Ingest, q.Parsed, q.DeadLetter} {
+		if qu != nil && !seen[qu] {
+			queues = append(queues, qu)
+			seen[qu] = true
+		}
+	}
+	return queues
+}
+
+// Flush waits for messages published to each queue to be delivered
+func (q *Queues) Flush(ctx context.Context) error {
+	var errs []error
+	for _, qu := range q.distinct() {
+		errs = append(errs, qu.Flush(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Ping checks the brokers of queues relying on one are reachable
+func (q *Queues) Ping(ctx context.Context) error {
+	var errs []error
+	for _, qu := range q.distinct() {
+		if pinger, ok := qu.(queue.Pinger); ok {
+			errs = append(errs, pinger.Ping(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Lag returns how far consumers are behind in each
+// partition, for the queues that can tell
+func (q *Queues) Lag(ctx context.Context) ([]queue.PartitionLag, error) {
+	var lag []queue.PartitionLag
+	for _, qu := range q.distinct() {
+		reporter, ok := qu.(queue.LagReporter)
+		if !ok {
+			continue
+		}
+		partitions, err := reporter.Lag(ctx)
+		if err != nil {
+			return nil, err
+		}
+		lag = append(lag, partitions...)
+	}
+	return lag, nil
+}
+
+func (q *Queues) Close() {
+	for _, qu := range q.distinct() {
+		qu.Close()
+	}
+}
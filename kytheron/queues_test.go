@@ -0,0 +1,77 @@
+package kytheron
+
+import (
+	"context"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/queue"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestNewTopics(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Kafka.Parser.Topic = "tenant-a.parsed"
+	cfg.Kafka.DeadLetter.Topic = "tenant-a.dead-letter"
+
+	assert.Equal(t, Topics{
+		Ingest:     DefaultIngestTopic,
+		Parsed:     "tenant-a.parsed",
+		DeadLetter: "tenant-a.dead-letter",
+	}, NewTopics(cfg))
+}
+
+func TestKafkaProperties(t *testing.T) {
+	client := config.KafkaClient{
+		Sasl: config.Sasl{Mechanism: "SCRAM-SHA-512", Username: "kytheron", Password: "secret"},
+		Tls:  config.Tls{Enabled: true, CaFile: "/etc/kytheron/ca.pem"},
+	}
+
+	assert.Equal(t, map[string]string{
+		"security.protocol": "sasl_ssl",
+		"sasl.mechanisms":   "SCRAM-SHA-512",
+		"sasl.username":     "kytheron",
+		"sasl.password":     "secret",
+		"ssl.ca.location":   "/etc/kytheron/ca.pem",
+		"linger.ms":         "5",
+	}, kafkaProperties(client, map[string]string{"linger.ms": "5"}))
+
+	// Configured properties take precedence
+	assert.Equal(t, map[string]string{"security.protocol": "ssl"}, kafkaProperties(config.KafkaClient{}, map[string]string{"security.protocol": "ssl"}))
+}
+
+func TestSourceTopics(t *testing.T) {
+	pipelines, err := NewPipelines([]config.Pipeline{
+		{Name: "default", Source: AnySource, Parsers: []string{"cloudtrail"}},
+		{Name: "syslog", Source: "edge-1", Parsers: []string{"syslog"}},
+		{Name: "audit", Source: "audit", Topic: "audit-logs", Parsers: []string{"json"}},
+	})
+	assert.NoError(t, err)
+	topics := NewTopics(&config.Config{})
+	topics.AddSources(pipelines)
+
+	assert.Equal(t, "ingest.edge-1", topics.Source("edge-1"))
+	assert.Equal(t, "audit-logs", topics.Source("audit"))
+	assert.Equal(t, DefaultIngestTopic, topics.Source("account-x"))
+	assert.Equal(t, []string{"ingest", "audit-logs", "ingest.edge-1"}, topics.IngestTopics())
+}
+
+func TestInlineQueuesDropFailures(t *testing.T) {
+	cfg := &config.Config{Queue: config.Queue{Driver: config.QueueDriverInline}}
+	cfg.Kafka.DeadLetter.Topic = "dead-letter"
+	queues, err := NewQueues(cfg, "", zap.NewNop())
+	assert.NoError(t, err)
+	defer queues.Close()
+	assert.Nil(t, queues.DeadLetter)
+	assert.Empty(t, queues.Topics.DeadLetter)
+
+	// Failed messages are logged and acknowledged, rather than redelivered
+	p := &Processor{config: cfg, queues: queues, logger: zap.NewNop(), work: context.Background()}
+	ingest := &settleCounter{Queue: queues.Ingest}
+	handler := p.consume(ingest, StageIngest, func(ctx context.Context, msg *queue.Message) error {
+		return ErrNoParser
+	})
+	assert.NoError(t, handler(context.Background(), &queue.Message{Topic: DefaultIngestTopic}))
+	assert.Equal(t, int32(1), ingest.acks.Load())
+	assert.Zero(t, ingest.nacks.Load())
+}
@@ -1,111 +1,254 @@
 package kytheron
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/google/uuid"
 	"github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/auth"
 	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/metrics"
+	"github.com/kytheron-org/kytheron/queue"
+	"github.com/kytheron-org/kytheron/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 	"io"
-	"log"
 	"net"
-	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
 )
 
-type LogReceiveHandler func(rawLog *plugin.RawLog) error
+const (
+	// defaultGrpcAddress only accepts sources on the same host
+	defaultGrpcAddress = "localhost"
+	// unknownSource labels the metrics of sources that
+	// neither authenticated nor have their own pipeline
+	unknownSource = "unknown"
+)
+
+type LogReceiveHandler func(ctx context.Context, rawLog *plugin.RawLog) error
 
 type GrpcServer struct {
 	plugin.UnimplementedSourcePluginServer
 	onLogReceiveHandlers []LogReceiveHandler
+	queues               *Queues
+	auth                 *auth.Authenticator
+	health               *Health
 	logger               *zap.Logger
+
+	server *grpc.Server
+	// stopping is closed on shutdown, ending open log streams
+	stopping chan struct{}
+	// maxInFlight limits the logs of a stream awaiting acknowledgement
+	maxInFlight int
 }
 
 var _ plugin.SourcePluginServer = &GrpcServer{}
 
+// NewGrpcServer creates a server publishing to the queues, authenticating
+// sources with auth, or letting any source stream logs when it's nil.
+// The server's health is served too, unless health is nil
+func NewGrpcServer(queues *Queues, authenticator *auth.Authenticator, health *Health, logger *zap.Logger) *GrpcServer {
+	return &GrpcServer{
+		queues:      queues,
+		auth:        authenticator,
+		health:      health,
+		logger:      logger,
+		stopping:    make(chan struct{}),
+		maxInFlight: defaultMaxInFlightLogs,
+	}
+}
+
+// StreamLogs receives a source's logs, publishing up to the configured
+// number at once. The stream is only closed successfully once every log
+// has been acknowledged by the queue. Otherwise it fails with a status
+// carrying an ErrorInfo detail for each log that wasn't, whose metadata
+// holds the log's index within the stream, its id and the error.
+//
+// Sources identify themselves with the kytheron-source-name and
+// kytheron-source-type metadata of the stream, or the source_name and
+// source_type metadata of its first log, which every log is stamped with.
+// Authenticated sources are identified by their credentials instead
 func (s *GrpcServer) StreamLogs(stream plugin.SourcePlugin_StreamLogsServer) error {
-	for {
-		rawLog, err := stream.Recv()
-		if err == io.EOF {
-			return stream.SendAndClose(&plugin.Empty{})
+	identity, identified := streamIdentity(stream.Context())
+	// Authenticated sources can only stream their own logs
+	if source, ok := auth.Source(stream.Context()); ok {
+		if identified && identity.Name != source {
+			return status.Errorf(codes.PermissionDenied, "authenticated as source %q, not %q", source, identity.Name)
+		}
+		identity.Name, identified = source, true
+	}
+	if identified {
+		if err := identity.validate(); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
 		}
+	}
 
-		if err != nil {
-			return err
+	// Receive in the background, so the stream can be
+	// ended on shutdown while waiting for the next log
+	received := make(chan *plugin.RawLog)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			rawLog, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case received <- rawLog:
+			case <-stream.Context().Done():
+				return
+			}
 		}
+	}()
 
-		for _, h := range s.onLogReceiveHandlers {
-			if err := h(rawLog); err != nil {
-				// Do we return an error to the client,
-				// or do we simply log / retry the failed message
+	deliveries := newStreamDeliveries(s.maxInFlight)
+	for {
+		select {
+		case rawLog := <-received:
+			// Nothing has been published before the first log
+			if !identified {
+				if identity, identified = logIdentity(rawLog); !identified {
+					return status.Errorf(codes.Unauthenticated, "source plugins must identify themselves with the %s metadata", SourceNameKey)
+				}
+				if err := identity.validate(); err != nil {
+					return status.Error(codes.InvalidArgument, err.Error())
+				}
+			}
+			identity.stamp(rawLog)
+			deliveries.add(stream.Context(), rawLog, s.handleLog)
+		case err := <-errs:
+			if err == io.EOF {
+				if err := deliveries.wait(s.logger); err != nil {
+					return err
+				}
+				return stream.SendAndClose(&plugin.Empty{})
+			}
+			deliveries.wait(s.logger)
+			return err
+		case <-s.stopping:
+			// Logs already received are published, so
+			// the source can resend the rest once we're back
+			if err := deliveries.wait(s.logger); err != nil {
 				return err
 			}
+			return status.Error(codes.Unavailable, "server is shutting down")
 		}
 	}
 }
 
+// handleLog runs each of the log handlers on a received log
+func (s *GrpcServer) handleLog(ctx context.Context, rawLog *plugin.RawLog) error {
+	for _, h := range s.onLogReceiveHandlers {
+		if err := h(ctx, rawLog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *GrpcServer) AddLogHandler(handler LogReceiveHandler) {
 	s.onLogReceiveHandlers = append(s.onLogReceiveHandlers, handler)
 }
 
-func (s *GrpcServer) Start(cfg *config.Config) error {
-	p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": cfg.Kafka.Source.Url})
-	if err != nil {
-		panic(err)
-	}
-	defer p.Close()
+// publishLog publishes a raw log to the ingest topic of its source.
+// Sources with their own pipeline have their own topic
+func (s *GrpcServer) publishLog(ctx context.Context, a *plugin.RawLog) (err error) {
+	source := a.Metadata[MetadataSourceName]
+	topic := s.queues.Topics.Source(source)
+	metrics.RawLogsReceived.WithLabelValues(s.sourceLabel(ctx, source)).Inc()
+
+	logId := uuid.Must(uuid.NewUUID())
+	a.Id = logId.String()
+
+	// Each log starts its own trace, linked to the stream it arrived on,
+	// as a stream may be open far longer than its logs take to process
+	ctx, span := tracing.Tracer().Start(ctx, "receive log",
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.LogIdKey.String(a.Id), tracing.SourceKey.String(source)),
+	)
+	defer func() { tracing.End(span, err) }()
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", cfg.Server.Grpc.Port))
+	content, err := json.Marshal(a)
 	if err != nil {
 		return err
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	done := make(chan bool, 1)
+	headers := map[string]string{SourceHeader: source}
+	tracing.Inject(ctx, headers)
+	s.logger.Debug("producing message", zap.String("topic", topic))
+	return s.queues.Ingest.Publish(ctx, &queue.Message{
+		Topic:   topic,
+		Value:   content,
+		Headers: headers,
+	})
+}
 
-	grpcServer := grpc.NewServer(
+// sourceLabel returns the source's name to label its metrics with.
+// Without auth, clients can name themselves anything, so only the
+// names of authenticated or configured sources are used
+func (s *GrpcServer) sourceLabel(ctx context.Context, source string) string {
+	if authenticated, ok := auth.Source(ctx); ok && authenticated == source {
+		return source
+	}
+	if _, ok := s.queues.Topics.Sources[source]; ok {
+		return source
+	}
+	return unknownSource
+}
+
+// Start serves source plugins until the context is cancelled
+func (s *GrpcServer) Start(ctx context.Context, cfg *config.Config) error {
+	options := []grpc.ServerOption{
 		grpc.MaxSendMsgSize(cfg.Server.Grpc.MaxSendMessageSize),
 		grpc.MaxRecvMsgSize(cfg.Server.Grpc.MaxRecvMessageSize),
-	)
-	s.AddLogHandler(func(a *plugin.RawLog) error {
-		// TODO: We should have a topic per configured ingester
-		topic := "ingest"
-
-		logId := uuid.Must(uuid.NewUUID())
-		a.Id = logId.String()
-
-		content, err := json.Marshal(a)
-		if err != nil {
-			return err
-		}
+		grpc.StatsHandler(tracing.ServerHandler()),
+	}
+	creds, err := auth.ServerCredentials(cfg.Server.Grpc.Tls)
+	if err != nil {
+		return err
+	}
+	if creds != nil {
+		options = append(options, grpc.Creds(creds))
+	}
+	if s.auth != nil {
+		options = append(options,
+			grpc.ChainUnaryInterceptor(s.auth.UnaryInterceptor()),
+			grpc.ChainStreamInterceptor(s.auth.StreamInterceptor()),
+		)
+	}
 
-		s.logger.Debug("producing message", zap.String("topic", topic))
-		return p.Produce(&kafka.Message{
-			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-			Value:          content,
-		}, nil)
-	})
+	address := cfg.Server.Grpc.Address
+	if address == "" {
+		address = defaultGrpcAddress
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(cfg.Server.Grpc.Port)))
+	if err != nil {
+		return err
+	}
 
-	plugin.RegisterSourcePluginServer(grpcServer, s)
+	if cfg.Server.Grpc.MaxInFlightLogs > 0 {
+		s.maxInFlight = cfg.Server.Grpc.MaxInFlightLogs
+	}
+	s.server = grpc.NewServer(options...)
+	s.AddLogHandler(s.publishLog)
 
-	go func() {
-		s.logger.Info("grpc server listening", zap.String("address", lis.Addr().String()))
-		if err := grpcServer.Serve(lis); err != nil {
-			log.Fatalf("failed to serve: %v", err)
-		}
-	}()
+	plugin.RegisterSourcePluginServer(s.server, s)
+	if s.health != nil {
+		healthpb.RegisterHealthServer(s.server, s.health.GrpcServer())
+	}
 
+	served := make(chan error, 1)
 	go func() {
-		select {
-		case sig := <-sigs:
-			println("Received signal:", sig)
-			done <- true // Signal main goroutine to exit
-		}
+		s.logger.Info("grpc server listening", zap.String("address", lis.Addr().String()), zap.Bool("tls", creds != nil))
+		served <- s.server.Serve(lis)
 	}()
 
 	handshake := map[string]interface{}{
@@ -115,9 +258,32 @@ func (s *GrpcServer) Start(cfg *config.Config) error {
 	contents, err := json.Marshal(handshake)
 	// Print our handshake
 	fmt.Println(string(contents))
-	<-done
 
-	// Wait for message deliveries before shutting down
-	//p.Flush(15 * 1000)
-	return nil
+	select {
+	case err := <-served:
+		return fmt.Errorf("failed to serve: %w", err)
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// Shutdown stops accepting streams and ends those open once their
+// current log is handled. Streams still open when the context
+// expires are closed without waiting
+func (s *GrpcServer) Shutdown(ctx context.Context) {
+	close(s.stopping)
+	if s.server == nil {
+		return
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.server.Stop()
+	}
 }
@@ -0,0 +1,177 @@
+package kytheron
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v5"
+	"github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/auth"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/model"
+	"github.com/kytheron-org/kytheron/queue"
+	"github.com/kytheron-org/kytheron/tracing"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"testing"
+	"time"
+)
+
+// logStream replays logs to StreamLogs
+type logStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	logs   []*plugin.RawLog
+	closed bool
+}
+
+func (s *logStream) Context() context.Context { return s.ctx }
+
+func (s *logStream) Recv() (*plugin.RawLog, error) {
+	if len(s.logs) == 0 {
+		return nil, io.EOF
+	}
+	rawLog := s.logs[0]
+	s.logs = s.logs[1:]
+	return rawLog, nil
+}
+
+func (s *logStream) SendAndClose(*plugin.Empty) error {
+	s.closed = true
+	return nil
+}
+
+func newTestServer(t *testing.T) (*GrpcServer, *queue.Channel) {
+	pipelines, err := NewPipelines([]config.Pipeline{{Name: "audit", Source: "audit", Parsers: []string{"json"}}})
+	assert.NoError(t, err)
+	inline := queue.NewChannel(8)
+	topics := NewTopics(&config.Config{})
+	topics.AddSources(pipelines)
+
+	srv := NewGrpcServer(&Queues{Topics: topics, Ingest: inline, Parsed: inline}, nil, nil, zap.NewNop())
+	srv.AddLogHandler(srv.publishLog)
+	return srv, inline
+}
+
+func TestSourceLabel(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	// Sources named by unauthenticated clients are only
+	// labelled when they have their own pipeline
+	assert.Equal(t, "audit", srv.sourceLabel(context.Background(), "audit"))
+	assert.Equal(t, unknownSource, srv.sourceLabel(context.Background(), "edge-1"))
+}
+
+func TestStreamLogsIdentity(t *testing.T) {
+	srv, inline := newTestServer(t)
+
+	// The stream's identity replaces any the logs carry
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(SourceNameKey, "audit", SourceTypeKey, "file"))
+	stream := &logStream{ctx: ctx, logs: []*plugin.RawLog{
+		{Data: "one"},
+		{Data: "two", Metadata: map[string]string{MetadataSourceName: "someone-else"}},
+	}}
+	assert.NoError(t, srv.StreamLogs(stream))
+	assert.True(t, stream.closed)
+
+	received := make(chan *queue.Message, 2)
+	subscribeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go inline.Subscribe(subscribeCtx, []string{"ingest.audit"}, func(ctx context.Context, msg *queue.Message) error {
+		received <- msg
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		msg := <-received
+		var rawLog plugin.RawLog
+		assert.NoError(t, json.Unmarshal(msg.Value, &rawLog))
+		assert.Equal(t, "audit", rawLog.Metadata[MetadataSourceName])
+		assert.Equal(t, "file", rawLog.Metadata[MetadataSourceType])
+		assert.Equal(t, "audit", msg.Headers[SourceHeader])
+	}
+}
+
+func TestStreamLogsTraced(t *testing.T) {
+	spans := recordSpans(t)
+	srv, inline := newTestServer(t)
+
+	ctx, stream := tracing.Tracer().Start(context.Background(), "stream")
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(SourceNameKey, "audit"))
+	assert.NoError(t, srv.StreamLogs(&logStream{ctx: ctx, logs: []*plugin.RawLog{{Data: "one"}}}))
+	stream.End()
+
+	// Each log starts a trace of its own, carried by its message
+	received := spanNamed(spans.GetSpans(), "receive log")
+	assert.NotNil(t, received)
+	assert.NotEqual(t, stream.SpanContext().TraceID(), received.SpanContext.TraceID())
+	assert.Equal(t, stream.SpanContext(), received.Links[0].SpanContext)
+
+	subscribeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	inline.Subscribe(subscribeCtx, []string{"ingest.audit"}, func(ctx context.Context, msg *queue.Message) error {
+		carried := trace.SpanContextFromContext(tracing.Extract(context.Background(), msg.Headers))
+		assert.Equal(t, received.SpanContext.TraceID(), carried.TraceID())
+		assert.Equal(t, received.SpanContext.SpanID(), carried.SpanID())
+		cancel()
+		return nil
+	})
+}
+
+func TestStreamLogsFirstLogIdentity(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	stream := &logStream{ctx: context.Background(), logs: []*plugin.RawLog{
+		{Data: "one", Metadata: map[string]string{MetadataSourceName: "audit"}},
+		{Data: "two"},
+	}}
+	assert.NoError(t, srv.StreamLogs(stream))
+	assert.True(t, stream.closed)
+}
+
+func TestStreamLogsUnidentified(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	err := srv.StreamLogs(&logStream{ctx: context.Background(), logs: []*plugin.RawLog{{Data: "one"}}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(SourceNameKey, AnySource))
+	err = srv.StreamLogs(&logStream{ctx: ctx})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// sourceTokens holds a single token for a source
+type sourceTokens struct {
+	hash   []byte
+	source string
+}
+
+func (s *sourceTokens) GetActiveSourceToken(_ context.Context, tokenHash []byte) (model.SourceToken, error) {
+	if !bytes.Equal(tokenHash, s.hash) {
+		return model.SourceToken{}, pgx.ErrNoRows
+	}
+	return model.SourceToken{Source: s.source, TokenHash: tokenHash}, nil
+}
+
+func TestStreamLogsAuthenticated(t *testing.T) {
+	srv, _ := newTestServer(t)
+	authenticator, err := auth.NewAuthenticator(config.GrpcServer{}, &sourceTokens{hash: auth.HashToken("secret"), source: "audit"}, zap.NewNop())
+	assert.NoError(t, err)
+	interceptor := authenticator.StreamInterceptor()
+	handler := func(_ any, stream grpc.ServerStream) error {
+		return srv.StreamLogs(&logStream{ServerStream: stream, ctx: stream.Context(), logs: []*plugin.RawLog{{Data: "one"}}})
+	}
+
+	// The token names the source, which can't claim to be another
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(auth.AuthorizationKey, "Bearer secret"))
+	assert.NoError(t, interceptor(nil, &logStream{ctx: ctx}, nil, handler))
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(auth.AuthorizationKey, "Bearer secret", SourceNameKey, "edge-1"))
+	err = interceptor(nil, &logStream{ctx: ctx}, nil, handler)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,185 @@
+package loki
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJson     = "json"
+)
+
+// Entry is a log line, and the labels of the stream it belongs to
+type Entry struct {
+	Labels    map[string]string
+	Timestamp time.Time
+	Line      string
+	// Metadata is attached to the entry as structured metadata,
+	// for values too varied to be stream labels
+	Metadata map[string]string
+}
+
+// batch groups entries by their stream
+type batch struct {
+	streams map[string]*stream
+	order   []string
+}
+
+type stream struct {
+	labels  string
+	entries []Entry
+}
+
+func newBatch(entries []Entry) *batch {
+	b := &batch{streams: make(map[string]*stream)}
+	for _, entry := range entries {
+		b.add(entry)
+	}
+	return b
+}
+
+func (b *batch) add(entry Entry) {
+	key := formatLabels(entry.Labels)
+	s, ok := b.streams[key]
+	if !ok {
+		s = &stream{labels: key}
+		b.streams[key] = s
+		b.order = append(b.order, key)
+	}
+	s.entries = append(s.entries, entry)
+}
+
+// formatLabels renders labels in Loki's selector syntax, sorted by name,
+// which also identifies the stream the labels belong to
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(labels[name]))
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// encode renders the batch as a push request body, returning
+// the body with its content type and encoding headers
+func (b *batch) encode(encoding string) ([]byte, string, string, error) {
+	switch encoding {
+	case EncodingProtobuf, "":
+		return snappy.Encode(nil, b.protobuf()), "application/x-protobuf", "", nil
+	case EncodingJson:
+		content, err := json.Marshal(b.json())
+		if err != nil {
+			return nil, "", "", err
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(content); err != nil {
+			return nil, "", "", err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", "", err
+		}
+		return buf.Bytes(), "application/json", "gzip", nil
+	default:
+		return nil, "", "", fmt.Errorf("unsupported loki encoding %q", encoding)
+	}
+}
+
+// protobuf encodes the batch as a logproto.PushRequest
+func (b *batch) protobuf() []byte {
+	var request []byte
+	for _, key := range b.order {
+		s := b.streams[key]
+
+		var message []byte
+		message = protowire.AppendTag(message, 1, protowire.BytesType)
+		message = protowire.AppendString(message, s.labels)
+		for _, entry := range s.entries {
+			message = protowire.AppendTag(message, 2, protowire.BytesType)
+			message = protowire.AppendBytes(message, encodeEntry(entry))
+		}
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, message)
+	}
+	return request
+}
+
+// encodeEntry encodes a logproto.EntryAdapter
+func encodeEntry(entry Entry) []byte {
+	var timestamp []byte
+	timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, uint64(entry.Timestamp.Unix()))
+	timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, uint64(entry.Timestamp.Nanosecond()))
+
+	var message []byte
+	message = protowire.AppendTag(message, 1, protowire.BytesType)
+	message = protowire.AppendBytes(message, timestamp)
+	message = protowire.AppendTag(message, 2, protowire.BytesType)
+	message = protowire.AppendString(message, entry.Line)
+
+	names := make([]string, 0, len(entry.Metadata))
+	for name := range entry.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var pair []byte
+		pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+		pair = protowire.AppendString(pair, name)
+		pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+		pair = protowire.AppendString(pair, entry.Metadata[name])
+
+		message = protowire.AppendTag(message, 3, protowire.BytesType)
+		message = protowire.AppendBytes(message, pair)
+	}
+	return message
+}
+
+type jsonPush struct {
+	Streams []jsonStream `json:"streams"`
+}
+
+type jsonStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]any           `json:"values"`
+}
+
+func (b *batch) json() jsonPush {
+	var push jsonPush
+	for _, key := range b.order {
+		s := b.streams[key]
+		js := jsonStream{Stream: s.entries[0].Labels}
+		for _, entry := range s.entries {
+			value := []any{strconv.FormatInt(entry.Timestamp.UnixNano(), 10), entry.Line}
+			if len(entry.Metadata) > 0 {
+				value = append(value, entry.Metadata)
+			}
+			js.Values = append(js.Values, value)
+		}
+		push.Streams = append(push.Streams, js)
+	}
+	return push
+}
@@ -0,0 +1,169 @@
+package loki
+
+// This package pushes log entries to Loki in batches, grouping
+// entries by stream and retrying batches Loki couldn't accept
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/internal/batcher"
+	"github.com/kytheron-org/kytheron/metrics"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultBatchSize = 1024 * 1024
+	defaultTimeout   = 10 * time.Second
+)
+
+// ErrClosed is returned when pushing to a closed client
+var ErrClosed = batcher.ErrClosed
+
+// Client sends entries to Loki in batches. Batches are sent one at a
+// time, so the results of pushing entries are reported in order
+type Client struct {
+	cfg      config.Loki
+	url      string
+	readyUrl string
+	http     *http.Client
+	batcher  *batcher.Batcher[Entry]
+}
+
+func NewClient(cfg config.Loki, logger *zap.Logger) *Client {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	c := &Client{
+		cfg:      cfg,
+		url:      fmt.Sprintf("%s/api/v1/push", cfg.Url),
+		readyUrl: readyUrl(cfg.Url),
+		http:     &http.Client{Timeout: cfg.Timeout},
+	}
+	// Batches grow to the configured size in bytes of their lines
+	c.batcher = batcher.New(batcher.Options{
+		BatchSize:  cfg.BatchSize,
+		BatchWait:  cfg.BatchWait,
+		BufferSize: cfg.BufferSize,
+		Retries:    cfg.Retries,
+		MinBackoff: cfg.MinBackoff,
+		MaxBackoff: cfg.MaxBackoff,
+	}, func(entry Entry) int { return len(entry.Line) }, c.send, logger.With(zap.String("sink", "loki")))
+	return c
+}
+
+// Push adds an entry to the next batch, calling done with the result of
+// sending it. Push blocks while the buffer of waiting entries is full,
+// holding back the caller until Loki catches up, rather than dropping entries
+func (c *Client) Push(ctx context.Context, entry Entry, done func(error)) error {
+	return c.batcher.Push(ctx, entry, func(err error) {
+		result := metrics.ResultSuccess
+		if err != nil {
+			result = metrics.ResultFailure
+		}
+		metrics.LokiPushedEntries.WithLabelValues(result).Inc()
+		if done != nil {
+			done(err)
+		}
+	})
+}
+
+// Flush sends the entries pushed so far, returning once they've been sent
+func (c *Client) Flush(ctx context.Context) error {
+	return c.batcher.Flush(ctx)
+}
+
+// Close sends the entries pushed so far and stops the client. Entries
+// still waiting when the context expires are reported as failed
+func (c *Client) Close(ctx context.Context) error {
+	return c.batcher.Close(ctx)
+}
+
+// send pushes a batch. Requests Loki rejects won't be accepted by trying
+// again, so only failures while Loki is unavailable or rate limiting are retried
+func (c *Client) send(ctx context.Context, entries []Entry) error {
+	body, contentType, contentEncoding, err := newBatch(entries).encode(c.cfg.Encoding)
+	if err != nil {
+		return batcher.Permanent(err)
+	}
+	retry, err := c.push(ctx, body, contentType, contentEncoding)
+	if err != nil && !retry {
+		return batcher.Permanent(err)
+	}
+	return err
+}
+
+// readyUrl is Loki's ready endpoint, which is served at the server's root
+// even when the push API is served under a path prefix
+func readyUrl(pushUrl string) string {
+	u, err := url.Parse(pushUrl)
+	if err != nil || u.Host == "" {
+		return pushUrl + "/ready"
+	}
+	return (&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: "/ready"}).String()
+}
+
+// Ready checks Loki is reachable and ready to accept entries
+func (c *Client) Ready(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.readyUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("loki returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// push sends a request, reporting whether a failure is worth retrying
+func (c *Client) push(ctx context.Context, body []byte, contentType, contentEncoding string) (retry bool, err error) {
+	start := time.Now()
+	defer func() {
+		result := metrics.ResultSuccess
+		if err != nil {
+			result = metrics.ResultFailure
+		}
+		metrics.LokiPushDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if c.cfg.TenantId != "" {
+		req.Header.Set("X-Scope-OrgID", c.cfg.TenantId)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("loki returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
@@ -0,0 +1,196 @@
+package loki
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/golang/snappy"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func push(t *testing.T, c *Client, entry Entry) chan error {
+	result := make(chan error, 1)
+	assert.NoError(t, c.Push(context.Background(), entry, func(err error) { result <- err }))
+	return result
+}
+
+func TestClientBatchesByStream(t *testing.T) {
+	var requests []jsonPush
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/loki/api/v1/push", r.URL.Path)
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "tenant", r.Header.Get("X-Scope-OrgID"))
+		body, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		var request jsonPush
+		assert.NoError(t, json.NewDecoder(body).Decode(&request))
+		requests = append(requests, request)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := NewClient(config.Loki{Url: server.URL + "/loki", TenantId: "tenant", Encoding: EncodingJson, BatchWait: time.Minute}, zap.NewNop())
+	now := time.Now()
+	results := []chan error{
+		push(t, c, Entry{Labels: map[string]string{"source_name": "a"}, Timestamp: now, Line: "one"}),
+		push(t, c, Entry{Labels: map[string]string{"source_name": "b"}, Timestamp: now, Line: "two"}),
+		push(t, c, Entry{Labels: map[string]string{"source_name": "a"}, Timestamp: now, Line: "three", Metadata: map[string]string{"log_id": "1"}}),
+	}
+
+	assert.NoError(t, c.Flush(context.Background()))
+	for _, result := range results {
+		assert.NoError(t, <-result)
+	}
+
+	assert.Len(t, requests, 1)
+	streams := requests[0].Streams
+	assert.Len(t, streams, 2)
+	assert.Equal(t, map[string]string{"source_name": "a"}, streams[0].Stream)
+	assert.Len(t, streams[0].Values, 2)
+	assert.Equal(t, "three", streams[0].Values[1][1])
+	assert.Equal(t, map[string]any{"log_id": "1"}, streams[0].Values[1][2])
+	assert.Equal(t, map[string]string{"source_name": "b"}, streams[1].Stream)
+
+	assert.NoError(t, c.Close(context.Background()))
+}
+
+func TestClientBatchSize(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// A batch is sent as soon as it's full, without waiting
+	c := NewClient(config.Loki{Url: server.URL, BatchSize: 8, BatchWait: time.Minute}, zap.NewNop())
+	defer c.Close(context.Background())
+	assert.NoError(t, <-push(t, c, Entry{Line: "0123456789"}))
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestClientProtobuf(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		content, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		body, err = snappy.Decode(nil, content)
+		assert.NoError(t, err)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := NewClient(config.Loki{Url: server.URL, Encoding: EncodingProtobuf}, zap.NewNop())
+	result := push(t, c, Entry{Labels: map[string]string{"source_name": "a"}, Timestamp: time.Unix(1, 2), Line: "line"})
+	assert.NoError(t, c.Close(context.Background()))
+	assert.NoError(t, <-result)
+
+	// PushRequest.streams
+	number, _, n := protowire.ConsumeTag(body)
+	assert.Equal(t, protowire.Number(1), number)
+	stream, _ := protowire.ConsumeBytes(body[n:])
+
+	// StreamAdapter.labels
+	_, _, n = protowire.ConsumeTag(stream)
+	labels, m := protowire.ConsumeString(stream[n:])
+	assert.Equal(t, `{source_name="a"}`, labels)
+	stream = stream[n+m:]
+
+	// StreamAdapter.entries
+	number, _, n = protowire.ConsumeTag(stream)
+	assert.Equal(t, protowire.Number(2), number)
+	entry, _ := protowire.ConsumeBytes(stream[n:])
+	_, _, n = protowire.ConsumeTag(entry)
+	_, m = protowire.ConsumeBytes(entry[n:])
+	entry = entry[n+m:]
+	_, _, n = protowire.ConsumeTag(entry)
+	line, _ := protowire.ConsumeString(entry[n:])
+	assert.Equal(t, "line", line)
+}
+
+func TestClientRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := NewClient(config.Loki{Url: server.URL, BatchWait: time.Millisecond, Retries: 5, MinBackoff: time.Millisecond}, zap.NewNop())
+	defer c.Close(context.Background())
+	assert.NoError(t, <-push(t, c, Entry{Line: "line"}))
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestClientRejected(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "entry too far behind", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	// Requests Loki rejects won't be accepted by trying again
+	c := NewClient(config.Loki{Url: server.URL, BatchWait: time.Millisecond, Retries: 5, MinBackoff: time.Millisecond}, zap.NewNop())
+	defer c.Close(context.Background())
+	assert.ErrorContains(t, <-push(t, c, Entry{Line: "line"}), "entry too far behind")
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestClientBackpressure(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := NewClient(config.Loki{Url: server.URL, BatchSize: 1, BufferSize: 1}, zap.NewNop())
+	// The first entry is being sent, and the second fills the buffer
+	push(t, c, Entry{Line: "one"})
+	assert.Eventually(t, func() bool { return c.batcher.Len() == 0 }, time.Second, time.Millisecond)
+	push(t, c, Entry{Line: "two"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.Push(ctx, Entry{Line: "three"}, nil), context.DeadlineExceeded)
+}
+
+func TestClientReady(t *testing.T) {
+	var ready atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/ready", r.URL.Path)
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "Ingester not ready")
+			return
+		}
+		io.WriteString(w, "ready")
+	}))
+	defer server.Close()
+
+	c := NewClient(config.Loki{Url: server.URL}, zap.NewNop())
+	defer c.Close(context.Background())
+	assert.ErrorContains(t, c.Ready(context.Background()), "Ingester not ready")
+	ready.Store(true)
+	assert.NoError(t, c.Ready(context.Background()))
+
+	// Readiness is served at the root when pushes are under a path prefix
+	prefixed := NewClient(config.Loki{Url: server.URL + "/loki"}, zap.NewNop())
+	defer prefixed.Close(context.Background())
+	assert.NoError(t, prefixed.Ready(context.Background()))
+}
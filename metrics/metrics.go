@@ -0,0 +1,114 @@
+package metrics
+
+// This package holds the Prometheus metrics of the pipeline, from
+// sources sending raw logs through to policy hits reaching outputs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "kytheron"
+
+// Result label values
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Registry holds every metric, along with the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	RawLogsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "raw_logs_received_total",
+		Help:      "Raw logs received from source plugins, by source",
+	}, []string{"source"})
+
+	ParseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "parse_duration_seconds",
+		Help:      "Time taken by parser plugins to parse a raw log",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"parser"})
+
+	ParseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_failures_total",
+		Help:      "Raw logs a parser plugin failed to parse",
+	}, []string{"parser"})
+
+	ParsedLogs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parsed_logs_total",
+		Help:      "Parsed logs produced, by parser plugin",
+	}, []string{"parser"})
+
+	Evaluations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "policy_evaluations_total",
+		Help:      "Parsed logs evaluated against the loaded policies",
+	})
+
+	EvaluationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "policy_evaluation_failures_total",
+		Help:      "Parsed logs that couldn't be evaluated",
+	})
+
+	Hits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "policy_hits_total",
+		Help:      "Policy hits, by policy and evaluation",
+	}, []string{"policy", "evaluation"})
+
+	OutputDispatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "output_dispatches_total",
+		Help:      "Hits delivered to outputs, or given up on after every retry",
+	}, []string{"output", "result"})
+
+	LokiPushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "loki_push_duration_seconds",
+		Help:      "Time taken by each request pushing a batch to Loki",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	LokiPushedEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "loki_pushed_entries_total",
+		Help:      "Entries sent to Loki, or dropped once retries ran out",
+	}, []string{"result"})
+
+	ConsumerLag = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "consumer_lag"),
+		"Messages between a consumer's position in a partition and its end",
+		[]string{"topic", "partition"}, nil,
+	)
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RawLogsReceived,
+		ParseDuration,
+		ParseFailures,
+		ParsedLogs,
+		Evaluations,
+		EvaluationFailures,
+		Hits,
+		OutputDispatches,
+		LokiPushDuration,
+		LokiPushedEntries,
+	)
+}
+
+// Handler serves the registry's metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
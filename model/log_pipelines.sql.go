@@ -7,10 +7,115 @@ package model
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const createLogPipeline = `-- name: CreateLogPipeline :one
+INSERT INTO log_pipelines (name, source, parsers, topic)
+VALUES ($1, $2, $3, $4)
+RETURNING id, name, source, parsers, created_at, updated_at, deleted_at, topic
+`
+
+type CreateLogPipelineParams struct {
+	Name    string
+	Source  string
+	Parsers []byte
+	Topic   pgtype.Text
+}
+
+func (q *Queries) CreateLogPipeline(ctx context.Context, arg CreateLogPipelineParams) (LogPipeline, error) {
+	row := q.db.QueryRow(ctx, createLogPipeline,
+		arg.Name,
+		arg.Source,
+		arg.Parsers,
+		arg.Topic,
+	)
+	var i LogPipeline
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Source,
+		&i.Parsers,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.DeletedAt,
+		&i.Topic,
+	)
+	return i, err
+}
+
+const deleteLogPipeline = `-- name: DeleteLogPipeline :execrows
+UPDATE log_pipelines SET deleted_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+`
+
+func (q *Queries) DeleteLogPipeline(ctx context.Context, id pgtype.UUID) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteLogPipeline, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const getLogPipeline = `-- name: GetLogPipeline :one
+SELECT id, name, source, parsers, created_at, updated_at, deleted_at, topic FROM log_pipelines
+WHERE id = $1 AND deleted_at IS NULL
+`
+
+func (q *Queries) GetLogPipeline(ctx context.Context, id pgtype.UUID) (LogPipeline, error) {
+	row := q.db.QueryRow(ctx, getLogPipeline, id)
+	var i LogPipeline
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Source,
+		&i.Parsers,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.DeletedAt,
+		&i.Topic,
+	)
+	return i, err
+}
+
+const listActiveLogPipelines = `-- name: ListActiveLogPipelines :many
+SELECT id, name, source, parsers, created_at, updated_at, deleted_at, topic FROM log_pipelines
+WHERE deleted_at IS NULL
+ORDER BY created_at
+`
+
+func (q *Queries) ListActiveLogPipelines(ctx context.Context) ([]LogPipeline, error) {
+	rows, err := q.db.Query(ctx, listActiveLogPipelines)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []LogPipeline
+	for rows.Next() {
+		var i LogPipeline
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Source,
+			&i.Parsers,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.DeletedAt,
+			&i.Topic,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const listLogPipelines = `-- name: ListLogPipelines :many
-SELECT id, name, source, parsers, created_at, updated_at, deleted_at FROM log_pipelines
+SELECT id, name, source, parsers, created_at, updated_at, deleted_at, topic FROM log_pipelines
 ORDER BY id
 `
 
@@ -31,6 +136,7 @@ func (q *Queries) ListLogPipelines(ctx context.Context) ([]LogPipeline, error) {
 			&i.CreatedAt,
 			&i.UpdatedAt,
 			&i.DeletedAt,
+			&i.Topic,
 		); err != nil {
 			return nil, err
 		}
@@ -41,3 +147,39 @@ func (q *Queries) ListLogPipelines(ctx context.Context) ([]LogPipeline, error) {
 	}
 	return items, nil
 }
+
+const updateLogPipeline = `-- name: UpdateLogPipeline :one
+UPDATE log_pipelines SET name = $2, source = $3, parsers = $4, topic = $5, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING id, name, source, parsers, created_at, updated_at, deleted_at, topic
+`
+
+type UpdateLogPipelineParams struct {
+	ID      pgtype.UUID
+	Name    string
+	Source  string
+	Parsers []byte
+	Topic   pgtype.Text
+}
+
+func (q *Queries) UpdateLogPipeline(ctx context.Context, arg UpdateLogPipelineParams) (LogPipeline, error) {
+	row := q.db.QueryRow(ctx, updateLogPipeline,
+		arg.ID,
+		arg.Name,
+		arg.Source,
+		arg.Parsers,
+		arg.Topic,
+	)
+	var i LogPipeline
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Source,
+		&i.Parsers,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.DeletedAt,
+		&i.Topic,
+	)
+	return i, err
+}
@@ -16,13 +16,48 @@ type LogPipeline struct {
 	CreatedAt pgtype.Timestamptz
 	UpdatedAt pgtype.Timestamptz
 	DeletedAt pgtype.Timestamptz
+	Topic     pgtype.Text
+}
+
+type ParsedLog struct {
+	ID         pgtype.UUID
+	SourceID   pgtype.UUID
+	SourceType string
+	SourceName string
+	Timestamp  pgtype.Timestamptz
+	Data       []byte
+	Labels     []byte
+	Metadata   []byte
+	CreatedAt  pgtype.Timestamptz
 }
 
 type Policy struct {
+	ID            pgtype.UUID
+	Name          string
+	Path          string
+	CreatedAt     pgtype.Timestamptz
+	UpdatedAt     pgtype.Timestamptz
+	DeletedAt     pgtype.Timestamptz
+	ActiveVersion pgtype.Int4
+	Pinned        bool
+}
+
+type PolicyVersion struct {
 	ID        pgtype.UUID
+	PolicyID  pgtype.UUID
+	Version   int32
+	Content   string
+	Checksum  string
+	Author    string
+	CreatedAt pgtype.Timestamptz
+}
+
+type SourceToken struct {
+	ID        pgtype.UUID
+	Source    string
 	Name      string
-	Path      string
+	TokenHash []byte
 	CreatedAt pgtype.Timestamptz
-	UpdatedAt pgtype.Timestamptz
-	DeletedAt pgtype.Timestamptz
+	ExpiresAt pgtype.Timestamptz
+	RevokedAt pgtype.Timestamptz
 }
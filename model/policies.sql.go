@@ -7,10 +7,144 @@ package model
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const activatePolicyVersion = `-- name: ActivatePolicyVersion :one
+UPDATE policies SET active_version = $2, pinned = $3, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+  AND EXISTS (SELECT 1 FROM policy_versions WHERE policy_id = $1 AND version = $2)
+RETURNING id, name, path, created_at, updated_at, deleted_at, active_version, pinned
+`
+
+type ActivatePolicyVersionParams struct {
+	ID            pgtype.UUID
+	ActiveVersion pgtype.Int4
+	Pinned        bool
+}
+
+func (q *Queries) ActivatePolicyVersion(ctx context.Context, arg ActivatePolicyVersionParams) (Policy, error) {
+	row := q.db.QueryRow(ctx, activatePolicyVersion,
+		arg.ID,
+		arg.ActiveVersion,
+		arg.Pinned,
+	)
+	var i Policy
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Path,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.DeletedAt,
+		&i.ActiveVersion,
+		&i.Pinned,
+	)
+	return i, err
+}
+
+const createPolicy = `-- name: CreatePolicy :one
+INSERT INTO policies (name, path)
+VALUES ($1, $2)
+RETURNING id, name, path, created_at, updated_at, deleted_at, active_version, pinned
+`
+
+type CreatePolicyParams struct {
+	Name string
+	Path string
+}
+
+func (q *Queries) CreatePolicy(ctx context.Context, arg CreatePolicyParams) (Policy, error) {
+	row := q.db.QueryRow(ctx, createPolicy,
+		arg.Name,
+		arg.Path,
+	)
+	var i Policy
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Path,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.DeletedAt,
+		&i.ActiveVersion,
+		&i.Pinned,
+	)
+	return i, err
+}
+
+const deletePolicy = `-- name: DeletePolicy :execrows
+UPDATE policies SET deleted_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+`
+
+func (q *Queries) DeletePolicy(ctx context.Context, id pgtype.UUID) (int64, error) {
+	result, err := q.db.Exec(ctx, deletePolicy, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const getPolicy = `-- name: GetPolicy :one
+SELECT id, name, path, created_at, updated_at, deleted_at, active_version, pinned FROM policies
+WHERE id = $1 AND deleted_at IS NULL
+`
+
+func (q *Queries) GetPolicy(ctx context.Context, id pgtype.UUID) (Policy, error) {
+	row := q.db.QueryRow(ctx, getPolicy, id)
+	var i Policy
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Path,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.DeletedAt,
+		&i.ActiveVersion,
+		&i.Pinned,
+	)
+	return i, err
+}
+
+const listActivePolicies = `-- name: ListActivePolicies :many
+SELECT id, name, path, created_at, updated_at, deleted_at, active_version, pinned FROM policies
+WHERE deleted_at IS NULL
+ORDER BY created_at
+`
+
+func (q *Queries) ListActivePolicies(ctx context.Context) ([]Policy, error) {
+	rows, err := q.db.Query(ctx, listActivePolicies)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Policy
+	for rows.Next() {
+		var i Policy
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Path,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.DeletedAt,
+			&i.ActiveVersion,
+			&i.Pinned,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const listPolicies = `-- name: ListPolicies :many
-SELECT id, name, path, created_at, updated_at, deleted_at FROM policies
+SELECT id, name, path, created_at, updated_at, deleted_at, active_version, pinned FROM policies
 ORDER BY id
 `
 
@@ -30,6 +164,8 @@ func (q *Queries) ListPolicies(ctx context.Context) ([]Policy, error) {
 			&i.CreatedAt,
 			&i.UpdatedAt,
 			&i.DeletedAt,
+			&i.ActiveVersion,
+			&i.Pinned,
 		); err != nil {
 			return nil, err
 		}
@@ -40,3 +176,58 @@ func (q *Queries) ListPolicies(ctx context.Context) ([]Policy, error) {
 	}
 	return items, nil
 }
+
+const lockPolicy = `-- name: LockPolicy :one
+SELECT id, name, path, created_at, updated_at, deleted_at, active_version, pinned FROM policies
+WHERE id = $1 AND deleted_at IS NULL
+FOR UPDATE
+`
+
+// Locks a policy until the end of the transaction, serializing its new versions
+func (q *Queries) LockPolicy(ctx context.Context, id pgtype.UUID) (Policy, error) {
+	row := q.db.QueryRow(ctx, lockPolicy, id)
+	var i Policy
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Path,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.DeletedAt,
+		&i.ActiveVersion,
+		&i.Pinned,
+	)
+	return i, err
+}
+
+const updatePolicy = `-- name: UpdatePolicy :one
+UPDATE policies SET name = $2, path = $3, updated_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL
+RETURNING id, name, path, created_at, updated_at, deleted_at, active_version, pinned
+`
+
+type UpdatePolicyParams struct {
+	ID   pgtype.UUID
+	Name string
+	Path string
+}
+
+func (q *Queries) UpdatePolicy(ctx context.Context, arg UpdatePolicyParams) (Policy, error) {
+	row := q.db.QueryRow(ctx, updatePolicy,
+		arg.ID,
+		arg.Name,
+		arg.Path,
+	)
+	var i Policy
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Path,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.DeletedAt,
+		&i.ActiveVersion,
+		&i.Pinned,
+	)
+	return i, err
+}
@@ -0,0 +1,212 @@
+package policy
+
+import (
+	"fmt"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/theory/jsonpath"
+	"github.com/zclconf/go-cty/cty"
+	"net"
+	"regexp"
+)
+
+// Operator compares the nodes selected by a condition's path
+// against the condition's value
+type Operator string
+
+const (
+	OperatorEquals     Operator = "equals"
+	OperatorNotEquals  Operator = "not_equals"
+	OperatorIn         Operator = "in"
+	OperatorContains   Operator = "contains"
+	OperatorStartsWith Operator = "starts_with"
+	OperatorEndsWith   Operator = "ends_with"
+	OperatorRegex      Operator = "regex"
+	OperatorExists     Operator = "exists"
+	OperatorNotExists  Operator = "not_exists"
+	OperatorGt         Operator = "gt"
+	OperatorGte        Operator = "gte"
+	OperatorLt         Operator = "lt"
+	OperatorLte        Operator = "lte"
+	OperatorCidr       Operator = "cidr"
+)
+
+// decodeCondition validates a raw condition block, converting its
+// value to the Go type expected by the operator:
+//   - string, float64 or bool for scalar comparisons
+//   - []any for in, and []any of CIDR strings for cidr
+//   - nil for exists and not_exists
+func decodeCondition(rc rawCondition) (Condition, error) {
+	condition := Condition{
+		Path:     rc.Path,
+		Operator: OperatorEquals,
+	}
+	if rc.Operator != "" {
+		condition.Operator = Operator(rc.Operator)
+	}
+
+	if _, err := jsonpath.Parse(rc.Path); err != nil {
+		return Condition{}, fmt.Errorf("invalid path %q: %w", rc.Path, err)
+	}
+
+	var value cty.Value = cty.NullVal(cty.DynamicPseudoType)
+	if rc.Value != nil {
+		var diags hcl.Diagnostics
+		value, diags = rc.Value.Value(nil)
+		if diags.HasErrors() {
+			return Condition{}, fmt.Errorf("invalid value for %s: %s", rc.Path, diags.Error())
+		}
+	}
+
+	converted, err := convertValue(value)
+	if err != nil {
+		return Condition{}, fmt.Errorf("invalid value for %s: %w", rc.Path, err)
+	}
+
+	// A single network is normalised to a list of one
+	if network, ok := converted.(string); ok && condition.Operator == OperatorCidr {
+		converted = []any{network}
+	}
+
+	condition.Value = converted
+	if err := condition.Validate(); err != nil {
+		return Condition{}, err
+	}
+	return condition, nil
+}
+
+// Validate checks the condition's operator is supported, and its value
+// is of the type the operator expects, so conditions built outside
+// the decoder can be evaluated safely
+func (c Condition) Validate() error {
+	switch c.Operator {
+	case OperatorExists, OperatorNotExists:
+		if c.Value != nil {
+			return fmt.Errorf("operator %s on %s does not take a value", c.Operator, c.Path)
+		}
+	case OperatorEquals, OperatorNotEquals, OperatorContains:
+		if c.Value == nil {
+			return fmt.Errorf("operator %s on %s requires a value", c.Operator, c.Path)
+		}
+		if _, ok := c.Value.([]any); ok {
+			return fmt.Errorf("operator %s on %s requires a single value", c.Operator, c.Path)
+		}
+	case OperatorStartsWith, OperatorEndsWith:
+		if _, ok := c.Value.(string); !ok {
+			return fmt.Errorf("operator %s on %s requires a string value", c.Operator, c.Path)
+		}
+	case OperatorRegex:
+		pattern, ok := c.Value.(string)
+		if !ok {
+			return fmt.Errorf("operator %s on %s requires a string value", c.Operator, c.Path)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid regex for %s: %w", c.Path, err)
+		}
+	case OperatorIn:
+		if _, ok := c.Value.([]any); !ok {
+			return fmt.Errorf("operator %s on %s requires a list value", c.Operator, c.Path)
+		}
+	case OperatorGt, OperatorGte, OperatorLt, OperatorLte:
+		if _, ok := c.Value.(float64); !ok {
+			return fmt.Errorf("operator %s on %s requires a number value", c.Operator, c.Path)
+		}
+	case OperatorCidr:
+		networks, ok := c.Value.([]any)
+		if !ok {
+			return fmt.Errorf("operator %s on %s requires a list value", c.Operator, c.Path)
+		}
+		for _, network := range networks {
+			cidr, ok := network.(string)
+			if !ok {
+				return fmt.Errorf("operator %s on %s requires CIDR strings", c.Operator, c.Path)
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid CIDR for %s: %w", c.Path, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported operator %q on %s", c.Operator, c.Path)
+	}
+	return nil
+}
+
+// decodeGroups decodes the all, any and not blocks nested
+// at one level of the condition tree
+func decodeGroups(allGroups, anyGroups, notGroups []rawConditionGroup) ([]ConditionGroup, error) {
+	var groups []ConditionGroup
+	for _, kind := range []struct {
+		kind GroupKind
+		raw  []rawConditionGroup
+	}{{GroupAll, allGroups}, {GroupAny, anyGroups}, {GroupNot, notGroups}} {
+		for _, rg := range kind.raw {
+			group, err := decodeGroup(kind.kind, rg)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+func decodeGroup(kind GroupKind, rg rawConditionGroup) (ConditionGroup, error) {
+	group := ConditionGroup{
+		Kind:       kind,
+		Conditions: make([]Condition, len(rg.Conditions)),
+	}
+
+	for i, rc := range rg.Conditions {
+		condition, err := decodeCondition(rc)
+		if err != nil {
+			return ConditionGroup{}, err
+		}
+		group.Conditions[i] = condition
+	}
+
+	groups, err := decodeGroups(rg.All, rg.Any, rg.Not)
+	if err != nil {
+		return ConditionGroup{}, err
+	}
+	group.Groups = groups
+
+	if len(group.Conditions) == 0 && len(group.Groups) == 0 {
+		return ConditionGroup{}, fmt.Errorf("%s block must contain at least one condition", kind)
+	}
+	return group, nil
+}
+
+// convertValue converts an HCL value into the equivalent
+// Go type produced by decoding JSON
+func convertValue(val cty.Value) (any, error) {
+	if val.IsNull() {
+		return nil, nil
+	}
+	if !val.IsWhollyKnown() {
+		return nil, fmt.Errorf("value must be known")
+	}
+
+	switch {
+	case val.Type() == cty.String:
+		return val.AsString(), nil
+	case val.Type() == cty.Number:
+		f, _ := val.AsBigFloat().Float64()
+		return f, nil
+	case val.Type() == cty.Bool:
+		return val.True(), nil
+	case val.Type().IsListType() || val.Type().IsTupleType() || val.Type().IsSetType():
+		values := []any{}
+		for _, item := range val.AsValueSlice() {
+			converted, err := convertValue(item)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := converted.([]any); ok {
+				return nil, fmt.Errorf("nested lists are not supported")
+			}
+			values = append(values, converted)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %s", val.Type().FriendlyName())
+	}
+}
@@ -20,28 +20,39 @@ type rawPolicy struct {
 type rawSource struct {
 	Type    string   `hcl:"type,label"`
 	Name    string   `hcl:"name,label"`
-	Version string   `hcl:"version,attr"`
+	Version string   `hcl:"version,optional"`
 	Remain  hcl.Body `hcl:",remain"`
 }
 
 type rawEvaluation struct {
-	Type       string         `hcl:"type,label"`
-	Name       string         `hcl:"name,label"`
-	Inputs     hcl.Expression `hcl:"inputs,attr"`
-	Conditions []rawCondition `hcl:"condition,block"`
-	Outputs    hcl.Expression `hcl:"outputs,attr"`
-	Remain     hcl.Body       `hcl:",remain"`
+	Type       string              `hcl:"type,label"`
+	Name       string              `hcl:"name,label"`
+	Inputs     hcl.Expression      `hcl:"inputs,attr"`
+	Conditions []rawCondition      `hcl:"condition,block"`
+	All        []rawConditionGroup `hcl:"all,block"`
+	Any        []rawConditionGroup `hcl:"any,block"`
+	Not        []rawConditionGroup `hcl:"not,block"`
+	Outputs    hcl.Expression      `hcl:"outputs,attr"`
+	Remain     hcl.Body            `hcl:",remain"`
+}
+
+type rawConditionGroup struct {
+	Conditions []rawCondition      `hcl:"condition,block"`
+	All        []rawConditionGroup `hcl:"all,block"`
+	Any        []rawConditionGroup `hcl:"any,block"`
+	Not        []rawConditionGroup `hcl:"not,block"`
 }
 
 type rawCondition struct {
-	Path  string `hcl:"path,attr"`
-	Value string `hcl:"value,attr"`
+	Path     string         `hcl:"path,attr"`
+	Operator string         `hcl:"operator,optional"`
+	Value    hcl.Expression `hcl:"value,optional"`
 }
 
 type rawOutput struct {
 	Type    string   `hcl:"type,label"`
 	Name    string   `hcl:"name,label"`
-	Version string   `hcl:"version,attr"`
+	Version string   `hcl:"version,optional"`
 	Remain  hcl.Body `hcl:",remain"`
 }
 
@@ -80,16 +91,18 @@ func Decode(filename string, content []byte) (*Policy, error) {
 	// Convert sources
 	for i, rs := range raw.Sources {
 		policy.Sources[i] = Source{
-			Type: rs.Type,
-			Name: rs.Name,
+			Type:    rs.Type,
+			Name:    rs.Name,
+			Version: rs.Version,
 		}
 	}
 
 	// Convert outputs (resolve evaluation and destination references)
 	for i, ro := range raw.Outputs {
 		output := Output{
-			Type: ro.Type,
-			Name: ro.Name,
+			Type:    ro.Type,
+			Name:    ro.Name,
+			Version: ro.Version,
 		}
 		policy.Outputs[i] = output
 	}
@@ -111,13 +124,21 @@ func Decode(filename string, content []byte) (*Policy, error) {
 			eval.Inputs = inputs
 		}
 
-		// Copy conditions
+		// Validate conditions and convert their values
 		for j, rc := range re.Conditions {
-			eval.Conditions[j] = Condition{
-				Path:  rc.Path,
-				Value: rc.Value,
+			condition, err := decodeCondition(rc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid condition for evaluation %s.%s: %w", re.Type, re.Name, err)
 			}
+			eval.Conditions[j] = condition
+		}
+
+		// Decode nested all, any and not blocks
+		groups, err := decodeGroups(re.All, re.Any, re.Not)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition for evaluation %s.%s: %w", re.Type, re.Name, err)
 		}
+		eval.Groups = groups
 
 		if re.Outputs != nil {
 			fmt.Println("resolving outputs")
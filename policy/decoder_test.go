@@ -42,3 +42,148 @@ output "console" "log_cloudtrail_user_actions" {}
 	assert.Equal(t, "$.userIdentity.type", policy.Evaluations[0].Conditions[0].Path)
 	assert.Equal(t, "IAMUser", policy.Evaluations[0].Conditions[0].Value)
 }
+
+func TestDecodeConditionOperators(t *testing.T) {
+	policyHcl := `
+source "aws_cloudtrail" "account-x" {}
+
+evaluation "aws_cloudtrail" "console_login" {
+  inputs = [source.aws_cloudtrail.account-x]
+
+  condition {
+    path = "$.eventName"
+    operator = "in"
+    value = ["ConsoleLogin", "GetSigninToken"]
+  }
+
+  condition {
+    path = "$.sourceIPAddress"
+    operator = "cidr"
+    value = "10.0.0.0/8"
+  }
+
+  condition {
+    path = "$.errorCode"
+    operator = "not_exists"
+  }
+}
+`
+	policy, err := Decode("test_policy.hcl", []byte(policyHcl))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	conditions := policy.Evaluations[0].Conditions
+	assert.Equal(t, 3, len(conditions))
+	assert.Equal(t, OperatorIn, conditions[0].Operator)
+	assert.Equal(t, []any{"ConsoleLogin", "GetSigninToken"}, conditions[0].Value)
+	assert.Equal(t, OperatorCidr, conditions[1].Operator)
+	assert.Equal(t, []any{"10.0.0.0/8"}, conditions[1].Value)
+	assert.Equal(t, OperatorNotExists, conditions[2].Operator)
+	assert.Nil(t, conditions[2].Value)
+}
+
+func TestDecodeInvalidConditions(t *testing.T) {
+	conditions := map[string]string{
+		"unknown operator": `operator = "like"
+value = "x"`,
+		"missing value": `operator = "equals"`,
+		"unexpected value": `operator = "exists"
+value = "x"`,
+		"non numeric comparison": `operator = "gt"
+value = "ten"`,
+		"invalid regex": `operator = "regex"
+value = "["`,
+		"invalid cidr": `operator = "cidr"
+value = ["10.0.0.0/33"]`,
+		"scalar in": `operator = "in"
+value = "x"`,
+	}
+
+	for name, condition := range conditions {
+		t.Run(name, func(t *testing.T) {
+			_, err := Decode("test_policy.hcl", []byte(`
+source "aws_cloudtrail" "account-x" {}
+
+evaluation "aws_cloudtrail" "invalid" {
+  inputs = [source.aws_cloudtrail.account-x]
+
+  condition {
+    path = "$.eventName"
+    `+condition+`
+  }
+}
+`))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDecodeConditionGroups(t *testing.T) {
+	policyHcl := `
+source "aws_cloudtrail" "account-x" {}
+
+evaluation "aws_cloudtrail" "root_login" {
+  inputs = [source.aws_cloudtrail.account-x]
+
+  condition {
+    path = "$.userIdentity.type"
+    value = "Root"
+  }
+
+  any {
+    condition {
+      path = "$.additionalEventData.MFAUsed"
+      value = "No"
+    }
+
+    all {
+      condition {
+        path = "$.eventName"
+        value = "ConsoleLogin"
+      }
+
+      not {
+        condition {
+          path = "$.sourceIPAddress"
+          operator = "cidr"
+          value = ["10.0.0.0/8"]
+        }
+      }
+    }
+  }
+}
+`
+	policy, err := Decode("test_policy.hcl", []byte(policyHcl))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	evaluation := policy.Evaluations[0]
+	assert.Equal(t, 1, len(evaluation.Conditions))
+	assert.Equal(t, 1, len(evaluation.Groups))
+
+	anyGroup := evaluation.Groups[0]
+	assert.Equal(t, GroupAny, anyGroup.Kind)
+	assert.Equal(t, 1, len(anyGroup.Conditions))
+	assert.Equal(t, 1, len(anyGroup.Groups))
+
+	allGroup := anyGroup.Groups[0]
+	assert.Equal(t, GroupAll, allGroup.Kind)
+	assert.Equal(t, "$.eventName", allGroup.Conditions[0].Path)
+	assert.Equal(t, GroupNot, allGroup.Groups[0].Kind)
+	assert.Equal(t, OperatorCidr, allGroup.Groups[0].Conditions[0].Operator)
+}
+
+func TestDecodeEmptyConditionGroup(t *testing.T) {
+	_, err := Decode("test_policy.hcl", []byte(`
+source "aws_cloudtrail" "account-x" {}
+
+evaluation "aws_cloudtrail" "empty" {
+  inputs = [source.aws_cloudtrail.account-x]
+
+  any {}
+}
+`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/afero"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PolicyExtension is the file extension of policy files within storage
+const PolicyExtension = ".hcl"
+
+// Load walks the storage filesystem and decodes every policy file found.
+// Decode errors don't stop the walk, they're collected per file and
+// returned together alongside every policy that decoded successfully
+func Load(storage afero.Fs) ([]*Policy, error) {
+	var paths []string
+	err := afero.Walk(storage, "/", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != PolicyExtension {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk policy storage: %w", err)
+	}
+
+	var policies []*Policy
+	var errs []error
+	for _, path := range paths {
+		// Policies are named by their path relative to the storage root
+		name := strings.TrimPrefix(filepath.ToSlash(path), "/")
+
+		content, err := afero.ReadFile(storage, path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		p, err := Decode(name, content)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		policies = append(policies, p)
+	}
+
+	return policies, errors.Join(errs...)
+}
@@ -0,0 +1,28 @@
+package policy
+
+import (
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	storage := afero.NewMemMapFs()
+	afero.WriteFile(storage, "/root_access.hcl", []byte(`source "aws_cloudtrail" "account-x" {}`), 0644)
+	afero.WriteFile(storage, "/nested/broken.hcl", []byte(`source "aws_cloudtrail" {`), 0644)
+	afero.WriteFile(storage, "/nested/invalid.hcl", []byte(`
+evaluation "aws_cloudtrail" "any_action" {
+  inputs = [source.aws_cloudtrail.missing]
+}
+`), 0644)
+	afero.WriteFile(storage, "/README.md", []byte(`not a policy`), 0644)
+
+	policies, err := Load(storage)
+	assert.Equal(t, 1, len(policies))
+	assert.Equal(t, "root_access.hcl", policies[0].Name)
+
+	// Errors for every broken file are reported together
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "nested/broken.hcl")
+	assert.Contains(t, err.Error(), "nested/invalid.hcl")
+}
@@ -20,17 +20,41 @@ type Source struct {
 	Version string
 }
 
+// Evaluation matches a log when all of its Conditions
+// and all of its Groups hold
 type Evaluation struct {
 	Type       string
 	Name       string
 	Inputs     []Source
 	Conditions []Condition
+	Groups     []ConditionGroup
 	Outputs    []Output
 }
 
+// Condition selects nodes from a parsed log with a JSONPath,
+// and compares them with Value using the Operator
 type Condition struct {
-	Path  string
-	Value string
+	Path     string
+	Operator Operator
+	Value    any
+}
+
+// GroupKind is how a ConditionGroup combines its children
+type GroupKind string
+
+const (
+	GroupAll GroupKind = "all"
+	GroupAny GroupKind = "any"
+	GroupNot GroupKind = "not"
+)
+
+// ConditionGroup is a node of an evaluation's condition tree, decoded
+// from an all, any or not block. A not group negates the conjunction
+// of its children
+type ConditionGroup struct {
+	Kind       GroupKind
+	Conditions []Condition
+	Groups     []ConditionGroup
 }
 
 type Output struct {
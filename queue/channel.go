@@ -0,0 +1,130 @@
+package queue
+
+import (
+	"context"
+	"sync"
+)
+
+// Channel is an in-memory queue, holding each topic in a bounded
+// channel. Publishing to a full topic blocks until a subscriber
+// catches up, so a slow stage applies backpressure to the one before.
+// Messages don't survive a restart, so it suits inline deployments and tests
+type Channel struct {
+	size    int
+	mu      sync.Mutex
+	topics  map[string]chan *Message
+	offsets map[string]int64
+}
+
+var _ Queue = &Channel{}
+
+// channelReceipt marks messages delivered by a Channel
+type channelReceipt struct {
+	queue *Channel
+}
+
+func NewChannel(size int) *Channel {
+	return &Channel{
+		size:    size,
+		topics:  make(map[string]chan *Message),
+		offsets: make(map[string]int64),
+	}
+}
+
+// topic returns the channel for a topic, creating it on first use
+func (c *Channel) topic(name string) chan *Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.topics[name]
+	if !ok {
+		ch = make(chan *Message, c.size)
+		c.topics[name] = ch
+	}
+	return ch
+}
+
+func (c *Channel) Publish(ctx context.Context, msg *Message) error {
+	ch := c.topic(msg.Topic)
+
+	c.mu.Lock()
+	published := *msg
+	published.Offset = c.offsets[msg.Topic]
+	published.receipt = &channelReceipt{queue: c}
+	c.offsets[msg.Topic]++
+	c.mu.Unlock()
+
+	return c.send(ctx, ch, &published)
+}
+
+func (c *Channel) send(ctx context.Context, ch chan *Message, msg *Message) error {
+	select {
+	case ch <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Channel) Subscribe(ctx context.Context, topics []string, handler Handler) error {
+	// Fan the topics in to one channel, so the handler
+	// is called for one message at a time
+	merged := make(chan *Message)
+	for _, name := range topics {
+		go func(ch chan *Message) {
+			for {
+				select {
+				case msg := <-ch:
+					select {
+					case merged <- msg:
+					case <-ctx.Done():
+						// The message was taken from its topic but never
+						// handled, so it goes back for the next subscriber
+						c.Nack(msg)
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(c.topic(name))
+	}
+
+	for {
+		select {
+		case msg := <-merged:
+			if err := handler(ctx, msg); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Ack is a no-op, as messages leave the channel once delivered
+func (c *Channel) Ack(msg *Message) error {
+	if r, ok := msg.receipt.(*channelReceipt); !ok || r.queue != c {
+		return ErrNotConsumed
+	}
+	return nil
+}
+
+// Nack places the message back on its topic, behind any messages
+// already waiting. The subscriber calling Nack may be the only one
+// draining a full topic, so the message is sent in the background
+func (c *Channel) Nack(msg *Message) error {
+	if r, ok := msg.receipt.(*channelReceipt); !ok || r.queue != c {
+		return ErrNotConsumed
+	}
+	go c.send(context.Background(), c.topic(msg.Topic), msg)
+	return nil
+}
+
+// Flush is a no-op, as published messages are already on their topic
+func (c *Channel) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (c *Channel) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestChannel(t *testing.T) {
+	q := NewChannel(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte("first")}))
+	assert.NoError(t, q.Publish(ctx, &Message{Topic: "parsed", Value: []byte("second")}))
+	assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte("third")}))
+
+	received := map[string][]string{}
+	err := q.Subscribe(ctx, []string{"ingest", "parsed"}, func(ctx context.Context, msg *Message) error {
+		received[msg.Topic] = append(received[msg.Topic], string(msg.Value))
+		if len(received["ingest"])+len(received["parsed"]) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "third"}, received["ingest"])
+	assert.Equal(t, []string{"second"}, received["parsed"])
+}
+
+func TestChannelBackpressure(t *testing.T) {
+	q := NewChannel(1)
+	assert.NoError(t, q.Publish(context.Background(), &Message{Topic: "ingest"}))
+
+	// Publishing to a full topic blocks until the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, q.Publish(ctx, &Message{Topic: "ingest"}), context.DeadlineExceeded)
+}
+
+func TestPublishAll(t *testing.T) {
+	q := NewChannel(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Queues that can't publish batches publish each message in turn
+	assert.NoError(t, PublishAll(ctx, q, []*Message{
+		{Topic: "parsed", Value: []byte("first")},
+		{Topic: "parsed", Value: []byte("second")},
+	}))
+	var received []string
+	err := q.Subscribe(ctx, []string{"parsed"}, func(ctx context.Context, msg *Message) error {
+		received = append(received, string(msg.Value))
+		if len(received) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, received)
+
+	// Publishing stops at the first message that can't be published
+	full := NewChannel(1)
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	assert.ErrorIs(t, PublishAll(timeout, full, []*Message{{Topic: "parsed"}, {Topic: "parsed"}}), context.DeadlineExceeded)
+}
+
+func TestChannelNack(t *testing.T) {
+	q := NewChannel(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte("first")}))
+	assert.ErrorIs(t, q.Ack(&Message{Topic: "ingest"}), ErrNotConsumed)
+
+	var received []string
+	err := q.Subscribe(ctx, []string{"ingest"}, func(ctx context.Context, msg *Message) error {
+		received = append(received, string(msg.Value))
+		if len(received) == 1 {
+			return q.Nack(msg)
+		}
+		cancel()
+		return q.Ack(msg)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "first"}, received)
+}
+
+func TestChannelUnsubscribe(t *testing.T) {
+	q := NewChannel(2)
+	assert.NoError(t, q.Publish(context.Background(), &Message{Topic: "ingest", Value: []byte("first")}))
+	assert.NoError(t, q.Publish(context.Background(), &Message{Topic: "ingest", Value: []byte("second")}))
+
+	// Messages read from a topic but not yet handled when the
+	// subscription ends are delivered to the next subscriber
+	for _, expected := range []string{"first", "second"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := q.Subscribe(ctx, []string{"ingest"}, func(ctx context.Context, msg *Message) error {
+			assert.Equal(t, expected, string(msg.Value))
+			cancel()
+			return q.Ack(msg)
+		})
+		assert.NoError(t, err)
+	}
+}
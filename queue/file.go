@@ -0,0 +1,700 @@
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentBytes = 64 * 1024 * 1024
+	segmentExtension    = ".log"
+	offsetsDir          = "offsets"
+	// Each record is prefixed by its length and checksum
+	recordHeaderSize = 8
+)
+
+// File is a durable queue for single node installs. Each topic is an
+// append-only log of segment files under the queue's directory, and
+// consumer groups commit the offset they've acknowledged up to, so
+// uncommitted messages are delivered again after a restart
+type File struct {
+	options FileOptions
+	logger  *zap.Logger
+	mu      sync.Mutex
+	topics  map[string]*topicLog
+}
+
+var _ Queue = &File{}
+
+// fileRecord is the encoded form of a message within a segment
+type fileRecord struct {
+	Value   []byte            `json:"value"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// fileReceipt links a delivered message to its subscription
+type fileReceipt struct {
+	queue        *File
+	subscription *fileSubscription
+}
+
+func NewFile(options FileOptions, logger *zap.Logger) (*File, error) {
+	if options.Dir == "" {
+		return nil, fmt.Errorf("file queue requires a directory")
+	}
+	if options.SegmentBytes <= 0 {
+		options.SegmentBytes = defaultSegmentBytes
+	}
+	options.Commit = options.Commit.withDefaults()
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return &File{
+		options: options,
+		logger:  logger,
+		topics:  make(map[string]*topicLog),
+	}, nil
+}
+
+// topic returns the log for a topic, opening it on first use
+func (f *File) topic(name string) (*topicLog, error) {
+	if name == "" || name == offsetsDir || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid topic name %q", name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if log, ok := f.topics[name]; ok {
+		return log, nil
+	}
+	log, err := openTopicLog(filepath.Join(f.options.Dir, name), f.options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open topic %s: %w", name, err)
+	}
+	f.topics[name] = log
+	return log, nil
+}
+
+func (f *File) Publish(ctx context.Context, msg *Message) error {
+	log, err := f.topic(msg.Topic)
+	if err != nil {
+		return err
+	}
+	_, err = log.append(fileRecord{Value: msg.Value, Headers: msg.Headers})
+	return err
+}
+
+func (f *File) Subscribe(ctx context.Context, topics []string, handler Handler) error {
+	sub := &fileSubscription{
+		rewinds: make(map[string]int64),
+		nacked:  make(map[string]chan struct{}),
+		offsets: newOffsetTracker(),
+	}
+
+	type delivery struct {
+		msg  *Message
+		done chan struct{}
+	}
+
+	// Each topic is read in its own goroutine, waiting for the handler to
+	// return before reading the next message. Handlers may settle messages
+	// later, so a Nack rewinds the reader from wherever it has got to,
+	// waking it if it's waiting for new messages, and offsets are only
+	// committed up to the first unacknowledged message
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	deliveries := make(chan delivery)
+	errs := make(chan error, len(topics))
+	for _, name := range topics {
+		log, err := f.topic(name)
+		if err != nil {
+			return err
+		}
+		sub.logs = append(sub.logs, log)
+		nacked := make(chan struct{}, 1)
+		sub.mu.Lock()
+		sub.nacked[name] = nacked
+		sub.mu.Unlock()
+
+		go func(name string, log *topicLog) {
+			reader := log.reader(log.start(f.options.GroupId))
+			defer reader.close()
+
+			for {
+				if rewind, ok := sub.rewind(name); ok {
+					reader.seek(rewind)
+				}
+
+				offset, record, err := reader.next(ctx, nacked)
+				if errors.Is(err, errReaderWoken) {
+					continue
+				}
+				if err != nil {
+					if ctx.Err() == nil {
+						errs <- fmt.Errorf("failed to read topic %s: %w", name, err)
+					}
+					return
+				}
+
+				sub.offsets.delivered(name, 0, offset)
+				d := delivery{
+					msg: &Message{
+						Topic:   name,
+						Offset:  offset,
+						Value:   record.Value,
+						Headers: record.Headers,
+						receipt: &fileReceipt{queue: f, subscription: sub},
+					},
+					done: make(chan struct{}),
+				}
+				select {
+				case deliveries <- d:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case <-d.done:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(name, log)
+	}
+
+	// Store what's been acknowledged when the subscription ends
+	defer func() {
+		if err := f.commit(sub); err != nil {
+			f.logger.Warn("failed to commit offsets", zap.Error(err))
+		}
+	}()
+	ticker := time.NewTicker(f.options.Commit.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case d := <-deliveries:
+			err := handler(ctx, d.msg)
+			close(d.done)
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := f.commit(sub); err != nil {
+				f.logger.Warn("failed to commit offsets", zap.Error(err))
+			}
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (f *File) receipt(msg *Message) (*fileReceipt, error) {
+	r, ok := msg.receipt.(*fileReceipt)
+	if !ok || r.queue != f {
+		return nil, ErrNotConsumed
+	}
+	return r, nil
+}
+
+// Ack records the consumer group's offset up to the first message not yet
+// acknowledged, to be stored with the subscription's next commit
+func (f *File) Ack(msg *Message) error {
+	r, err := f.receipt(msg)
+	if err != nil {
+		return err
+	}
+	log, err := f.topic(msg.Topic)
+	if err != nil {
+		return err
+	}
+	if offset, ok := r.subscription.offsets.acked(msg.Topic, 0, msg.Offset); ok {
+		log.ack(f.options.GroupId, offset)
+	}
+	if r.subscription.acked() >= f.options.Commit.Messages {
+		return f.commit(r.subscription)
+	}
+	return nil
+}
+
+// commit stores the offsets acknowledged by a subscription, and removes
+// segments that every consumer group has acknowledged
+func (f *File) commit(sub *fileSubscription) error {
+	var errs []error
+	for _, log := range sub.reset() {
+		if err := log.commit(f.options.GroupId); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := log.removeAcknowledged(); err != nil {
+			f.logger.Warn("failed to remove acknowledged segments", zap.String("dir", log.dir), zap.Error(err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Nack rewinds the subscription to the message, so it is delivered again
+func (f *File) Nack(msg *Message) error {
+	r, err := f.receipt(msg)
+	if err != nil {
+		return err
+	}
+	r.subscription.nack(msg.Topic, msg.Offset)
+	return nil
+}
+
+// Flush syncs each topic's active segment to disk
+func (f *File) Flush(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var errs []error
+	for _, log := range f.topics {
+		errs = append(errs, log.sync())
+	}
+	return errors.Join(errs...)
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var errs []error
+	for _, log := range f.topics {
+		errs = append(errs, log.close())
+	}
+	f.topics = make(map[string]*topicLog)
+	return errors.Join(errs...)
+}
+
+// fileSubscription holds the offsets nacked messages are redelivered
+// from, the messages delivered but not yet acknowledged, and the count
+// of messages acknowledged since the last commit
+type fileSubscription struct {
+	mu      sync.Mutex
+	logs    []*topicLog
+	rewinds map[string]int64
+	// nacked wakes a topic's reader to redeliver a nacked message
+	nacked  map[string]chan struct{}
+	offsets *offsetTracker
+	pending int
+}
+
+func (s *fileSubscription) acked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending++
+	return s.pending
+}
+
+// reset starts a new commit batch, returning the subscription's topics
+func (s *fileSubscription) reset() []*topicLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = 0
+	return s.logs
+}
+
+func (s *fileSubscription) nack(topic string, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.rewinds[topic]; !ok || offset < current {
+		s.rewinds[topic] = offset
+	}
+	select {
+	case s.nacked[topic] <- struct{}{}:
+	default:
+	}
+}
+
+func (s *fileSubscription) rewind(topic string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.rewinds[topic]
+	delete(s.rewinds, topic)
+	return offset, ok
+}
+
+// topicLog is the segments and consumer group offsets of one topic
+type topicLog struct {
+	dir     string
+	options FileOptions
+
+	mu sync.Mutex
+	// segments holds the base offset of each segment, in order
+	segments   []int64
+	active     *os.File
+	activeSize int64
+	next       int64
+	// appended is closed and replaced whenever a record is appended
+	appended chan struct{}
+	// committed holds each consumer group's stored offset, which
+	// retention keeps messages from, and acked the offset
+	// acknowledged since, to be stored with the next commit
+	committed map[string]int64
+	acked     map[string]int64
+}
+
+func openTopicLog(dir string, options FileOptions) (*topicLog, error) {
+	if err := os.MkdirAll(filepath.Join(dir, offsetsDir), 0755); err != nil {
+		return nil, err
+	}
+
+	l := &topicLog{
+		dir:       dir,
+		options:   options,
+		appended:  make(chan struct{}),
+		committed: make(map[string]int64),
+		acked:     make(map[string]int64),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != segmentExtension {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, base)
+	}
+	sort.Slice(l.segments, func(i, j int) bool { return l.segments[i] < l.segments[j] })
+	if len(l.segments) == 0 {
+		l.segments = []int64{0}
+	}
+
+	if err := l.recover(); err != nil {
+		return nil, err
+	}
+
+	offsets, err := os.ReadDir(filepath.Join(dir, offsetsDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range offsets {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, offsetsDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset for group %s: %w", entry.Name(), err)
+		}
+		l.committed[entry.Name()] = offset
+	}
+	return l, nil
+}
+
+func (l *topicLog) segmentPath(base int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", base, segmentExtension))
+}
+
+// recover counts the records of the last segment, truncating
+// any partial record left behind by a crash mid-write
+func (l *topicLog) recover() error {
+	base := l.segments[len(l.segments)-1]
+	file, err := os.OpenFile(l.segmentPath(base), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	var position, count int64
+	for {
+		size, _, err := readRecord(file, position)
+		if err != nil {
+			break
+		}
+		position += size
+		count++
+	}
+	if err := file.Truncate(position); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(position, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.active = file
+	l.activeSize = position
+	l.next = base + count
+	return nil
+}
+
+func (l *topicLog) append(record fileRecord) (int64, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return 0, fmt.Errorf("topic log is closed")
+	}
+
+	// Roll over to a new segment once the active one is full
+	if l.activeSize > 0 && l.activeSize+int64(len(buf)) > l.options.SegmentBytes {
+		file, err := os.OpenFile(l.segmentPath(l.next), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return 0, err
+		}
+		l.active.Close()
+		l.active = file
+		l.activeSize = 0
+		l.segments = append(l.segments, l.next)
+	}
+
+	if _, err := l.active.Write(buf); err != nil {
+		return 0, err
+	}
+	if l.options.Sync {
+		if err := l.active.Sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	offset := l.next
+	l.activeSize += int64(len(buf))
+	l.next++
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return offset, nil
+}
+
+// start is the offset a consumer group reads from, the first retained
+// message for groups that haven't acknowledged anything yet
+func (l *topicLog) start(group string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset, ok := l.committed[group]; ok && offset >= l.segments[0] {
+		return offset
+	}
+	// Hold the group's place, so retention keeps its messages
+	l.committed[group] = l.segments[0]
+	return l.segments[0]
+}
+
+// ack records the offset a consumer group has acknowledged up to,
+// which is stored with the group's next commit
+func (l *topicLog) ack(group string, offset int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset > l.acked[group] {
+		l.acked[group] = offset
+	}
+}
+
+// commit stores the offset a consumer group has acknowledged up to
+func (l *topicLog) commit(group string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offset, ok := l.acked[group]
+	if !ok || offset <= l.committed[group] {
+		return nil
+	}
+	l.committed[group] = offset
+
+	path := filepath.Join(l.dir, offsetsDir, group)
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// removeAcknowledged deletes segments whose messages have
+// been acknowledged by every consumer group
+func (l *topicLog) removeAcknowledged() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.committed) == 0 {
+		return nil
+	}
+	low := l.next
+	for _, offset := range l.committed {
+		if offset < low {
+			low = offset
+		}
+	}
+
+	var errs []error
+	for len(l.segments) > 1 && l.segments[1] <= low {
+		if err := os.Remove(l.segmentPath(l.segments[0])); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		l.segments = l.segments[1:]
+	}
+	return errors.Join(errs...)
+}
+
+func (l *topicLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return nil
+	}
+	return l.active.Sync()
+}
+
+func (l *topicLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return nil
+	}
+	err := l.active.Close()
+	l.active = nil
+	return err
+}
+
+// state returns the next offset to be written, the segment
+// holding an offset, and a channel closed on the next append
+func (l *topicLog) state(offset int64) (next int64, segment int64, segmentEnd int64, appended chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i] > offset }) - 1
+	if i < 0 {
+		i = 0
+	}
+	segmentEnd = l.next
+	if i+1 < len(l.segments) {
+		segmentEnd = l.segments[i+1]
+	}
+	return l.next, l.segments[i], segmentEnd, l.appended
+}
+
+func (l *topicLog) reader(offset int64) *topicReader {
+	return &topicReader{log: l, offset: offset, segment: -1}
+}
+
+// topicReader reads a topic's records in order, across segments
+type topicReader struct {
+	log      *topicLog
+	offset   int64
+	segment  int64
+	file     *os.File
+	position int64
+}
+
+func (r *topicReader) seek(offset int64) {
+	r.offset = offset
+	r.close()
+}
+
+func (r *topicReader) close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	r.segment = -1
+}
+
+// errReaderWoken is returned by a reader woken while waiting for a record
+var errReaderWoken = errors.New("topic reader woken")
+
+// next returns the record at the reader's offset, waiting for it to be
+// appended if need be. Waiting ends early when wake receives
+func (r *topicReader) next(ctx context.Context, wake <-chan struct{}) (int64, fileRecord, error) {
+	for {
+		next, segment, segmentEnd, appended := r.log.state(r.offset)
+		if r.offset < segment {
+			// The offset was removed by retention, skip ahead
+			r.seek(segment)
+			continue
+		}
+		if r.offset >= next {
+			select {
+			case <-appended:
+				continue
+			case <-wake:
+				return 0, fileRecord{}, errReaderWoken
+			case <-ctx.Done():
+				return 0, fileRecord{}, ctx.Err()
+			}
+		}
+
+		if r.segment != segment || r.offset >= segmentEnd {
+			if err := r.open(segment); err != nil {
+				return 0, fileRecord{}, err
+			}
+		}
+
+		size, record, err := readRecord(r.file, r.position)
+		if err != nil {
+			return 0, fileRecord{}, err
+		}
+		r.position += size
+		offset := r.offset
+		r.offset++
+		return offset, record, nil
+	}
+}
+
+// open opens a segment, skipping records ahead of the reader's offset
+func (r *topicReader) open(segment int64) error {
+	r.close()
+	file, err := os.Open(r.log.segmentPath(segment))
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.segment = segment
+	r.position = 0
+	for offset := segment; offset < r.offset; offset++ {
+		size, _, err := readRecord(file, r.position)
+		if err != nil {
+			return err
+		}
+		r.position += size
+	}
+	return nil
+}
+
+// readRecord reads the record at a position, returning its size on disk
+func readRecord(file *os.File, position int64) (int64, fileRecord, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, position); err != nil {
+		return 0, fileRecord{}, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, position+recordHeaderSize); err != nil {
+		return 0, fileRecord{}, err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return 0, fileRecord{}, fmt.Errorf("corrupt record at position %d", position)
+	}
+
+	var record fileRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return 0, fileRecord{}, err
+	}
+	return recordHeaderSize + int64(length), record, nil
+}
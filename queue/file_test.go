@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// consume reads count messages from the topic, acknowledging each
+func consume(t *testing.T, q Queue, topic string, count int) []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var received []string
+	err := q.Subscribe(ctx, []string{topic}, func(ctx context.Context, msg *Message) error {
+		received = append(received, string(msg.Value))
+		if len(received) == count {
+			cancel()
+		}
+		return q.Ack(msg)
+	})
+	assert.NoError(t, err)
+	return received
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFile(FileOptions{Dir: dir, GroupId: "kytheron"}, zap.NewNop())
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	for _, value := range []string{"first", "second", "third"} {
+		assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte(value), Headers: map[string]string{"source": "test"}}))
+	}
+	assert.Equal(t, []string{"first", "second"}, consume(t, q, "ingest", 2))
+	assert.NoError(t, q.Close())
+
+	// Reopening resumes after the last acknowledged message
+	q, err = NewFile(FileOptions{Dir: dir, GroupId: "kytheron"}, zap.NewNop())
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte("fourth")}))
+	assert.Equal(t, []string{"third", "fourth"}, consume(t, q, "ingest", 2))
+
+	// Other groups read the topic from the start
+	other, err := NewFile(FileOptions{Dir: dir, GroupId: "replay"}, zap.NewNop())
+	assert.NoError(t, err)
+	defer other.Close()
+	assert.Equal(t, []string{"first", "second", "third", "fourth"}, consume(t, other, "ingest", 4))
+}
+
+func TestFileNack(t *testing.T) {
+	q, err := NewFile(FileOptions{Dir: t.TempDir(), GroupId: "kytheron"}, zap.NewNop())
+	assert.NoError(t, err)
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte("first")}))
+	assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte("second")}))
+
+	var received []string
+	err = q.Subscribe(ctx, []string{"ingest"}, func(ctx context.Context, msg *Message) error {
+		received = append(received, string(msg.Value))
+		if len(received) == 1 {
+			return q.Nack(msg)
+		}
+		if len(received) == 3 {
+			cancel()
+		}
+		return q.Ack(msg)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "first", "second"}, received)
+}
+
+func TestFileSegments(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFile(FileOptions{Dir: dir, GroupId: "kytheron", SegmentBytes: 32}, zap.NewNop())
+	assert.NoError(t, err)
+	defer q.Close()
+
+	ctx := context.Background()
+	for _, value := range []string{"first", "second", "third"} {
+		assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte(value)}))
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "ingest", "*.log"))
+	assert.Equal(t, 3, len(segments))
+
+	// Acknowledged segments are removed, leaving the active one
+	assert.Equal(t, []string{"first", "second", "third"}, consume(t, q, "ingest", 3))
+	segments, _ = filepath.Glob(filepath.Join(dir, "ingest", "*.log"))
+	assert.Equal(t, []string{filepath.Join(dir, "ingest", "00000000000000000002.log")}, segments)
+}
+
+func TestFileTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFile(FileOptions{Dir: dir, GroupId: "kytheron"}, zap.NewNop())
+	assert.NoError(t, err)
+	assert.NoError(t, q.Publish(context.Background(), &Message{Topic: "ingest", Value: []byte("first")}))
+	assert.NoError(t, q.Close())
+
+	// A crash part way through a write leaves a partial record behind
+	segment, err := os.OpenFile(filepath.Join(dir, "ingest", "00000000000000000000.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = segment.Write([]byte{0, 0, 0, 40, 1, 2})
+	assert.NoError(t, err)
+	segment.Close()
+
+	q, err = NewFile(FileOptions{Dir: dir, GroupId: "kytheron"}, zap.NewNop())
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.NoError(t, q.Publish(context.Background(), &Message{Topic: "ingest", Value: []byte("second")}))
+	assert.Equal(t, []string{"first", "second"}, consume(t, q, "ingest", 2))
+}
+
+func TestFileCommitBatch(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFile(FileOptions{Dir: dir, GroupId: "kytheron", Commit: CommitOptions{Messages: 2, Interval: time.Hour}}, zap.NewNop())
+	assert.NoError(t, err)
+	defer q.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, value := range []string{"first", "second", "third"} {
+		assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte(value)}))
+	}
+
+	offsets := filepath.Join(dir, "ingest", "offsets", "kytheron")
+	committed := func() string {
+		content, _ := os.ReadFile(offsets)
+		return string(content)
+	}
+
+	var seen []string
+	err = q.Subscribe(ctx, []string{"ingest"}, func(ctx context.Context, msg *Message) error {
+		assert.NoError(t, q.Ack(msg))
+		seen = append(seen, committed())
+		if len(seen) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	// Offsets are committed once the batch is full, and when the subscription ends
+	assert.Equal(t, []string{"", "2", "2"}, seen)
+	assert.Equal(t, "3", committed())
+}
+
+func TestFileAckOutOfOrder(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewFile(FileOptions{Dir: dir, GroupId: "kytheron", Commit: CommitOptions{Messages: 1, Interval: time.Hour}}, zap.NewNop())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, value := range []string{"first", "second"} {
+		assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte(value)}))
+	}
+
+	// The first message is still being handled when the second is acknowledged
+	var first *Message
+	err = q.Subscribe(ctx, []string{"ingest"}, func(ctx context.Context, msg *Message) error {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if msg.Offset == 0 {
+			first = msg
+			return nil
+		}
+		assert.NoError(t, q.Ack(msg))
+		assert.NoError(t, q.Nack(first))
+		cancel()
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, q.Close())
+
+	// Nothing is committed past the nacked message, so both are delivered again
+	_, err = os.Stat(filepath.Join(dir, "ingest", "offsets", "kytheron"))
+	assert.True(t, os.IsNotExist(err))
+	q, err = NewFile(FileOptions{Dir: dir, GroupId: "kytheron"}, zap.NewNop())
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, []string{"first", "second"}, consume(t, q, "ingest", 2))
+}
+
+func TestFileNackIdle(t *testing.T) {
+	q, err := NewFile(FileOptions{Dir: t.TempDir(), GroupId: "kytheron"}, zap.NewNop())
+	assert.NoError(t, err)
+	defer q.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, q.Publish(ctx, &Message{Topic: "ingest", Value: []byte("first")}))
+
+	// The last message on the topic is nacked once its handler has
+	// returned, and is redelivered without waiting for another
+	var received []string
+	err = q.Subscribe(ctx, []string{"ingest"}, func(ctx context.Context, msg *Message) error {
+		received = append(received, string(msg.Value))
+		if len(received) == 1 {
+			time.AfterFunc(20*time.Millisecond, func() { q.Nack(msg) })
+			return nil
+		}
+		cancel()
+		return q.Ack(msg)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "first"}, received)
+}
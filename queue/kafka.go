@@ -0,0 +1,384 @@
+//go:build !nokafka
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// closeFlushTimeout bounds the wait for deliveries
+// when closing a queue that hasn't been flushed
+const closeFlushTimeout = 15 * time.Second
+
+// Kafka is a queue backed by Kafka topics. Offsets are only committed
+// for acknowledged messages, so a restarted consumer resumes after the
+// last message it finished. Builds with the nokafka tag leave it out,
+// which removes the cgo dependency on librdkafka
+type Kafka struct {
+	options  KafkaOptions
+	producer *kafka.Producer
+	logger   *zap.Logger
+
+	// consumers holds the open subscriptions' consumers, for their lag
+	mu        sync.Mutex
+	consumers map[*kafka.Consumer]struct{}
+}
+
+var (
+	_ Queue          = &Kafka{}
+	_ Pinger         = &Kafka{}
+	_ LagReporter    = &Kafka{}
+	_ BatchPublisher = &Kafka{}
+)
+
+func NewKafka(options KafkaOptions, logger *zap.Logger) (*Kafka, error) {
+	producer, err := kafka.NewProducer(clientConfig(options.Producer, kafka.ConfigMap{
+		"bootstrap.servers": options.Url,
+	}, nil))
+	if err != nil {
+		return nil, err
+	}
+	options.Commit = options.Commit.withDefaults()
+	k := &Kafka{options: options, producer: producer, logger: logger, consumers: make(map[*kafka.Consumer]struct{})}
+	go k.logEvents()
+	return k, nil
+}
+
+// logEvents logs the producer's events that aren't delivery reports,
+// which are sent to the channel passed when publishing
+func (k *Kafka) logEvents() {
+	for e := range k.producer.Events() {
+		switch ev := e.(type) {
+		case kafka.Error:
+			k.logger.Warn("kafka producer error", zap.Error(ev))
+		default:
+			k.logger.Debug("kafka producer event", zap.String("event", ev.String()))
+		}
+	}
+}
+
+// Publish returns once the broker has acknowledged the message
+func (k *Kafka) Publish(ctx context.Context, msg *Message) error {
+	return k.PublishBatch(ctx, []*Message{msg})
+}
+
+// PublishBatch produces every message before waiting for their delivery
+// reports, returning once the broker has acknowledged them all, so a
+// batch waits for a single round trip rather than one per message
+func (k *Kafka) PublishBatch(ctx context.Context, msgs []*Message) error {
+	delivery := make(chan kafka.Event, len(msgs))
+	produced := 0
+	var errs []error
+	for _, msg := range msgs {
+		var headers []kafka.Header
+		for key, value := range msg.Headers {
+			headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+		}
+
+		topic := msg.Topic
+		if err := k.producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          msg.Value,
+			Headers:        headers,
+		}, delivery); err != nil {
+			// Still wait for the messages already produced
+			errs = append(errs, err)
+			break
+		}
+		produced++
+	}
+
+	for ; produced > 0; produced-- {
+		select {
+		case e := <-delivery:
+			if m, ok := e.(*kafka.Message); !ok {
+				errs = append(errs, fmt.Errorf("unexpected delivery event: %s", e))
+			} else if m.TopicPartition.Error != nil {
+				errs = append(errs, m.TopicPartition.Error)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (k *Kafka) Subscribe(ctx context.Context, topics []string, handler Handler) error {
+	c, err := kafka.NewConsumer(clientConfig(k.options.Consumer, kafka.ConfigMap{
+		"bootstrap.servers": k.options.Url,
+		"auto.offset.reset": k.options.OffsetReset,
+	}, kafka.ConfigMap{
+		// Offsets are stored on Ack, and committed in batches
+		"group.id":                 k.options.GroupId,
+		"enable.auto.commit":       "false",
+		"enable.auto.offset.store": "false",
+	}))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	sub := &kafkaSubscription{consumer: c, options: k.options.Commit, offsets: newOffsetTracker(), committed: time.Now(), logger: k.logger}
+	// Commit what's been handled before partitions move to another consumer
+	rebalance := func(c *kafka.Consumer, e kafka.Event) error {
+		if revoked, ok := e.(kafka.RevokedPartitions); ok {
+			sub.commit()
+			for _, tp := range revoked.Partitions {
+				if tp.Topic != nil {
+					sub.offsets.forget(*tp.Topic, tp.Partition)
+				}
+			}
+		}
+		return nil
+	}
+	if err := c.SubscribeTopics(topics, rebalance); err != nil {
+		return err
+	}
+	defer sub.commit()
+
+	k.mu.Lock()
+	k.consumers[c] = struct{}{}
+	k.mu.Unlock()
+	defer func() {
+		k.mu.Lock()
+		delete(k.consumers, c)
+		k.mu.Unlock()
+	}()
+
+	for ctx.Err() == nil {
+		if sub.due() {
+			sub.commit()
+		}
+
+		msg, err := c.ReadMessage(time.Second)
+		if err != nil {
+			// The client will automatically try to recover from all errors.
+			// Timeout is not considered an error because it is raised by
+			// ReadMessage in absence of messages.
+			var kafkaErr kafka.Error
+			if errors.As(err, &kafkaErr) && kafkaErr.IsTimeout() {
+				continue
+			}
+			if kafkaErr.IsFatal() {
+				return err
+			}
+			k.logger.Warn("failed to read message", zap.Error(err), zap.Strings("topics", topics))
+			continue
+		}
+
+		if msg.TopicPartition.Topic != nil {
+			sub.offsets.delivered(*msg.TopicPartition.Topic, msg.TopicPartition.Partition, int64(msg.TopicPartition.Offset))
+		}
+		if err := handler(ctx, fromKafka(sub, msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientConfig applies the configured properties over the defaults,
+// and the required properties over both
+func clientConfig(properties map[string]string, defaults, required kafka.ConfigMap) *kafka.ConfigMap {
+	config := kafka.ConfigMap{}
+	for key, value := range defaults {
+		config[key] = value
+	}
+	for key, value := range properties {
+		config[key] = value
+	}
+	for key, value := range required {
+		config[key] = value
+	}
+	return &config
+}
+
+// kafkaSubscription batches the commits of a consumer's stored offsets
+type kafkaSubscription struct {
+	consumer *kafka.Consumer
+	options  CommitOptions
+	offsets  *offsetTracker
+	logger   *zap.Logger
+
+	mu        sync.Mutex
+	pending   int
+	committed time.Time
+}
+
+// ack stores the partition's offset up to the first message not yet
+// acknowledged, committing the batch once it's full
+func (s *kafkaSubscription) ack(msg *kafka.Message) error {
+	tp := msg.TopicPartition
+	if tp.Topic == nil {
+		return nil
+	}
+	offset, ok := s.offsets.acked(*tp.Topic, tp.Partition, int64(tp.Offset))
+	if !ok {
+		// The partition has been revoked, its messages are read again by its new consumer
+		return nil
+	}
+	if _, err := s.consumer.StoreOffsets([]kafka.TopicPartition{{
+		Topic:     tp.Topic,
+		Partition: tp.Partition,
+		Offset:    kafka.Offset(offset),
+	}}); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.pending++
+	full := s.pending >= s.options.Messages
+	s.mu.Unlock()
+	if full {
+		s.commit()
+	}
+	return nil
+}
+
+// due reports whether acknowledged offsets have waited a full interval
+func (s *kafkaSubscription) due() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending > 0 && time.Since(s.committed) >= s.options.Interval
+}
+
+func (s *kafkaSubscription) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == 0 {
+		return
+	}
+	if _, err := s.consumer.Commit(); err != nil {
+		var kafkaErr kafka.Error
+		if !errors.As(err, &kafkaErr) || kafkaErr.Code() != kafka.ErrNoOffset {
+			// Stored offsets are kept, and committed with the next batch
+			s.logger.Warn("failed to commit offsets", zap.Error(err))
+			return
+		}
+	}
+	s.pending = 0
+	s.committed = time.Now()
+}
+
+// kafkaReceipt links a delivered message to its subscription
+type kafkaReceipt struct {
+	subscription *kafkaSubscription
+	msg          *kafka.Message
+}
+
+func (k *Kafka) receipt(msg *Message) (*kafkaReceipt, error) {
+	r, ok := msg.receipt.(*kafkaReceipt)
+	if !ok {
+		return nil, ErrNotConsumed
+	}
+	return r, nil
+}
+
+// Ack stores the message's offset, to be committed with the next batch
+func (k *Kafka) Ack(msg *Message) error {
+	r, err := k.receipt(msg)
+	if err != nil {
+		return err
+	}
+	return r.subscription.ack(r.msg)
+}
+
+// Nack seeks the partition back to the message, so it is read again.
+// Its offset stays unacknowledged, holding back the partition's commits
+func (k *Kafka) Nack(msg *Message) error {
+	r, err := k.receipt(msg)
+	if err != nil {
+		return err
+	}
+	_, err = r.subscription.consumer.SeekPartitions([]kafka.TopicPartition{r.msg.TopicPartition})
+	return err
+}
+
+// Flush waits for the producer's outstanding messages to be delivered
+func (k *Kafka) Flush(ctx context.Context) error {
+	for k.producer.Flush(100) > 0 {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%d messages not delivered: %w", k.producer.Len(), ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Ping fetches the cluster's metadata, checking a broker is reachable
+func (k *Kafka) Ping(ctx context.Context) error {
+	timeout := 10 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		return context.DeadlineExceeded
+	}
+	_, err := k.producer.GetMetadata(nil, false, int(timeout.Milliseconds()))
+	return err
+}
+
+// Lag returns, for each assigned partition, the messages between its
+// position and its high watermark. Watermarks are those last seen by
+// the consumers, so no requests are made to the brokers
+func (k *Kafka) Lag(ctx context.Context) ([]PartitionLag, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var lag []PartitionLag
+	for c := range k.consumers {
+		assigned, err := c.Assignment()
+		if err != nil {
+			return nil, err
+		}
+		positions, err := c.Position(assigned)
+		if err != nil {
+			return nil, err
+		}
+		for _, tp := range positions {
+			// Partitions not yet read from have no position
+			if tp.Topic == nil || tp.Offset < 0 {
+				continue
+			}
+			_, high, err := c.GetWatermarkOffsets(*tp.Topic, tp.Partition)
+			if err != nil || high < 0 {
+				continue
+			}
+			lag = append(lag, PartitionLag{
+				Topic:     *tp.Topic,
+				Partition: tp.Partition,
+				Lag:       max(high-int64(tp.Offset), 0),
+			})
+		}
+	}
+	return lag, nil
+}
+
+func (k *Kafka) Close() error {
+	// Wait for message deliveries before shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+	defer cancel()
+	err := k.Flush(ctx)
+	k.producer.Close()
+	return err
+}
+
+func fromKafka(sub *kafkaSubscription, msg *kafka.Message) *Message {
+	m := &Message{
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
+		Value:     msg.Value,
+		Headers:   make(map[string]string, len(msg.Headers)),
+		receipt:   &kafkaReceipt{subscription: sub, msg: msg},
+	}
+	if msg.TopicPartition.Topic != nil {
+		m.Topic = *msg.TopicPartition.Topic
+	}
+	for _, header := range msg.Headers {
+		m.Headers[header.Key] = string(header.Value)
+	}
+	return m
+}
@@ -0,0 +1,21 @@
+//go:build nokafka
+
+package queue
+
+import (
+	"errors"
+	"go.uber.org/zap"
+)
+
+// ErrKafkaDisabled is returned when creating a Kafka
+// queue in a build with the nokafka tag
+var ErrKafkaDisabled = errors.New("kafka support is not included in this build")
+
+// Kafka is unavailable in builds with the nokafka tag
+type Kafka struct {
+	Queue
+}
+
+func NewKafka(options KafkaOptions, logger *zap.Logger) (*Kafka, error) {
+	return nil, ErrKafkaDisabled
+}
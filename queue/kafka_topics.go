@@ -0,0 +1,136 @@
+//go:build !nokafka
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+const retentionConfig = "retention.ms"
+
+var _ Provisioner = &Kafka{}
+
+// Provision creates the topics missing from the cluster. Existing topics
+// aren't altered, but a warning is logged for settings differing from
+// their spec, as partitions and replicas are costly to change under load
+func (k *Kafka) Provision(ctx context.Context, topics []TopicSpec) error {
+	admin, err := kafka.NewAdminClientFromProducer(k.producer)
+	if err != nil {
+		return fmt.Errorf("failed to create admin client: %w", err)
+	}
+	defer admin.Close()
+
+	names := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		names = append(names, topic.Name)
+	}
+	described, err := admin.DescribeTopics(ctx, kafka.NewTopicCollectionOfTopicNames(names))
+	if err != nil {
+		return fmt.Errorf("failed to describe topics: %w", err)
+	}
+	existing := make(map[string]kafka.TopicDescription)
+	for _, description := range described.TopicDescriptions {
+		switch description.Error.Code() {
+		case kafka.ErrNoError:
+			existing[description.Name] = description
+		case kafka.ErrUnknownTopicOrPart, kafka.ErrUnknownTopic:
+		default:
+			return fmt.Errorf("failed to describe topic %s: %w", description.Name, description.Error)
+		}
+	}
+
+	var create []kafka.TopicSpecification
+	for _, topic := range topics {
+		description, ok := existing[topic.Name]
+		if !ok {
+			create = append(create, topicSpecification(topic))
+			continue
+		}
+		if err := k.checkTopic(ctx, admin, topic, description); err != nil {
+			return err
+		}
+	}
+	if len(create) == 0 {
+		return nil
+	}
+
+	results, err := admin.CreateTopics(ctx, create)
+	if err != nil {
+		return fmt.Errorf("failed to create topics: %w", err)
+	}
+	var errs []error
+	for _, result := range results {
+		switch result.Error.Code() {
+		case kafka.ErrNoError:
+			k.logger.Info("created topic", zap.String("topic", result.Topic))
+		case kafka.ErrTopicAlreadyExists:
+			// Another instance created it first
+		default:
+			errs = append(errs, fmt.Errorf("failed to create topic %s: %w", result.Topic, result.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func topicSpecification(topic TopicSpec) kafka.TopicSpecification {
+	// -1 leaves the setting to the broker's default
+	spec := kafka.TopicSpecification{Topic: topic.Name, NumPartitions: -1, ReplicationFactor: -1}
+	if topic.Partitions > 0 {
+		spec.NumPartitions = topic.Partitions
+	}
+	if topic.ReplicationFactor > 0 {
+		spec.ReplicationFactor = topic.ReplicationFactor
+	}
+	if topic.Retention > 0 {
+		spec.Config = map[string]string{retentionConfig: strconv.FormatInt(topic.Retention.Milliseconds(), 10)}
+	}
+	return spec
+}
+
+// checkTopic warns about the settings of an existing topic differing from its spec
+func (k *Kafka) checkTopic(ctx context.Context, admin *kafka.AdminClient, topic TopicSpec, description kafka.TopicDescription) error {
+	logger := k.logger.With(zap.String("topic", topic.Name))
+
+	if topic.Partitions > 0 && len(description.Partitions) != topic.Partitions {
+		logger.Warn("topic partitions differ from configuration",
+			zap.Int("partitions", len(description.Partitions)),
+			zap.Int("configured", topic.Partitions),
+		)
+	}
+	if topic.ReplicationFactor > 0 && len(description.Partitions) > 0 && len(description.Partitions[0].Replicas) != topic.ReplicationFactor {
+		logger.Warn("topic replication factor differs from configuration",
+			zap.Int("replicationFactor", len(description.Partitions[0].Replicas)),
+			zap.Int("configured", topic.ReplicationFactor),
+		)
+	}
+
+	if topic.Retention <= 0 {
+		return nil
+	}
+	results, err := admin.DescribeConfigs(ctx, []kafka.ConfigResource{{Type: kafka.ResourceTopic, Name: topic.Name}})
+	if err != nil {
+		return fmt.Errorf("failed to describe config of topic %s: %w", topic.Name, err)
+	}
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError {
+			return fmt.Errorf("failed to describe config of topic %s: %w", topic.Name, result.Error)
+		}
+		retention, ok := result.Config[retentionConfig]
+		if !ok {
+			continue
+		}
+		configured := strconv.FormatInt(topic.Retention.Milliseconds(), 10)
+		if retention.Value != configured {
+			logger.Warn("topic retention differs from configuration",
+				zap.String("retentionMs", retention.Value),
+				zap.String("configuredMs", configured),
+			)
+		}
+	}
+	return nil
+}
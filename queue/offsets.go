@@ -0,0 +1,74 @@
+package queue
+
+import "sync"
+
+// offsetTracker follows the messages delivered from each partition until
+// they're acknowledged. Messages are settled out of order, so the offset
+// committed for a partition is its low watermark: the first message that
+// hasn't been acknowledged, which keeps nacked and in flight messages
+// from being skipped after a restart
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionOffsets
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets holds the offsets delivered but not yet acknowledged,
+// and the offset after the highest acknowledged message
+type partitionOffsets struct {
+	outstanding map[int64]struct{}
+	acked       int64
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[partitionKey]*partitionOffsets)}
+}
+
+// delivered records a message handed to the subscription's handler
+func (t *offsetTracker) delivered(topic string, partition int32, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := partitionKey{topic: topic, partition: partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionOffsets{outstanding: make(map[int64]struct{})}
+		t.partitions[key] = p
+	}
+	p.outstanding[offset] = struct{}{}
+}
+
+// acked records an acknowledged message, returning the offset every
+// message before has been acknowledged up to. It reports false for
+// partitions that are no longer tracked
+func (t *offsetTracker) acked(topic string, partition int32, offset int64) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.partitions[partitionKey{topic: topic, partition: partition}]
+	if !ok {
+		return 0, false
+	}
+	delete(p.outstanding, offset)
+	if offset+1 > p.acked {
+		p.acked = offset + 1
+	}
+
+	watermark := p.acked
+	for outstanding := range p.outstanding {
+		if outstanding < watermark {
+			watermark = outstanding
+		}
+	}
+	return watermark, true
+}
+
+// forget stops tracking a partition, once it's been
+// revoked and its messages belong to another consumer
+func (t *offsetTracker) forget(topic string, partition int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.partitions, partitionKey{topic: topic, partition: partition})
+}
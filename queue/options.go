@@ -0,0 +1,54 @@
+package queue
+
+import "time"
+
+// CommitOptions batches the offsets committed for acknowledged
+// messages. Offsets are committed once either limit is reached, and
+// when a subscription ends, so a crash redelivers at most a batch
+type CommitOptions struct {
+	// Messages acknowledged before committing
+	Messages int
+	// Interval between commits of acknowledged messages
+	Interval time.Duration
+}
+
+const (
+	defaultCommitMessages = 100
+	defaultCommitInterval = time.Second
+)
+
+func (o CommitOptions) withDefaults() CommitOptions {
+	if o.Messages <= 0 {
+		o.Messages = defaultCommitMessages
+	}
+	if o.Interval <= 0 {
+		o.Interval = defaultCommitInterval
+	}
+	return o
+}
+
+// KafkaOptions configures the Kafka cluster behind a queue
+type KafkaOptions struct {
+	Url     string
+	GroupId string
+	// OffsetReset is where a new consumer group starts reading from
+	OffsetReset string
+	Commit      CommitOptions
+	// Producer and Consumer hold librdkafka properties for the
+	// queue's clients, such as those securing the connection
+	Producer map[string]string
+	Consumer map[string]string
+}
+
+// FileOptions configures the directory holding a file queue
+type FileOptions struct {
+	Dir     string
+	GroupId string
+	// SegmentBytes is the size a topic's segment grows to before
+	// a new one is started. Segments are removed once every consumer
+	// group has acknowledged all of their messages
+	SegmentBytes int64
+	// Sync flushes each published message to disk before returning
+	Sync   bool
+	Commit CommitOptions
+}
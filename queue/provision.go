@@ -0,0 +1,24 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// TopicSpec describes a topic to provision. Zero values
+// leave the setting to the broker's defaults
+type TopicSpec struct {
+	Name              string
+	Partitions        int
+	ReplicationFactor int
+	Retention         time.Duration
+}
+
+// Provisioner is implemented by queues whose topics must be
+// created before they're used. Queues creating topics on
+// first use, such as the channel and file queues, don't
+type Provisioner interface {
+	// Provision creates missing topics, and checks the
+	// settings of existing ones match their spec
+	Provision(ctx context.Context, topics []TopicSpec) error
+}
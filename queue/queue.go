@@ -0,0 +1,94 @@
+package queue
+
+// This package carries messages between the stages of the
+// pipeline. Kafka is used for larger deployments, while smaller
+// ones can pass messages inline over bounded channels, or through
+// a durable log on the local filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNotConsumed is returned when acknowledging a message
+// that wasn't delivered by a subscription to the queue
+var ErrNotConsumed = errors.New("message was not consumed from this queue")
+
+// Message is a record published to, or consumed from, a topic
+type Message struct {
+	Topic string
+	// Partition and Offset locate the message within its topic,
+	// and are set by the queue when the message is consumed
+	Partition int32
+	Offset    int64
+	Value     []byte
+	Headers   map[string]string
+
+	// receipt is set by the queue that delivered the
+	// message, so it can be acknowledged later
+	receipt any
+}
+
+func (m *Message) String() string {
+	return fmt.Sprintf("%s[%d]@%d", m.Topic, m.Partition, m.Offset)
+}
+
+// Pinger is implemented by queues relying on a broker,
+// which can check the broker is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// PartitionLag is how many messages a consumer is behind the end of a partition
+type PartitionLag struct {
+	Topic     string
+	Partition int32
+	Lag       int64
+}
+
+// LagReporter is implemented by queues that can tell how many
+// messages their consumers are behind the end of each partition
+type LagReporter interface {
+	Lag(ctx context.Context) ([]PartitionLag, error)
+}
+
+// BatchPublisher is implemented by queues that can publish
+// several messages at once, waiting for them to be delivered together
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, msgs []*Message) error
+}
+
+// PublishAll places the messages on their topics, as one
+// batch when the queue can publish them together
+func PublishAll(ctx context.Context, q Queue, msgs []*Message) error {
+	if publisher, ok := q.(BatchPublisher); ok {
+		return publisher.PublishBatch(ctx, msgs)
+	}
+	for _, msg := range msgs {
+		if err := q.Publish(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler processes a message consumed from a topic
+type Handler func(ctx context.Context, msg *Message) error
+
+type Queue interface {
+	// Publish places the message on its topic
+	Publish(ctx context.Context, msg *Message) error
+	// Subscribe calls the handler for each message on the topics, until
+	// the context is cancelled or the handler returns an error. Handlers
+	// are called one message at a time, and should Ack or Nack each message
+	Subscribe(ctx context.Context, topics []string, handler Handler) error
+	// Ack marks a consumed message as processed, so it isn't delivered again
+	Ack(msg *Message) error
+	// Nack marks a consumed message as failed, so it is delivered again
+	Nack(msg *Message) error
+	// Flush waits for published messages to be delivered,
+	// or until the context expires
+	Flush(ctx context.Context) error
+	Close() error
+}
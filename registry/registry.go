@@ -7,7 +7,9 @@ import (
 	"encoding/json"
 	"fmt"
 	pb "github.com/kytheron-org/kytheron-plugin-go/plugin"
+	"github.com/kytheron-org/kytheron/tracing"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"io"
 	"log"
 	"net/http"
@@ -15,6 +17,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -36,6 +40,27 @@ type PluginRegistry struct {
 	parsers   map[string]pb.ParserPluginClient
 	outputs   map[string]pb.OutputPluginClient
 	processes map[string]*exec.Cmd
+	// loaded records each plugin's version, path and connection
+	loaded map[string]loadedPlugin
+	// exited holds the result of plugin processes that have exited
+	exited map[string]error
+}
+
+type loadedPlugin struct {
+	version string
+	path    string
+	conn    *grpc.ClientConn
+}
+
+// PluginStatus describes a loaded plugin and its connection
+type PluginStatus struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	// State is the gRPC connectivity state of the plugin's connection
+	State   string `json:"state"`
+	Running bool   `json:"running"`
+	Healthy bool   `json:"healthy"`
 }
 
 // Plugin Manifest (similar to Terraform's provider manifest)
@@ -65,6 +90,8 @@ func NewPluginRegistry(cacheDir string) *PluginRegistry {
 		outputs:   make(map[string]pb.OutputPluginClient),
 		plugins:   make(map[string]pb.PluginClient),
 		processes: make(map[string]*exec.Cmd),
+		loaded:    make(map[string]loadedPlugin),
+		exited:    make(map[string]error),
 	}
 }
 
@@ -78,6 +105,16 @@ func (r *PluginRegistry) Parser(name string) (pb.ParserPluginClient, error) {
 	return val, nil
 }
 
+func (r *PluginRegistry) Output(name string) (pb.OutputPluginClient, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	val, ok := r.outputs[name]
+	if !ok {
+		return nil, fmt.Errorf("no output plugin client for %s", name)
+	}
+	return val, nil
+}
+
 func (r *PluginRegistry) DownloadPlugin(ctx context.Context, manifest PluginManifest) (string, error) {
 	// Determine OS and architecture
 	osArch := fmt.Sprintf("%s_%s", runtime.GOOS, runtime.GOARCH)
@@ -191,7 +228,17 @@ func (r *PluginRegistry) StartPlugin(ctx context.Context, pluginPath string, plu
 		return "", fmt.Errorf("failed to get stderr pipe: %w", err)
 	}
 
-	// Start logging stderr
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start plugin: %w", err)
+	}
+
+	// Store process for cleanup, forgetting how any earlier process exited
+	r.mu.Lock()
+	r.processes[pluginPath] = cmd
+	delete(r.exited, pluginPath)
+	r.mu.Unlock()
+
+	// Start logging stderr, once the process is running
 	go func() {
 		scanner := io.Reader(stderr)
 		buf := make([]byte, 1024)
@@ -204,16 +251,18 @@ func (r *PluginRegistry) StartPlugin(ctx context.Context, pluginPath string, plu
 				break
 			}
 		}
-	}()
 
-	if err := cmd.Start(); err != nil {
-		return "", fmt.Errorf("failed to start plugin: %w", err)
-	}
-
-	// Store process for cleanup
-	r.mu.Lock()
-	r.processes[pluginPath] = cmd
-	r.mu.Unlock()
+		// stderr is closed once the process exits, and
+		// every read from it has completed
+		err := cmd.Wait()
+		log.Printf("Plugin process %s exited: %v\n", pluginPath, err)
+		r.mu.Lock()
+		// A plugin restarted since is tracked by its new process
+		if r.processes[pluginPath] == cmd {
+			r.exited[pluginPath] = err
+		}
+		r.mu.Unlock()
+	}()
 
 	// Read the handshake from stdout
 	handshake := make([]byte, 1024)
@@ -285,7 +334,7 @@ func (r *PluginRegistry) LoadPlugin(ctx context.Context, name, version string) e
 		return fmt.Errorf("failed to start plugin: %w", err)
 	}
 
-	conn, err := grpc.NewClient(fmt.Sprintf("unix://%s", address), grpc.WithInsecure())
+	conn, err := grpc.NewClient(fmt.Sprintf("unix://%s", address), grpc.WithInsecure(), grpc.WithStatsHandler(tracing.ClientHandler()))
 	if err != nil {
 		return fmt.Errorf("failed to connect to plugin: %w", err)
 	}
@@ -293,6 +342,7 @@ func (r *PluginRegistry) LoadPlugin(ctx context.Context, name, version string) e
 
 	r.mu.Lock()
 	r.plugins[name] = client
+	r.loaded[name] = loadedPlugin{version: version, path: pluginPath, conn: conn}
 	r.mu.Unlock()
 
 	// We also need to get the supported interfaces
@@ -351,4 +401,45 @@ func (r *PluginRegistry) Shutdown() {
 	r.outputs = make(map[string]pb.OutputPluginClient)
 	r.plugins = make(map[string]pb.PluginClient)
 	r.processes = make(map[string]*exec.Cmd)
+	r.loaded = make(map[string]loadedPlugin)
+	r.exited = make(map[string]error)
+}
+
+// Plugins lists the loaded plugins by name. A plugin is healthy while its
+// process is running and its connection isn't failing or shut down
+func (r *PluginRegistry) Plugins() []PluginStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	plugins := make([]PluginStatus, 0, len(r.loaded))
+	for name, plugin := range r.loaded {
+		state := plugin.conn.GetState()
+		_, exited := r.exited[plugin.path]
+		plugins = append(plugins, PluginStatus{
+			Name:    name,
+			Version: plugin.version,
+			Path:    plugin.path,
+			State:   state.String(),
+			Running: !exited,
+			Healthy: !exited && state != connectivity.TransientFailure && state != connectivity.Shutdown,
+		})
+	}
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].Name < plugins[j].Name
+	})
+	return plugins
+}
+
+// Check returns an error naming the plugins that aren't healthy
+func (r *PluginRegistry) Check(ctx context.Context) error {
+	var unhealthy []string
+	for _, plugin := range r.Plugins() {
+		if !plugin.Healthy {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", plugin.Name, plugin.State))
+		}
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("unhealthy plugins: %s", strings.Join(unhealthy, ", "))
+	}
+	return nil
 }
@@ -0,0 +1,33 @@
+package sink
+
+import (
+	"context"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/internal/batcher"
+	"go.uber.org/zap"
+)
+
+const defaultBatchSize = 1000
+
+// ErrClosed is returned when pushing to a closed sink
+var ErrClosed = batcher.ErrClosed
+
+// writer stores a batch of entries
+type writer func(ctx context.Context, entries []Entry) error
+
+// newBatcher collects entries into batches for a sink's writer, writing
+// a batch once it's full or has waited long enough, and retrying failed
+// batches. Batches are written one at a time, so results are reported in order
+func newBatcher(name string, options config.SinkBatch, write writer, logger *zap.Logger) *batcher.Batcher[Entry] {
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultBatchSize
+	}
+	return batcher.New(batcher.Options{
+		BatchSize:  options.BatchSize,
+		BatchWait:  options.BatchWait,
+		BufferSize: options.BufferSize,
+		Retries:    options.Retries,
+		MinBackoff: options.MinBackoff,
+		MaxBackoff: options.MaxBackoff,
+	}, nil, batcher.Sender[Entry](write), logger.With(zap.String("sink", name)))
+}
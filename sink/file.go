@@ -0,0 +1,119 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/internal/batcher"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	defaultFileMaxBytes = 100 * 1024 * 1024
+	defaultFileMaxAge   = 24 * time.Hour
+
+	// fileTimeFormat names files after the time they were started,
+	// so they sort in the order they were written
+	fileTimeFormat = "20060102T150405.000000000Z"
+)
+
+// File writes entries to newline delimited JSON files in a directory.
+// Each batch is synced to disk before its entries are reported stored
+type File struct {
+	*batcher.Batcher[Entry]
+	cfg    config.FileSink
+	logger *zap.Logger
+
+	// The current file is only used by the batcher's goroutine
+	current *os.File
+	started time.Time
+	size    int64
+}
+
+func NewFile(cfg config.FileSink, logger *zap.Logger) (*File, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("file sink dir is not set")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultFileMaxBytes
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultFileMaxAge
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	f := &File{cfg: cfg, logger: logger}
+	f.Batcher = newBatcher(config.SinkFile, cfg.SinkBatch, f.write, logger)
+	return f, nil
+}
+
+func (f *File) write(_ context.Context, entries []Entry) error {
+	content, err := appendNDJSON(nil, entries)
+	if err != nil {
+		return err
+	}
+
+	if f.current == nil || f.size >= f.cfg.MaxBytes || time.Since(f.started) >= f.cfg.MaxAge {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.current.Write(content)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return f.current.Sync()
+}
+
+// rotate closes the current file and starts a new one,
+// removing the oldest files beyond those kept
+func (f *File) rotate() error {
+	if f.current != nil {
+		if err := f.current.Close(); err != nil {
+			f.logger.Error("failed to close log file", zap.String("file", f.current.Name()), zap.Error(err))
+		}
+		f.current = nil
+	}
+
+	started := time.Now().UTC()
+	name := filepath.Join(f.cfg.Dir, fmt.Sprintf("parsed-%s.ndjson", started.Format(fileTimeFormat)))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create log file: %w", err)
+	}
+	f.current, f.started, f.size = file, started, 0
+	f.logger.Debug("started log file", zap.String("file", name))
+
+	if f.cfg.MaxFiles <= 0 {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(f.cfg.Dir, "parsed-*.ndjson"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for len(names) > f.cfg.MaxFiles {
+		if err := os.Remove(names[0]); err != nil {
+			f.logger.Error("failed to remove log file", zap.String("file", names[0]), zap.Error(err))
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+func (f *File) Close(ctx context.Context) error {
+	err := f.Batcher.Close(ctx)
+	if f.current != nil {
+		err = errors.Join(err, f.current.Close())
+	}
+	return err
+}
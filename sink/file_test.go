@@ -0,0 +1,46 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFile(config.FileSink{Dir: dir, MaxBytes: 1, MaxFiles: 2, SinkBatch: config.SinkBatch{BatchSize: 2}}, zap.NewNop())
+	assert.NoError(t, err)
+
+	results := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, f.Push(context.Background(), Entry{Id: "id", Timestamp: time.Now(), Data: `{}`}, func(err error) { results <- err }))
+		if i%2 == 1 {
+			// Each batch is written to a new file, as the last is full
+			for j := 0; j < 2; j++ {
+				assert.NoError(t, <-results)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	assert.NoError(t, f.Close(context.Background()))
+
+	// Only the newest files are kept
+	names, err := filepath.Glob(filepath.Join(dir, "parsed-*.ndjson"))
+	assert.NoError(t, err)
+	assert.Len(t, names, 2)
+
+	file, err := os.Open(names[1])
+	assert.NoError(t, err)
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lines++
+	}
+	assert.Equal(t, 2, lines)
+}
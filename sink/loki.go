@@ -0,0 +1,51 @@
+package sink
+
+import (
+	"context"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/loki"
+	"go.uber.org/zap"
+)
+
+// Loki stores entries as streams labelled by their source
+type Loki struct {
+	client *loki.Client
+}
+
+func NewLoki(cfg config.Loki, logger *zap.Logger) *Loki {
+	return &Loki{client: loki.NewClient(cfg, logger)}
+}
+
+func (l *Loki) Push(ctx context.Context, entry Entry, done func(error)) error {
+	labels := map[string]string{
+		"source_type": entry.SourceType,
+		"source_name": entry.SourceName,
+	}
+	for name, value := range entry.Labels {
+		labels[name] = value
+	}
+	metadata := map[string]string{"log_id": entry.SourceId}
+	for name, value := range entry.Metadata {
+		metadata[name] = value
+	}
+
+	return l.client.Push(ctx, loki.Entry{
+		Labels:    labels,
+		Timestamp: entry.Timestamp,
+		Line:      entry.Data,
+		Metadata:  metadata,
+	}, done)
+}
+
+// Ping checks Loki is ready
+func (l *Loki) Ping(ctx context.Context) error {
+	return l.client.Ready(ctx)
+}
+
+func (l *Loki) Flush(ctx context.Context) error {
+	return l.client.Flush(ctx)
+}
+
+func (l *Loki) Close(ctx context.Context) error {
+	return l.client.Close(ctx)
+}
@@ -0,0 +1,159 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/internal/batcher"
+	"github.com/kytheron-org/kytheron/model"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+const (
+	partitionPrefix = "parsed_logs_"
+	partitionFormat = "20060102"
+	partitionPeriod = 24 * time.Hour
+)
+
+// Postgres writes entries to the parsed_logs table, creating
+// the daily partitions entries fall in as they arrive
+type Postgres struct {
+	*batcher.Batcher[Entry]
+	cfg     config.PostgresSink
+	db      *pgxpool.Pool
+	queries *model.Queries
+	logger  *zap.Logger
+
+	// partitions known to exist, only used by the batcher's goroutine
+	partitions map[string]struct{}
+}
+
+func NewPostgres(cfg config.PostgresSink, db *pgxpool.Pool, logger *zap.Logger) *Postgres {
+	p := &Postgres{
+		cfg:        cfg,
+		db:         db,
+		queries:    model.New(db),
+		logger:     logger,
+		partitions: make(map[string]struct{}),
+	}
+	p.Batcher = newBatcher(config.SinkPostgres, cfg.SinkBatch, p.write, logger)
+	return p
+}
+
+func (p *Postgres) write(ctx context.Context, entries []Entry) error {
+	rows := make([]model.InsertParsedLogsParams, 0, len(entries))
+	for _, entry := range entries {
+		row, err := parsedLogParams(entry)
+		if err != nil {
+			return err
+		}
+		if err := p.partition(ctx, entry.Timestamp); err != nil {
+			return err
+		}
+		rows = append(rows, row)
+	}
+
+	_, err := p.queries.InsertParsedLogs(ctx, rows)
+	if err != nil {
+		return fmt.Errorf("failed to insert parsed logs: %w", err)
+	}
+	return nil
+}
+
+// parsedLogParams converts an entry to a row of the parsed_logs table
+func parsedLogParams(entry Entry) (model.InsertParsedLogsParams, error) {
+	row := model.InsertParsedLogsParams{
+		SourceType: entry.SourceType,
+		SourceName: entry.SourceName,
+		Timestamp:  pgtype.Timestamptz{Time: entry.Timestamp, Valid: true},
+		Data:       jsonData(entry.Data),
+	}
+	if err := row.ID.Scan(entry.Id); err != nil {
+		return row, fmt.Errorf("invalid parsed log id %q: %w", entry.Id, err)
+	}
+	if entry.SourceId != "" {
+		if err := row.SourceID.Scan(entry.SourceId); err != nil {
+			return row, fmt.Errorf("invalid log id %q: %w", entry.SourceId, err)
+		}
+	}
+
+	var err error
+	if len(entry.Labels) > 0 {
+		if row.Labels, err = json.Marshal(entry.Labels); err != nil {
+			return row, err
+		}
+	}
+	if len(entry.Metadata) > 0 {
+		if row.Metadata, err = json.Marshal(entry.Metadata); err != nil {
+			return row, err
+		}
+	}
+	return row, nil
+}
+
+// partition creates the partition holding logs from the day of
+// the timestamp, dropping those past retention whenever a day starts
+func (p *Postgres) partition(ctx context.Context, timestamp time.Time) error {
+	start := timestamp.UTC().Truncate(partitionPeriod)
+	name := partitionPrefix + start.Format(partitionFormat)
+	if _, ok := p.partitions[name]; ok {
+		return nil
+	}
+
+	_, err := p.db.Exec(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s PARTITION OF parsed_logs FOR VALUES FROM ('%s') TO ('%s')`,
+		name, start.Format(time.RFC3339), start.Add(partitionPeriod).Format(time.RFC3339),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create partition %s: %w", name, err)
+	}
+	p.partitions[name] = struct{}{}
+	p.logger.Info("created parsed logs partition", zap.String("partition", name))
+
+	if p.cfg.Retention > 0 {
+		if err := p.dropExpired(ctx); err != nil {
+			p.logger.Error("failed to drop expired partitions", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// dropExpired drops the partitions whose logs are all past retention
+func (p *Postgres) dropExpired(ctx context.Context) error {
+	rows, err := p.db.Query(ctx, `SELECT inhrelid::regclass::text FROM pg_inherits WHERE inhparent = 'parsed_logs'::regclass`)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-p.cfg.Retention)
+	for _, name := range names {
+		day, err := time.Parse(partitionFormat, strings.TrimPrefix(name, partitionPrefix))
+		if err != nil || !day.Add(partitionPeriod).Before(cutoff) {
+			continue
+		}
+		if _, err := p.db.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, name)); err != nil {
+			return fmt.Errorf("failed to drop partition %s: %w", name, err)
+		}
+		delete(p.partitions, name)
+		p.logger.Info("dropped expired parsed logs partition", zap.String("partition", name))
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package sink
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParsedLogParams(t *testing.T) {
+	timestamp := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	row, err := parsedLogParams(Entry{
+		Id:         "0b2f6a52-3f0f-11f0-9fe2-0242ac120002",
+		SourceType: "cloudtrail",
+		SourceName: "audit",
+		Timestamp:  timestamp,
+		Data:       `{"a":1}`,
+		Labels:     map[string]string{"region": "us-east-1"},
+	})
+	assert.NoError(t, err)
+	assert.True(t, row.ID.Valid)
+	assert.False(t, row.SourceID.Valid)
+	assert.Equal(t, timestamp, row.Timestamp.Time)
+	assert.JSONEq(t, `{"a":1}`, string(row.Data))
+	assert.JSONEq(t, `{"region":"us-east-1"}`, string(row.Labels))
+	assert.Nil(t, row.Metadata)
+
+	_, err = parsedLogParams(Entry{Id: "parsed-1"})
+	assert.ErrorContains(t, err, "invalid parsed log id")
+}
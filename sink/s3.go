@@ -0,0 +1,208 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/internal/batcher"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region  = "us-east-1"
+	defaultS3Timeout = 30 * time.Second
+
+	amzDateFormat = "20060102T150405Z"
+)
+
+// S3 writes each batch of entries as a gzipped newline delimited
+// JSON object to an S3 compatible bucket, signing requests with
+// AWS Signature Version 4
+type S3 struct {
+	*batcher.Batcher[Entry]
+	cfg      config.S3Sink
+	endpoint *url.URL
+	http     *http.Client
+	logger   *zap.Logger
+}
+
+func NewS3(cfg config.S3Sink, logger *zap.Logger) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 sink endpoint and bucket must be set")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultS3Timeout
+	}
+
+	s := &S3{
+		cfg:      cfg,
+		endpoint: endpoint,
+		http:     &http.Client{Timeout: cfg.Timeout},
+		logger:   logger,
+	}
+	s.Batcher = newBatcher(config.SinkS3, cfg.SinkBatch, s.write, logger)
+	return s, nil
+}
+
+func (s *S3) write(ctx context.Context, entries []Entry) error {
+	content, err := appendNDJSON(nil, entries)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if _, err := gz.Write(content); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	key := s.key(now)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectUrl(key), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	s.sign(req, body.Bytes(), now)
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	s.logger.Debug("wrote object", zap.String("bucket", s.cfg.Bucket), zap.String("key", key), zap.Int("entries", len(entries)))
+	return nil
+}
+
+// key names an object after the hour it was written in,
+// so objects can be listed and expired by time
+func (s *S3) key(now time.Time) string {
+	name := fmt.Sprintf("%s/%s-%s.ndjson.gz", now.Format("2006/01/02/15"), now.Format(fileTimeFormat), uuid.NewString())
+	if prefix := strings.Trim(s.cfg.Prefix, "/"); prefix != "" {
+		return prefix + "/" + name
+	}
+	return name
+}
+
+func (s *S3) objectUrl(key string) string {
+	u := *s.endpoint
+	if s.cfg.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	return u.String()
+}
+
+// sign adds a Signature Version 4 authorization header,
+// covering the host and every header already on the request
+func (s *S3) sign(req *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+	if s.cfg.AccessKeyId == "" {
+		// Anonymous access, for stores allowing it
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	date := now.Format("20060102")
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(amzDateFormat),
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	key = hmacSha256(key, s.cfg.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyId, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes a path as Signature Version 4 expects,
+// leaving only unreserved characters and slashes as they are
+func uriEncode(path string) string {
+	var sb strings.Builder
+	for _, b := range []byte(path) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/':
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
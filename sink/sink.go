@@ -0,0 +1,228 @@
+package sink
+
+// This package stores parsed logs long term, in any combination of
+// Loki, local files, Postgres and S3 compatible object storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kytheron-org/kytheron/config"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Entry is a parsed log to store
+type Entry struct {
+	Id         string
+	SourceId   string
+	SourceType string
+	SourceName string
+	Timestamp  time.Time
+	// Data is the parsed log, as JSON
+	Data string
+	// Labels identify the stream of logs the entry belongs to
+	Labels map[string]string
+	// Metadata holds values too varied to be labels
+	Metadata map[string]string
+}
+
+// Sink stores parsed logs. Entries are stored asynchronously, usually in
+// batches, with done called once with the result of storing each entry.
+// When Push returns an error, the entry wasn't accepted and done isn't called
+type Sink interface {
+	// Push blocks while the sink has too many entries waiting to be
+	// stored, holding back the caller rather than dropping entries
+	Push(ctx context.Context, entry Entry, done func(error)) error
+	// Flush stores the entries pushed so far
+	Flush(ctx context.Context) error
+	// Close stores the entries pushed so far and stops the sink
+	Close(ctx context.Context) error
+}
+
+// Pinger is implemented by sinks that can check
+// whatever they store entries in is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks the sink is reachable, when it can tell
+func Ping(ctx context.Context, s Sink) error {
+	if pinger, ok := s.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// New opens the configured sinks, returning nil when none are configured.
+// The database is only needed by the postgres sink
+func New(cfg *config.Config, db *pgxpool.Pool, logger *zap.Logger) (Sink, error) {
+	names := cfg.Storage.Sinks
+	if len(names) == 0 && cfg.Loki.Url != "" {
+		names = []string{config.SinkLoki}
+	}
+
+	var sinks []Sink
+	for _, name := range names {
+		var s Sink
+		var err error
+		switch name {
+		case config.SinkLoki:
+			if cfg.Loki.Url == "" {
+				err = errors.New("loki url is not set")
+				break
+			}
+			s = NewLoki(cfg.Loki, logger)
+		case config.SinkFile:
+			s, err = NewFile(cfg.Storage.File, logger)
+		case config.SinkPostgres:
+			if db == nil {
+				err = errors.New("database url is not set")
+				break
+			}
+			s = NewPostgres(cfg.Storage.Postgres, db, logger)
+		case config.SinkS3:
+			s, err = NewS3(cfg.Storage.S3, logger)
+		default:
+			err = errors.New("unknown sink")
+		}
+		if err != nil {
+			closeAll(sinks)
+			return nil, fmt.Errorf("failed to open %s sink: %w", name, err)
+		}
+		sinks = append(sinks, s)
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return sinks[0], nil
+	default:
+		return Multi(sinks...), nil
+	}
+}
+
+func closeAll(sinks []Sink) {
+	for _, s := range sinks {
+		s.Close(context.Background())
+	}
+}
+
+// multi stores entries in several sinks, reporting an entry
+// as stored once every sink has stored it
+type multi struct {
+	sinks []Sink
+}
+
+// Multi combines sinks, storing each entry in all of them
+func Multi(sinks ...Sink) Sink {
+	return &multi{sinks: sinks}
+}
+
+// result collects the results of storing an entry in each sink
+type result struct {
+	mu        sync.Mutex
+	remaining int
+	errs      []error
+	done      func(error)
+}
+
+func (r *result) report(err error) {
+	r.mu.Lock()
+	if err != nil {
+		r.errs = append(r.errs, err)
+	}
+	r.remaining--
+	remaining := r.remaining
+	r.mu.Unlock()
+
+	if remaining == 0 && r.done != nil {
+		r.done(errors.Join(r.errs...))
+	}
+}
+
+func (m *multi) Push(ctx context.Context, entry Entry, done func(error)) error {
+	r := &result{remaining: len(m.sinks), done: done}
+	for i, s := range m.sinks {
+		if err := s.Push(ctx, entry, r.report); err != nil {
+			// Nothing was accepted yet, so the entry can be refused
+			if i == 0 {
+				return err
+			}
+			r.report(err)
+		}
+	}
+	return nil
+}
+
+func (m *multi) Ping(ctx context.Context) error {
+	var errs []error
+	for _, s := range m.sinks {
+		errs = append(errs, Ping(ctx, s))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *multi) Flush(ctx context.Context) error {
+	var errs []error
+	for _, s := range m.sinks {
+		errs = append(errs, s.Flush(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *multi) Close(ctx context.Context) error {
+	var errs []error
+	for _, s := range m.sinks {
+		errs = append(errs, s.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// record is an entry as written to files and objects
+type record struct {
+	Id         string            `json:"id"`
+	SourceId   string            `json:"source_id"`
+	SourceType string            `json:"source_type"`
+	SourceName string            `json:"source_name"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Data       json.RawMessage   `json:"data"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// jsonData returns the entry's data as JSON, quoting
+// data that isn't, so it's kept rather than rejected
+func jsonData(data string) json.RawMessage {
+	if json.Valid([]byte(data)) {
+		return json.RawMessage(data)
+	}
+	quoted, _ := json.Marshal(data)
+	return quoted
+}
+
+// appendNDJSON appends entries as newline delimited JSON records
+func appendNDJSON(buf []byte, entries []Entry) ([]byte, error) {
+	for _, entry := range entries {
+		line, err := json.Marshal(record{
+			Id:         entry.Id,
+			SourceId:   entry.SourceId,
+			SourceType: entry.SourceType,
+			SourceName: entry.SourceName,
+			Timestamp:  entry.Timestamp,
+			Data:       jsonData(entry.Data),
+			Labels:     entry.Labels,
+			Metadata:   entry.Metadata,
+		})
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	return buf, nil
+}
@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// stub reports each entry with a fixed result
+type stub struct {
+	err     error
+	entries []Entry
+}
+
+func (s *stub) Push(_ context.Context, entry Entry, done func(error)) error {
+	s.entries = append(s.entries, entry)
+	done(s.err)
+	return nil
+}
+
+func (s *stub) Flush(context.Context) error { return nil }
+func (s *stub) Close(context.Context) error { return nil }
+
+func TestMulti(t *testing.T) {
+	stored, failed := &stub{}, &stub{err: errors.New("unavailable")}
+
+	var results []error
+	s := Multi(stored, failed)
+	assert.NoError(t, s.Push(context.Background(), Entry{Id: "1"}, func(err error) { results = append(results, err) }))
+
+	// An entry is only stored once every sink has stored it
+	assert.Len(t, stored.entries, 1)
+	assert.Len(t, failed.entries, 1)
+	assert.Len(t, results, 1)
+	assert.ErrorContains(t, results[0], "unavailable")
+
+	results = nil
+	s = Multi(stored, &stub{})
+	assert.NoError(t, s.Push(context.Background(), Entry{Id: "2"}, func(err error) { results = append(results, err) }))
+	assert.Equal(t, []error{nil}, results)
+}
+
+func TestAppendNDJSON(t *testing.T) {
+	content, err := appendNDJSON(nil, []Entry{
+		{Id: "1", Data: `{"a":1}`},
+		{Id: "2", Data: `not json`},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ""+
+		`{"id":"1","source_id":"","source_type":"","source_name":"","timestamp":"0001-01-01T00:00:00Z","data":{"a":1}}`+"\n"+
+		`{"id":"2","source_id":"","source_type":"","source_name":"","timestamp":"0001-01-01T00:00:00Z","data":"not json"}`+"\n",
+		string(content))
+}
@@ -0,0 +1,130 @@
+package tracing
+
+// This package traces each log through the pipeline, from the source
+// plugin streaming it through parsing, evaluation and output dispatch.
+// Trace context crosses the queues between stages in message headers,
+// and the calls to plugins in gRPC metadata
+
+import (
+	"context"
+	"fmt"
+	"github.com/kytheron-org/kytheron/config"
+	"github.com/kytheron-org/kytheron/queue"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/stats"
+	"strconv"
+)
+
+const (
+	instrumentationName = "github.com/kytheron-org/kytheron"
+	defaultServiceName  = "kytheron"
+)
+
+// Attributes of the pipeline's spans
+const (
+	LogIdKey       = attribute.Key("kytheron.log_id")
+	ParsedLogIdKey = attribute.Key("kytheron.parsed_log_id")
+	SourceKey      = attribute.Key("kytheron.source")
+	ParserKey      = attribute.Key("kytheron.parser")
+	PolicyKey      = attribute.Key("kytheron.policy")
+	EvaluationKey  = attribute.Key("kytheron.evaluation")
+	OutputKey      = attribute.Key("kytheron.output")
+	HitsKey        = attribute.Key("kytheron.hits")
+)
+
+func init() {
+	// Trace context is carried in the W3C format, whether or not traces are exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Tracer starts the pipeline's spans
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// NewProvider creates a tracer provider, batching spans to the exporter
+func NewProvider(cfg config.Tracing, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+}
+
+// Setup exports traces to the configured OTLP collector, returning a
+// function that flushes the spans yet to be exported and stops exporting.
+// Without an endpoint, spans aren't recorded and nothing is exported
+func Setup(ctx context.Context, cfg config.Tracing) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	provider := NewProvider(cfg, exporter)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Inject adds the trace context of ctx to a message's headers
+func Inject(ctx context.Context, headers map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+}
+
+// Extract returns ctx carrying the trace context of a message's headers
+func Extract(ctx context.Context, headers map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// MessageAttributes locate a message within its topic
+func MessageAttributes(msg *queue.Message) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingDestinationName(msg.Topic),
+		semconv.MessagingDestinationPartitionID(strconv.Itoa(int(msg.Partition))),
+		semconv.MessagingKafkaOffset(int(msg.Offset)),
+	}
+}
+
+// ServerHandler traces the calls to a gRPC server, other than health checks
+func ServerHandler() stats.Handler {
+	return otelgrpc.NewServerHandler(otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))
+}
+
+// ClientHandler traces the calls made to plugins, passing on the trace context
+func ClientHandler() stats.Handler {
+	return otelgrpc.NewClientHandler()
+}
+
+// End ends the span, recording the error it failed with, if any
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}